@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/internal/logging"
+	"sync/internal/server"
+	"sync/internal/sync_engine"
+	"time"
+)
+
+// Config holds every setting of the sync server.
+//
+// Settings are resolved in this order, later sources win:
+//   - the defaults below
+//   - the config file passed with -config or SYNC_CONFIG (.json or .toml)
+//   - environment variables, SYNC_ followed by the flag name in upper case
+//     with dashes replaced by underscores, e.g. SYNC_DB_BUSY_TIMEOUT
+//   - command line flags
+//
+// The config file uses the flag names as keys, e.g. "max-page-size": 500.
+type Config struct {
+	Addr                 string
+	MetricsAddr          string
+	DatabasePath         string
+	DatabaseMaxOpenConns int
+	DatabaseMaxIdleConns int
+	DatabaseBusyTimeout  time.Duration
+	CompactionInterval   time.Duration
+	ShutdownTimeout      time.Duration
+	TableSchemas         string
+	ClientKeys           string
+	LogFormat            string
+	LogLevel             string
+
+	// AuthSecret can't be passed as a flag, command lines are visible to
+	// every user of the machine
+	AuthSecret string
+
+	// MigrateDryRun is only read from the command line
+	MigrateDryRun bool
+
+	Server server.Config
+	Sync   sync_engine.Config
+}
+
+func defaultConfig() Config {
+	return Config{
+		Addr:                 ":3001",
+		DatabasePath:         "./sync.db",
+		DatabaseMaxOpenConns: 20,
+		DatabaseMaxIdleConns: 20,
+		DatabaseBusyTimeout:  5 * time.Second,
+		CompactionInterval:   10 * time.Minute,
+		ShutdownTimeout:      30 * time.Second,
+		LogFormat:            "text",
+		LogLevel:             "info",
+		Server:               server.DefaultConfig(),
+		Sync:                 sync_engine.DefaultConfig(),
+	}
+}
+
+// commandLineOnly flags are neither read from the environment nor the config file.
+var commandLineOnly = map[string]bool{
+	"config":          true,
+	"migrate-dry-run": true,
+}
+
+// secretFlags are settings that are rejected on the command line.
+var secretFlags = map[string]bool{
+	"auth-secret": true,
+}
+
+// bind registers a flag for every setting that writes directly into config.
+func (config *Config) bind(flags *flag.FlagSet) {
+	flags.StringVar(&config.Addr, "addr", config.Addr, "Address to listen on")
+	flags.StringVar(&config.MetricsAddr, "metrics-addr", config.MetricsAddr, "Separate address serving /metrics without authentication, if empty /metrics is served on addr and needs a token")
+	flags.StringVar(&config.DatabasePath, "db", config.DatabasePath, "Path of the SQLite database")
+	flags.IntVar(&config.DatabaseMaxOpenConns, "db-max-open-conns", config.DatabaseMaxOpenConns, "Maximum open database connections")
+	flags.IntVar(&config.DatabaseMaxIdleConns, "db-max-idle-conns", config.DatabaseMaxIdleConns, "Maximum idle database connections")
+	flags.DurationVar(&config.DatabaseBusyTimeout, "db-busy-timeout", config.DatabaseBusyTimeout, "How long SQLite waits for a locked database")
+	flags.DurationVar(&config.CompactionInterval, "compaction-interval", config.CompactionInterval, "Time between compaction runs")
+	flags.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "How long in-flight requests get to finish on SIGTERM")
+	flags.StringVar(&config.TableSchemas, "table-schemas", config.TableSchemas, "JSON file with the table schemas operations must match, all tables are accepted if empty")
+	flags.StringVar(&config.ClientKeys, "client-keys", config.ClientKeys, "JSON file with the HMAC keys clients sign their syncs with, clients without a key don't sign")
+	flags.StringVar(&config.LogFormat, "log-format", config.LogFormat, "Log output format: text or json")
+	flags.StringVar(&config.LogLevel, "log-level", config.LogLevel, "Minimum log level: debug, info, warn or error")
+	flags.StringVar(&config.AuthSecret, "auth-secret", config.AuthSecret, "Secret for signing access tokens, only accepted from SYNC_AUTH_SECRET or the config file")
+	flags.IntVar(&config.Server.MaxConcurrentConnections, "max-concurrent-connections", config.Server.MaxConcurrentConnections, "Sync and snapshot requests handled at once")
+	flags.IntVar(&config.Server.MaxQueuedRequests, "max-queued-requests", config.Server.MaxQueuedRequests, "Requests that can wait for a free slot when the concurrency limit is reached")
+	flags.DurationVar(&config.Server.QueueTimeout, "queue-timeout", config.Server.QueueTimeout, "How long a queued request waits for a free slot")
+	flags.Float64Var(&config.Server.ClientRate, "client-rate", config.Server.ClientRate, "Syncs per second allowed per client ID, 0 disables the limit")
+	flags.IntVar(&config.Server.ClientBurst, "client-burst", config.Server.ClientBurst, "Syncs a client ID can send at once")
+	flags.Float64Var(&config.Server.IPRate, "ip-rate", config.Server.IPRate, "Requests per second allowed per remote address, 0 disables the limit")
+	flags.IntVar(&config.Server.IPBurst, "ip-burst", config.Server.IPBurst, "Requests a remote address can send at once")
+	flags.BoolVar(&config.Server.TrustForwardedFor, "trust-forwarded-for", config.Server.TrustForwardedFor, "Rate limit by X-Forwarded-For, only enable behind a proxy that sets it")
+	flags.Var((*stringList)(&config.Server.Cors.AllowedOrigins), "cors-origins", "Comma separated browser origins allowed to call the server, * allows all")
+	flags.BoolVar(&config.Server.Cors.AllowCredentials, "cors-allow-credentials", config.Server.Cors.AllowCredentials, "Allow browsers to send credentials, needs explicit cors-origins")
+	flags.DurationVar(&config.Server.Cors.MaxAge, "cors-max-age", config.Server.Cors.MaxAge, "How long browsers may cache CORS preflight responses")
+	flags.Int64Var(&config.Server.MaxBodyBytes, "max-body-bytes", config.Server.MaxBodyBytes, "Maximum size of a sync request body")
+	flags.IntVar(&config.Server.MaxOperations, "max-operations", config.Server.MaxOperations, "Maximum operations in a single sync request")
+	flags.IntVar(&config.Server.MaxValueBytes, "max-value-bytes", config.Server.MaxValueBytes, "Maximum encoded size of a single operation value")
+	flags.IntVar(&config.Server.MaxEventStreams, "max-event-streams", config.Server.MaxEventStreams, "Event streams open at once per namespace")
+	flags.IntVar(&config.Sync.DefaultPageSize, "default-page-size", config.Sync.DefaultPageSize, "Operations returned per sync when the client has no preference")
+	flags.IntVar(&config.Sync.MaxPageSize, "max-page-size", config.Sync.MaxPageSize, "Maximum operations a client can ask for per sync")
+	flags.BoolVar(&config.Sync.AllowUnregisteredClients, "allow-unregistered-clients", config.Sync.AllowUnregisteredClients, "Accept unsigned syncs from client IDs that weren't issued by POST /clients and have no key, only for legacy clients")
+	flags.BoolVar(&config.MigrateDryRun, "migrate-dry-run", config.MigrateDryRun, "Check pending schema migrations without applying them, then exit")
+}
+
+// stringList is a comma separated flag value. Setting it replaces the list,
+// so later sources override earlier ones instead of adding to them.
+type stringList []string
+
+func (list *stringList) String() string {
+	if list == nil {
+		return ""
+	}
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*list = append(*list, item)
+		}
+	}
+	return nil
+}
+
+// loadConfig resolves the config from the command line arguments (without
+// the program name), the environment and the config file, and validates it.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	config := defaultConfig()
+
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := flags.String("config", "", "JSON or TOML config file, see Config for the precedence of settings")
+	config.bind(flags)
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	// Remember what was passed on the command line, it's applied again
+	// last so it wins over the file and the environment
+	commandLine := make(map[string]string)
+	var commandLineErr error
+	flags.Visit(func(f *flag.Flag) {
+		if secretFlags[f.Name] {
+			commandLineErr = fmt.Errorf("-%s can't be passed on the command line, use %s or the config file", f.Name, envName(f.Name))
+		}
+		commandLine[f.Name] = f.Value.String()
+	})
+	if commandLineErr != nil {
+		return Config{}, commandLineErr
+	}
+
+	path := *configPath
+	if envPath, ok := lookupEnv("SYNC_CONFIG"); ok && path == "" {
+		path = envPath
+	}
+	if path != "" {
+		settings, err := readConfigFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		if err := applySettings(flags, settings); err != nil {
+			return Config{}, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+
+	var envErr error
+	flags.VisitAll(func(f *flag.Flag) {
+		if commandLineOnly[f.Name] || envErr != nil {
+			return
+		}
+		if value, ok := lookupEnv(envName(f.Name)); ok {
+			if err := flags.Set(f.Name, value); err != nil {
+				envErr = fmt.Errorf("%s: %w", envName(f.Name), err)
+			}
+		}
+	})
+	if envErr != nil {
+		return Config{}, envErr
+	}
+
+	for name, value := range commandLine {
+		if err := flags.Set(name, value); err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config: %w", err)
+	}
+	return config, nil
+}
+
+// envName returns the environment variable of a flag, e.g. SYNC_MAX_PAGE_SIZE.
+func envName(flagName string) string {
+	return "SYNC_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applySettings sets flags from config file settings, in name order so the
+// same file always reports the same error.
+func applySettings(flags *flag.FlagSet, settings map[string]string) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if commandLineOnly[name] || flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		if err := flags.Set(name, settings[name]); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Validate reports the first setting that can't be used.
+func (config Config) Validate() error {
+	if config.Addr == "" {
+		return errors.New("addr is required")
+	}
+	if config.DatabasePath == "" {
+		return errors.New("db is required")
+	}
+	if config.DatabaseMaxOpenConns <= 0 {
+		return fmt.Errorf("db-max-open-conns must be positive, got %d", config.DatabaseMaxOpenConns)
+	}
+	if config.DatabaseMaxIdleConns < 0 || config.DatabaseMaxIdleConns > config.DatabaseMaxOpenConns {
+		return fmt.Errorf("db-max-idle-conns must be between 0 and db-max-open-conns, got %d", config.DatabaseMaxIdleConns)
+	}
+	if config.DatabaseBusyTimeout < 0 {
+		return fmt.Errorf("db-busy-timeout can't be negative, got %s", config.DatabaseBusyTimeout)
+	}
+	if config.CompactionInterval <= 0 {
+		return fmt.Errorf("compaction-interval must be positive, got %s", config.CompactionInterval)
+	}
+	if config.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown-timeout must be positive, got %s", config.ShutdownTimeout)
+	}
+	if _, err := logging.NewLogger(io.Discard, config.LogFormat, config.LogLevel); err != nil {
+		return err
+	}
+	if err := config.Server.Validate(); err != nil {
+		return err
+	}
+	return config.Sync.Validate()
+}
+
+// databaseDSN returns the SQLite connection string for the configured database.
+func (config Config) databaseDSN() string {
+	return fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=%d", config.DatabasePath, config.DatabaseBusyTimeout.Milliseconds())
+}
+
+// ------------------------------------------------------------------------
+// Config files
+// ------------------------------------------------------------------------
+
+// readConfigFile reads the settings of a .json or .toml file as strings,
+// they are parsed by the flags they belong to.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var settings map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		settings, err = parseJSONSettings(data)
+	case ".toml":
+		settings, err = parseTOMLSettings(data)
+	default:
+		return nil, fmt.Errorf("config file %s must end in .json or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// parseJSONSettings reads a flat JSON object of strings, numbers and booleans.
+func parseJSONSettings(data []byte) (map[string]string, error) {
+	var document map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]string, len(document))
+	for name, value := range document {
+		switch value := value.(type) {
+		case string:
+			settings[name] = value
+		case json.Number:
+			settings[name] = value.String()
+		case bool:
+			settings[name] = strconv.FormatBool(value)
+		default:
+			return nil, fmt.Errorf("%s must be a string, number or boolean", name)
+		}
+	}
+	return settings, nil
+}
+
+// parseTOMLSettings reads the subset of TOML the config needs: top level
+// key = value pairs with string, number and boolean values, and comments.
+// Durations are strings such as "5s".
+func parseTOMLSettings(data []byte) (map[string]string, error) {
+	settings := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: tables are not supported", i+1)
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		if _, duplicate := settings[name]; duplicate {
+			return nil, fmt.Errorf("line %d: %s is set twice", i+1, name)
+		}
+
+		parsed, err := parseTOMLValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		settings[name] = parsed
+	}
+	return settings, nil
+}
+
+// parseTOMLValue parses a single value followed by an optional comment.
+func parseTOMLValue(value string) (string, error) {
+	var parsed, rest string
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := 1
+		for end < len(value) && value[end] != '"' {
+			if value[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(value) {
+			return "", errors.New("unterminated string")
+		}
+		unquoted, err := strconv.Unquote(value[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", value[:end+1])
+		}
+		parsed, rest = unquoted, value[end+1:]
+	case strings.HasPrefix(value, "'"):
+		end := strings.IndexByte(value[1:], '\'')
+		if end < 0 {
+			return "", errors.New("unterminated string")
+		}
+		parsed, rest = value[1:end+1], value[end+2:]
+	default:
+		parsed, rest, _ = strings.Cut(value, "#")
+		parsed = strings.TrimSpace(parsed)
+		rest = ""
+		if parsed != "true" && parsed != "false" {
+			parsed = strings.ReplaceAll(parsed, "_", "")
+			if _, err := strconv.ParseFloat(parsed, 64); err != nil {
+				return "", fmt.Errorf("invalid value %q, strings must be quoted", value)
+			}
+		}
+	}
+
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %q after value", rest)
+	}
+	return parsed, nil
+}
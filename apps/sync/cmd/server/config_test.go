@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// -------------------- Config loading tests --------------------
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	tomlPath := filepath.Join(dir, "server.toml")
+	os.WriteFile(tomlPath, []byte(`
+# Staging
+addr = ":4000"
+db = '/var/lib/sync/sync.db' # literal string
+db-busy-timeout = "2s"
+max-page-size = 2_000
+auth-secret = "file-secret"
+`), 0o600)
+	jsonPath := filepath.Join(dir, "server.json")
+	os.WriteFile(jsonPath, []byte(`{"addr": ":5000", "default-page-size": 10, "log-format": "json"}`), 0o600)
+	unknownPath := filepath.Join(dir, "unknown.json")
+	os.WriteFile(unknownPath, []byte(`{"port": 5000}`), 0o600)
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		check   func(t *testing.T, config Config)
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, config Config) {
+				if config.Addr != ":3001" || config.Sync.DefaultPageSize != 1000 || config.Server.MaxConcurrentConnections != 100 {
+					t.Errorf("unexpected defaults %+v", config)
+				}
+			},
+		},
+		{
+			name: "toml file",
+			args: []string{"-config", tomlPath},
+			check: func(t *testing.T, config Config) {
+				if config.Addr != ":4000" || config.DatabasePath != "/var/lib/sync/sync.db" ||
+					config.DatabaseBusyTimeout != 2*time.Second || config.Sync.MaxPageSize != 2000 || config.AuthSecret != "file-secret" {
+					t.Errorf("file settings not applied %+v", config)
+				}
+				if config.databaseDSN() != "/var/lib/sync/sync.db?_journal_mode=WAL&_busy_timeout=2000" {
+					t.Errorf("unexpected DSN %s", config.databaseDSN())
+				}
+			},
+		},
+		{
+			name: "env overrides file, flags override env",
+			args: []string{"-addr", ":7000"},
+			env:  map[string]string{"SYNC_CONFIG": jsonPath, "SYNC_ADDR": ":6000", "SYNC_DEFAULT_PAGE_SIZE": "20", "SYNC_AUTH_SECRET": "env-secret"},
+			check: func(t *testing.T, config Config) {
+				if config.Addr != ":7000" || config.Sync.DefaultPageSize != 20 || config.LogFormat != "json" || config.AuthSecret != "env-secret" {
+					t.Errorf("unexpected precedence %+v", config)
+				}
+			},
+		},
+		{
+			name:    "secret on the command line",
+			args:    []string{"-auth-secret", "visible"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown file setting",
+			args:    []string{"-config", unknownPath},
+			wantErr: true,
+		},
+		{
+			name:    "invalid env value",
+			env:     map[string]string{"SYNC_DB_MAX_OPEN_CONNS": "many"},
+			wantErr: true,
+		},
+		{
+			name:    "fails validation",
+			args:    []string{"-default-page-size", "6000"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookupEnv := func(name string) (string, bool) {
+				value, ok := tt.env[name]
+				return value, ok
+			}
+
+			config, err := loadConfig(tt.args, lookupEnv)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, config)
+			}
+		})
+	}
+}
+
+func TestParseTOMLSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "values", input: "a = \"x \\\"y\\\"\" # note\nb = true\nc = -1.5", want: map[string]string{"a": `x "y"`, "b": "true", "c": "-1.5"}},
+		{name: "unquoted string", input: "addr = localhost", wantErr: true},
+		{name: "table", input: "[server]\naddr = \":1\"", wantErr: true},
+		{name: "duplicate", input: "a = 1\na = 2", wantErr: true},
+		{name: "unterminated", input: `a = "x`, wantErr: true},
+		{name: "trailing garbage", input: `a = "x" y`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOMLSettings([]byte(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTOMLSettings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for key, value := range tt.want {
+				if got[key] != value {
+					t.Errorf("%s = %q, want %q", key, got[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigCorsOrigins(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+
+	config, err := loadConfig([]string{"-cors-origins", "https://a.example.com, https://b.example.com", "-cors-allow-credentials"}, noEnv)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	origins := config.Server.Cors.AllowedOrigins
+	if len(origins) != 2 || origins[0] != "https://a.example.com" || origins[1] != "https://b.example.com" || !config.Server.Cors.AllowCredentials {
+		t.Errorf("unexpected cors policy %+v", config.Server.Cors)
+	}
+
+	// Credentials need explicit origins
+	if _, err := loadConfig([]string{"-cors-allow-credentials"}, noEnv); err == nil {
+		t.Errorf("expected error for credentials with every origin allowed")
+	}
+}
@@ -3,51 +3,253 @@ package main
 import (
 	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"flag"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync/internal/auth"
+	"sync/internal/logging"
+	"sync/internal/metrics"
 	"sync/internal/repository"
 	"sync/internal/server"
 	"sync/internal/sync_engine"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-const (
-	maxConcurrentConnections = 100
-	serverPort               = ":3001"
-)
-
 func main() {
-	log.Printf("Starting sync server...")
+	config, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("Failed to load config", err)
+	}
+
+	// Already validated with the config
+	logger, _ := logging.NewLogger(os.Stderr, config.LogFormat, config.LogLevel)
+	slog.SetDefault(logger)
+
+	slog.Info("Starting sync server")
 
 	// Open database connection
 	// Using file-based SQLite for persistence across restarts
-	// To reset the database, delete ./sync.db
-	db, err := sql.Open("sqlite3", "./sync.db?_journal_mode=WAL&_busy_timeout=5000")
+	// To reset the database, delete the configured database file
+	db, err := sql.Open("sqlite3", config.databaseDSN())
 	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+		fatal("Failed to open database", err)
 	}
 	defer db.Close()
 
 	// Configure connection pool
-	db.SetMaxOpenConns(20)
-	db.SetMaxIdleConns(20)
+	db.SetMaxOpenConns(config.DatabaseMaxOpenConns)
+	db.SetMaxIdleConns(config.DatabaseMaxIdleConns)
 	db.SetConnMaxLifetime(time.Duration(0)) // Zero means never timeout
 
-	// Initialize schema
-	ctx := context.Background()
-	if err := repository.InitSchema(ctx, db); err != nil {
-		log.Fatalf("Error initializing database schema: %v", err)
+	// Cancelled on SIGINT or SIGTERM, which starts the graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Bring the schema up to date
+	migrations, err := repository.Migrate(ctx, db, config.MigrateDryRun)
+	if err != nil {
+		fatal("Error migrating database schema", err)
+	}
+	for _, migration := range migrations {
+		slog.Info("Migration", "version", migration.Version, "description", migration.Description, "dry_run", config.MigrateDryRun)
+	}
+	if config.MigrateDryRun {
+		slog.Info("Dry run finished, nothing was applied", "pending_migrations", len(migrations))
+		return
 	}
 
 	// Create sync service
-	syncService := sync_engine.NewSyncService(db)
+	syncService := sync_engine.NewSyncService(repository.NewSQLiteStore(db), config.Sync)
+
+	// Reject operations that don't match the schemas of their tables
+	if config.TableSchemas != "" {
+		if err := registerTableSchemas(syncService.Schemas(), config.TableSchemas); err != nil {
+			fatal("Error loading table schemas", err)
+		}
+	}
+
+	// Require signed syncs from clients that were given a key
+	if config.ClientKeys != "" {
+		if err := loadClientKeys(syncService, config.ClientKeys); err != nil {
+			fatal("Error loading client keys", err)
+		}
+	}
+
+	// Fold any operations that aren't reflected in the materialized rows yet
+	if err := syncService.CatchUpMaterializedRows(ctx); err != nil {
+		fatal("Error materializing rows", err)
+	}
+
+	// Periodically drop operations every client has seen and that no longer
+	// affect any row, otherwise the log grows without bound
+	compactionDone := make(chan struct{})
+	go func() {
+		defer close(compactionDone)
+		runCompaction(ctx, syncService, config.CompactionInterval)
+	}()
+
+	// Authenticate requests when a token secret is configured, otherwise
+	// every client shares a single namespace
+	var authenticator auth.Authenticator
+	if config.AuthSecret != "" {
+		hmacAuthenticator, err := auth.NewHMACAuthenticator([]byte(config.AuthSecret))
+		if err != nil {
+			fatal("Invalid auth secret", err)
+		}
+		authenticator = hmacAuthenticator
+	} else {
+		slog.Warn("No auth secret configured, authentication is disabled")
+	}
+
+	// Serve the metrics on their own address when one is configured, it
+	// should only be reachable by the scraper
+	var metricsServer *http.Server
+	if config.MetricsAddr != "" {
+		config.Server.ServeMetrics = false
+		metricsServer = &http.Server{
+			Addr:              config.MetricsAddr,
+			Handler:           metrics.Handler(),
+			ReadHeaderTimeout: readHeaderTimeout,
+		}
+	}
 
 	// Start server
-	mux := server.Cors(server.NewServer(syncService, maxConcurrentConnections))
-	log.Printf("Server listening on http://localhost%s\n", serverPort)
-	if err := http.ListenAndServe(serverPort, mux); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	httpServer := &http.Server{
+		Addr:              config.Addr,
+		Handler:           server.RequestID(server.NewServer(syncService, authenticator, config.Server)),
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+	serverErr := make(chan error, 2)
+	go func() {
+		serverErr <- httpServer.ListenAndServe()
+	}()
+	slog.Info("Server listening", "addr", config.Addr)
+
+	if metricsServer != nil {
+		go func() {
+			serverErr <- metricsServer.ListenAndServe()
+		}()
+		slog.Info("Metrics listening", "addr", config.MetricsAddr)
+	}
+
+	select {
+	case err := <-serverErr:
+		fatal("Server failed to start", err)
+	case <-ctx.Done():
+	}
+
+	// A second signal kills the process without waiting for the drain
+	stop()
+	shutdown(httpServer, metricsServer, syncService, db, compactionDone, config.ShutdownTimeout)
+}
+
+// readHeaderTimeout protects against clients that open connections and never finish sending headers
+const readHeaderTimeout = 10 * time.Second
+
+// shutdown drains the server once a signal arrived:
+//  1. readiness probes start failing and event streams end
+//  2. in-flight requests get up to timeout to finish, new connections are refused
+//  3. compaction, which was cancelled with the signal, winds down
+//  4. the WAL is checkpointed into the database file
+//
+// The metrics server, if any, keeps answering until the drain is done.
+func shutdown(httpServer, metricsServer *http.Server, syncService *sync_engine.SyncService, db *sql.DB, compactionDone <-chan struct{}, timeout time.Duration) {
+	slog.Info("Shutting down", "timeout", timeout)
+	syncService.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		slog.Error("Failed to drain requests", "error", err)
+	}
+	<-compactionDone
+
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+
+	if err := repository.CheckpointWAL(context.Background(), db); err != nil {
+		slog.Error("Failed to checkpoint the database", "error", err)
+	}
+	slog.Info("Server stopped")
+}
+
+// fatal logs the error and exits, log/slog has no Fatal level.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func registerTableSchemas(registry *sync_engine.SchemaRegistry, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	schemas, err := sync_engine.ParseTableSchemas(data)
+	if err != nil {
+		return err
+	}
+	for _, schema := range schemas {
+		if err := registry.Register(schema); err != nil {
+			return err
+		}
+		slog.Info("Registered table schema", "table", schema.Name, "fields", len(schema.Fields))
+	}
+
+	return nil
+}
+
+func loadClientKeys(syncService *sync_engine.SyncService, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	keys, err := sync_engine.ParseClientKeys(data)
+	if err != nil {
+		return err
+	}
+	syncService.SetClientKeys(keys)
+
+	clients := 0
+	for _, namespaceKeys := range keys {
+		clients += len(namespaceKeys)
+	}
+	slog.Info("Loaded client keys", "clients", clients)
+	return nil
+}
+
+func runCompaction(ctx context.Context, syncService *sync_engine.SyncService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			results, err := syncService.CompactAcknowledged(ctx)
+			if err != nil {
+				slog.Error("Compaction failed", "error", err)
+			}
+			for _, result := range results {
+				slog.Info("Compaction finished",
+					"namespace", result.Namespace,
+					"compacted_through", result.CompactedThrough,
+					"rows_scanned", result.RowsScanned,
+					"operations_deleted", result.OperationsDeleted)
+			}
+		}
 	}
 }
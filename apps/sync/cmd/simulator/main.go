@@ -2,9 +2,7 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/binary"
 	"encoding/json"
 	"flag"
@@ -17,8 +15,6 @@ import (
 	"sync/internal/server"
 	"sync/internal/sync_engine"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type ClientTickResponse struct {
@@ -455,20 +451,10 @@ func createClients(random *rand.Rand, fileName string, numClients int) []*Client
 }
 
 func createServer() *server.Server {
-	db, err := sql.Open("sqlite3", ":memory:?_journal_mode=WAL&_busy_timeout=1000")
-	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
-	}
-
-	db.SetMaxOpenConns(1)
-	db.SetMaxIdleConns(1)
-	db.SetConnMaxLifetime(time.Duration(0))
-
-	if err := repository.InitSchema(context.Background(), db); err != nil {
-		log.Fatalf("Error initializing database schema: %v", err)
-	}
-
-	syncService := sync_engine.NewSyncService(db)
+	// Simulated clients make up their IDs instead of registering
+	syncConfig := sync_engine.DefaultConfig()
+	syncConfig.AllowUnregisteredClients = true
+	syncService := sync_engine.NewSyncService(repository.NewMemoryStore(), syncConfig)
 	server := &server.Server{
 		SyncService: syncService,
 	}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrMissingCredentials indicates the request carried no credentials
+	ErrMissingCredentials = errors.New("missing credentials")
+
+	// ErrInvalidCredentials indicates the credentials could not be verified
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	// Subject identifies the user the credentials were issued to
+	Subject string
+
+	// Namespace partitions the data the caller can read and write.
+	// Callers in different namespaces never see each other's operations.
+	Namespace string
+}
+
+// Authenticator verifies the credentials of an incoming request.
+type Authenticator interface {
+	Authenticate(request *http.Request) (Identity, error)
+}
+
+type identityKey struct{}
+
+type queryTokenKey struct{}
+
+// WithIdentity returns a copy of ctx carrying the identity.
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity stored in ctx.
+// The second return value is false if the request wasn't authenticated.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+// AllowQueryToken returns a copy of ctx in which BearerToken also accepts the
+// "access_token" query parameter. Browsers can't set headers on EventSource
+// connections, so only routes they stream from should allow it: tokens in
+// URLs end up in access logs and browser history.
+func AllowQueryToken(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queryTokenKey{}, true)
+}
+
+// BearerToken extracts the token from an "Authorization: Bearer <token>" header.
+// If the request context allows it, see AllowQueryToken, the "access_token"
+// query parameter is accepted as a fallback (RFC 6750 2.3).
+func BearerToken(request *http.Request) (string, error) {
+	header := request.Header.Get("Authorization")
+	if header == "" {
+		allowed, _ := request.Context().Value(queryTokenKey{}).(bool)
+		if token := request.URL.Query().Get("access_token"); allowed && token != "" {
+			return token, nil
+		}
+		return "", ErrMissingCredentials
+	}
+
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", ErrInvalidCredentials
+	}
+
+	return strings.TrimSpace(token), nil
+}
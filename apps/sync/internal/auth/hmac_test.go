@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func TestHMACAuthenticator(t *testing.T) {
+	authenticator, err := NewHMACAuthenticator(testSecret)
+	if err != nil {
+		t.Fatalf("NewHMACAuthenticator() error = %v", err)
+	}
+
+	token, err := authenticator.IssueToken("user-1", "", time.Hour)
+	if err != nil {
+		t.Fatalf("IssueToken() error = %v", err)
+	}
+	shared, err := authenticator.IssueToken("user-2", "team-1", time.Hour)
+	if err != nil {
+		t.Fatalf("IssueToken() error = %v", err)
+	}
+	expired, err := authenticator.IssueToken("user-1", "", -time.Minute)
+	if err != nil {
+		t.Fatalf("IssueToken() error = %v", err)
+	}
+	other, _ := NewHMACAuthenticator([]byte(strings.Repeat("x", 32)))
+	forged, _ := other.IssueToken("user-1", "", time.Hour)
+
+	tests := []struct {
+		name          string
+		header        string
+		query         string
+		allowQuery    bool
+		wantErr       error
+		wantNamespace string
+	}{
+		{name: "valid token", header: "Bearer " + token, wantNamespace: "user-1"},
+		{name: "explicit namespace", header: "Bearer " + shared, wantNamespace: "team-1"},
+		{name: "missing header", header: "", wantErr: ErrMissingCredentials},
+		{name: "wrong scheme", header: "Basic " + token, wantErr: ErrInvalidCredentials},
+		{name: "expired token", header: "Bearer " + expired, wantErr: ErrInvalidCredentials},
+		{name: "signed with other secret", header: "Bearer " + forged, wantErr: ErrInvalidCredentials},
+		{name: "malformed token", header: "Bearer not-a-token", wantErr: ErrInvalidCredentials},
+		{name: "query token", query: token, allowQuery: true, wantNamespace: "user-1"},
+		{name: "query token not allowed", query: token, wantErr: ErrMissingCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("POST", "/sync?access_token="+tt.query, nil)
+			if tt.header != "" {
+				request.Header.Set("Authorization", tt.header)
+			}
+			if tt.allowQuery {
+				request = request.WithContext(AllowQueryToken(request.Context()))
+			}
+
+			identity, err := authenticator.Authenticate(request)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && identity.Namespace != tt.wantNamespace {
+				t.Errorf("Authenticate() namespace = %q, want %q", identity.Namespace, tt.wantNamespace)
+			}
+		})
+	}
+}
+
+func TestNewHMACAuthenticatorRejectsShortSecret(t *testing.T) {
+	if _, err := NewHMACAuthenticator([]byte("short")); err == nil {
+		t.Errorf("expected error for short secret")
+	}
+}
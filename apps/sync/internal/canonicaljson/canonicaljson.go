@@ -0,0 +1,175 @@
+// Package canonicaljson serializes JSON in the canonical form of RFC 8785,
+// the JSON Canonicalization Scheme. Two JSON texts with the same data have
+// the same canonical form, whatever their key order, whitespace, escaping or
+// number formatting, so it can be hashed and compared byte by byte.
+//
+// The canonical form is the output of ECMAScript's JSON.stringify with object
+// keys sorted by their UTF-16 code units: no whitespace, strings escaped only
+// where JSON requires it and numbers in their shortest round-trip form.
+package canonicaljson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// maxExactInteger is 2^53, above it a float64 can't hold every integer
+// exactly. Canonical numbers are IEEE 754 doubles, larger integers would
+// silently change on the way through.
+const maxExactInteger = 1 << 53
+
+// Canonicalize returns the canonical form of the JSON text data. It fails on
+// invalid JSON and on numbers that a double can't represent, integers beyond
+// ±2^53 included.
+func Canonicalize(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("canonicaljson: %w", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("canonicaljson: unexpected data after the JSON value")
+	}
+
+	return appendValue(make([]byte, 0, len(data)), value)
+}
+
+// Equal reports whether a and b are JSON texts with the same canonical form.
+// Invalid JSON is only equal to the identical text.
+func Equal(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	canonicalA, err := Canonicalize(a)
+	if err != nil {
+		return false
+	}
+	canonicalB, err := Canonicalize(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(canonicalA, canonicalB)
+}
+
+func appendValue(buf []byte, value any) ([]byte, error) {
+	switch value := value.(type) {
+	case nil:
+		return append(buf, "null"...), nil
+	case bool:
+		return strconv.AppendBool(buf, value), nil
+	case json.Number:
+		return appendNumber(buf, value)
+	case string:
+		return appendString(buf, value), nil
+	case []any:
+		buf = append(buf, '[')
+		for i, element := range value {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			var err error
+			if buf, err = appendValue(buf, element); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, ']'), nil
+	case map[string]any:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		slices.SortFunc(keys, compareUTF16)
+
+		buf = append(buf, '{')
+		for i, key := range keys {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendString(buf, key)
+			buf = append(buf, ':')
+			var err error
+			if buf, err = appendValue(buf, value[key]); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, '}'), nil
+	default:
+		return nil, fmt.Errorf("canonicaljson: unexpected %T", value)
+	}
+}
+
+// compareUTF16 orders strings by their UTF-16 code units, which differs from
+// Go's byte order for characters outside the Basic Multilingual Plane.
+func compareUTF16(a, b string) int {
+	return slices.Compare(utf16.Encode([]rune(a)), utf16.Encode([]rune(b)))
+}
+
+// appendNumber writes number the way ECMAScript's Number.prototype.toString does.
+func appendNumber(buf []byte, number json.Number) ([]byte, error) {
+	value, err := strconv.ParseFloat(number.String(), 64)
+	if err != nil {
+		return nil, fmt.Errorf("canonicaljson: number %s is out of range", number)
+	}
+	// Compared before rounding, 2^53+1 parses to 2^53 as a float64
+	if !strings.ContainsAny(number.String(), ".eE") {
+		if integer, err := strconv.ParseInt(number.String(), 10, 64); err != nil || integer > maxExactInteger || integer < -maxExactInteger {
+			return nil, fmt.Errorf("canonicaljson: integer %s can't be represented exactly", number)
+		}
+	}
+
+	if value == 0 {
+		// Covers -0 too
+		return append(buf, '0'), nil
+	}
+	if abs := math.Abs(value); abs >= 1e-6 && abs < 1e21 {
+		return strconv.AppendFloat(buf, value, 'f', -1, 64), nil
+	}
+
+	// Go writes exponents with at least two digits, ECMAScript without padding
+	formatted := strconv.FormatFloat(value, 'e', -1, 64)
+	mantissa, exponent, _ := strings.Cut(formatted, "e")
+	sign, digits := exponent[:1], strings.TrimLeft(exponent[1:], "0")
+	return append(buf, mantissa+"e"+sign+digits...), nil
+}
+
+// appendString escapes only what JSON requires, unlike encoding/json which
+// also escapes HTML characters and U+2028/U+2029.
+func appendString(buf []byte, value string) []byte {
+	buf = append(buf, '"')
+	for _, char := range value {
+		switch char {
+		case '"':
+			buf = append(buf, `\"`...)
+		case '\\':
+			buf = append(buf, `\\`...)
+		case '\b':
+			buf = append(buf, `\b`...)
+		case '\f':
+			buf = append(buf, `\f`...)
+		case '\n':
+			buf = append(buf, `\n`...)
+		case '\r':
+			buf = append(buf, `\r`...)
+		case '\t':
+			buf = append(buf, `\t`...)
+		default:
+			if char < 0x20 {
+				buf = fmt.Appendf(buf, `\u%04x`, char)
+			} else {
+				buf = utf8.AppendRune(buf, char)
+			}
+		}
+	}
+	return append(buf, '"')
+}
@@ -0,0 +1,71 @@
+package canonicaljson
+
+import "testing"
+
+// -------------------- Canonicalize tests --------------------
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{
+			// RFC 8785 section 3.2.2
+			name:  "rfc example",
+			input: `{"numbers":[333333333.33333329,1E30,4.50,2e-3,0.000000000000000000000000001],"string":"\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/","literals":[null,true,false]}`,
+			want:  `{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`,
+		},
+		{
+			// RFC 8785 section 3.2.3, sorted by UTF-16 code units
+			name:  "key order",
+			input: `{"\u20ac":"Euro Sign","\r":"Carriage Return","\ufb33":"Hebrew Letter Dalet With Dagesh","1":"One","\ud83d\ude00":"Emoji: Grinning Face","\u0080":"Control","\u00f6":"Latin Small Letter O With Diaeresis"}`,
+			want:  "{\"\\r\":\"Carriage Return\",\"1\":\"One\",\"\u0080\":\"Control\",\"\u00f6\":\"Latin Small Letter O With Diaeresis\",\"\u20ac\":\"Euro Sign\",\"\U0001F600\":\"Emoji: Grinning Face\",\"\ufb33\":\"Hebrew Letter Dalet With Dagesh\"}",
+		},
+		{name: "whitespace and nesting", input: " { \"b\" : [ 1 , { \"d\": 1, \"c\": 2 } ], \"a\" : { } } ", want: `{"a":{},"b":[1,{"c":2,"d":1}]}`},
+		{name: "no html escaping", input: `"<a&b>\u2028"`, want: "\"<a&b>\u2028\""},
+		{name: "negative zero", input: `-0.0`, want: `0`},
+		{name: "integers", input: `[1.0, 100, -5e0, 9007199254740992]`, want: `[1,100,-5,9007199254740992]`},
+		{name: "large and small numbers", input: `[1e21, 1e20, 0.000001, 0.0000001, -1.5e-7]`, want: `[1e+21,100000000000000000000,0.000001,1e-7,-1.5e-7]`},
+		{name: "integer beyond 2^53", input: `12345678901234567890`, wantErr: true},
+		{name: "integer just beyond 2^53", input: `-9007199254740993`, wantErr: true},
+		{name: "number out of range", input: `1e400`, wantErr: true},
+		{name: "invalid JSON", input: `{"a":}`, wantErr: true},
+		{name: "trailing data", input: `{} {}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Canonicalize([]byte(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Canonicalize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("Canonicalize() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{name: "identical", a: `{"a":1}`, b: `{"a":1}`, want: true},
+		{name: "key order and whitespace", a: `{"a":1,"b":[true]}`, b: `{ "b": [ true ], "a": 1.0 }`, want: true},
+		{name: "escaping", a: `"é"`, b: `"\u00e9"`, want: true},
+		{name: "different values", a: `{"a":1}`, b: `{"a":2}`, want: false},
+		{name: "invalid JSON", a: `{"a":}`, b: `{"a": }`, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Equal([]byte(tt.a), []byte(tt.b)); got != tt.want {
+				t.Errorf("Equal(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
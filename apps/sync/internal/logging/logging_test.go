@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+// -------------------- Context logger tests --------------------
+
+func TestFromContext(t *testing.T) {
+	if FromContext(context.Background()) != slog.Default() {
+		t.Errorf("expected the default logger without a stored logger")
+	}
+
+	var output bytes.Buffer
+	logger, err := NewLogger(&output, "json", "info")
+	if err != nil {
+		t.Fatalf("NewLogger() error = %v", err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	ctx := WithRequestID(context.Background(), "request-1")
+	ctx = With(ctx, "client_id", "client-1")
+	FromContext(ctx).Debug("Hidden")
+	FromContext(ctx).Info("Synced", "operations", 2)
+
+	if got := RequestIDFromContext(ctx); got != "request-1" {
+		t.Errorf("RequestIDFromContext() = %q, want request-1", got)
+	}
+
+	var line map[string]any
+	if err := json.Unmarshal(output.Bytes(), &line); err != nil {
+		t.Fatalf("expected a single JSON line, got %q: %v", output.String(), err)
+	}
+	want := map[string]any{"msg": "Synced", "request_id": "request-1", "client_id": "client-1", "operations": float64(2)}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("%s = %v, want %v", key, line[key], value)
+		}
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		level   string
+		wantErr bool
+	}{
+		{name: "text", format: "text", level: "debug"},
+		{name: "json", format: "JSON", level: "WARN"},
+		{name: "unknown format", format: "xml", level: "info", wantErr: true},
+		{name: "unknown level", format: "text", level: "verbose", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewLogger(&bytes.Buffer{}, tt.format, tt.level)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewLogger() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
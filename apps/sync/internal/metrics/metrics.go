@@ -0,0 +1,344 @@
+// Package metrics implements the counters and histograms the sync server
+// exposes in the Prometheus text format, without depending on the
+// Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are latency buckets in seconds.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry metrics are created in and the /metrics endpoint serves.
+var Default = NewRegistry()
+
+// ------------------------------------------------------------------------
+// Registry
+// ------------------------------------------------------------------------
+
+// family is a named metric with all of its label combinations.
+type family interface {
+	name() string
+	write(w io.Writer) error
+}
+
+// Registry holds metric families and writes them in the text exposition format.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]family)}
+}
+
+// register panics on duplicate names, metrics are created at package init.
+func (registry *Registry) register(f family) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if _, ok := registry.families[f.name()]; ok {
+		panic(fmt.Sprintf("metrics: %s registered twice", f.name()))
+	}
+	registry.families[f.name()] = f
+}
+
+// Write writes every metric, ordered by name.
+func (registry *Registry) Write(w io.Writer) error {
+	registry.mu.Lock()
+	families := make([]family, 0, len(registry.families))
+	for _, f := range registry.families {
+		families = append(families, f)
+	}
+	registry.mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name() < families[j].name() })
+	for _, f := range families {
+		if err := f.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (registry *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registry.Write(writer)
+	})
+}
+
+// Handler serves the default registry.
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// ------------------------------------------------------------------------
+// Counter
+// ------------------------------------------------------------------------
+
+// Counter is a value that only goes up.
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (counter *Counter) Inc() {
+	counter.value.Add(1)
+}
+
+// Add increases the counter, negative values are ignored.
+func (counter *Counter) Add(n int) {
+	if n > 0 {
+		counter.value.Add(uint64(n))
+	}
+}
+
+func (counter *Counter) Value() uint64 {
+	return counter.value.Load()
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	*vec[*Counter]
+}
+
+// NewCounter creates a counter without labels in the default registry.
+func NewCounter(name string, help string) *Counter {
+	return NewCounterVec(name, help).WithLabelValues()
+}
+
+// NewCounterVec creates a labelled counter in the default registry.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+func (registry *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	counterVec := &CounterVec{newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	registry.register(counterVec)
+	return counterVec
+}
+
+func (counterVec *CounterVec) write(w io.Writer) error {
+	return counterVec.writeFamily(w, func(w io.Writer, labels string, counter *Counter) error {
+		_, err := fmt.Fprintf(w, "%s%s %d\n", counterVec.metricName, labels, counter.Value())
+		return err
+	})
+}
+
+// ------------------------------------------------------------------------
+// Histogram
+// ------------------------------------------------------------------------
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	upperBounds []float64
+	counts      []atomic.Uint64 // Per bucket, not cumulative
+	count       atomic.Uint64
+	sumBits     atomic.Uint64 // float64 bits
+}
+
+func newHistogram(upperBounds []float64) *Histogram {
+	return &Histogram{
+		upperBounds: upperBounds,
+		counts:      make([]atomic.Uint64, len(upperBounds)),
+	}
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	if i := sort.SearchFloat64s(histogram.upperBounds, value); i < len(histogram.upperBounds) {
+		histogram.counts[i].Add(1)
+	}
+	histogram.count.Add(1)
+	for {
+		old := histogram.sumBits.Load()
+		sum := math.Float64frombits(old) + value
+		if histogram.sumBits.CompareAndSwap(old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	*vec[*Histogram]
+}
+
+// NewHistogram creates a histogram without labels in the default registry.
+// Buckets are upper bounds in increasing order.
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	return NewHistogramVec(name, help, buckets).WithLabelValues()
+}
+
+// NewHistogramVec creates a labelled histogram in the default registry.
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+func (registry *Registry) NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+	histogramVec := &HistogramVec{newVec(name, help, "histogram", labels, func() *Histogram { return newHistogram(buckets) })}
+	registry.register(histogramVec)
+	return histogramVec
+}
+
+func (histogramVec *HistogramVec) write(w io.Writer) error {
+	return histogramVec.writeFamily(w, func(w io.Writer, labels string, histogram *Histogram) error {
+		// Read the total first, so buckets written afterwards never exceed it
+		count := histogram.count.Load()
+		sum := math.Float64frombits(histogram.sumBits.Load())
+
+		var cumulative uint64
+		for i, upperBound := range histogram.upperBounds {
+			cumulative += histogram.counts[i].Load()
+			bucketLabels := withLabel(labels, "le", formatFloat(upperBound))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", histogramVec.metricName, bucketLabels, min(cumulative, count)); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", histogramVec.metricName, withLabel(labels, "le", "+Inf"), count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", histogramVec.metricName, labels, formatFloat(sum)); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%s_count%s %d\n", histogramVec.metricName, labels, count)
+		return err
+	})
+}
+
+// ------------------------------------------------------------------------
+// Labels
+// ------------------------------------------------------------------------
+
+// vec holds one metric per combination of label values.
+type vec[M any] struct {
+	metricName string
+	help       string
+	metricType string
+	labels     []string
+	create     func() M
+
+	mu       sync.RWMutex
+	children map[string]M
+	values   map[string][]string
+}
+
+func newVec[M any](name string, help string, metricType string, labels []string, create func() M) *vec[M] {
+	return &vec[M]{
+		metricName: name,
+		help:       help,
+		metricType: metricType,
+		labels:     labels,
+		create:     create,
+		children:   make(map[string]M),
+		values:     make(map[string][]string),
+	}
+}
+
+func (v *vec[M]) name() string {
+	return v.metricName
+}
+
+// WithLabelValues returns the metric for the given label values, in the
+// order the labels were declared. Panics if the number of values is wrong.
+func (v *vec[M]) WithLabelValues(values ...string) M {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.metricName, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	child, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if child, ok := v.children[key]; ok {
+		return child
+	}
+	child = v.create()
+	v.children[key] = child
+	v.values[key] = append([]string(nil), values...)
+	return child
+}
+
+func (v *vec[M]) writeFamily(w io.Writer, writeChild func(w io.Writer, labels string, child M) error) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.metricName, escapeHelp(v.help), v.metricName, v.metricType); err != nil {
+		return err
+	}
+
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	children := make([]M, len(keys))
+	labels := make([]string, len(keys))
+	for i, key := range keys {
+		children[i] = v.children[key]
+		labels[i] = formatLabels(v.labels, v.values[key])
+	}
+	v.mu.RUnlock()
+
+	for i := range children {
+		if err := writeChild(w, labels[i], children[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatLabels renders {name="value",...}, or nothing without labels.
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escapeLabelValue(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel appends a label to already formatted labels.
+func withLabel(labels string, name string, value string) string {
+	pair := fmt.Sprintf(`%s="%s"`, name, value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
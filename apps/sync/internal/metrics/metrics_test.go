@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+// -------------------- Exposition format tests --------------------
+
+func TestRegistryWrite(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.NewCounterVec("requests_total", "Requests by outcome.", "outcome", "code")
+	requests.WithLabelValues("success", "").Inc()
+	requests.WithLabelValues("error", `BAD"REQUEST`).Add(2)
+	requests.WithLabelValues("error", "ignored").Add(-1)
+
+	duration := registry.NewHistogramVec("duration_seconds", "Request duration.", []float64{0.1, 1}).WithLabelValues()
+	duration.Observe(0.05)
+	duration.Observe(0.5)
+	duration.Observe(3)
+
+	var output strings.Builder
+	if err := registry.Write(&output); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	want := `# HELP duration_seconds Request duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.1"} 1
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 3.55
+duration_seconds_count 3
+# HELP requests_total Requests by outcome.
+# TYPE requests_total counter
+requests_total{outcome="error",code="BAD\"REQUEST"} 2
+requests_total{outcome="error",code="ignored"} 0
+requests_total{outcome="success",code=""} 1
+`
+	if output.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", output.String(), want)
+	}
+}
+
+func TestRegistryPanics(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(registry *Registry)
+	}{
+		{
+			name: "duplicate name",
+			fn: func(registry *Registry) {
+				registry.NewCounterVec("a", "")
+				registry.NewCounterVec("a", "")
+			},
+		},
+		{
+			name: "unsorted buckets",
+			fn: func(registry *Registry) {
+				registry.NewHistogramVec("a", "", []float64{1, 0.1})
+			},
+		},
+		{
+			name: "wrong label count",
+			fn: func(registry *Registry) {
+				registry.NewCounterVec("a", "", "outcome").WithLabelValues()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic")
+				}
+			}()
+			tt.fn(NewRegistry())
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// DBClientState represents how far a single client has caught up.
+// Clients are identified by namespace and client ID together.
+type DBClientState struct {
+	Namespace             string
+	ClientID              string
+	LastSeenServerVersion int64
+	LastSyncedAt          int64 // Unix timestamp in milliseconds
+	MaxDotVersion         int64
+}
+
+// UpsertClientState records a sync from a client.
+// The last seen server version is stored as sent, a client that reset its
+// state must be able to move backwards. The max dot version never decreases.
+func UpsertClientState(ctx context.Context, exec Execer, state *DBClientState) error {
+	const query = `
+		INSERT INTO client_state (namespace, client_id, last_seen_server_version, last_synced_at, max_dot_version)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (namespace, client_id) DO UPDATE SET
+			last_seen_server_version = excluded.last_seen_server_version,
+			last_synced_at = excluded.last_synced_at,
+			max_dot_version = MAX(client_state.max_dot_version, excluded.max_dot_version)
+	`
+
+	_, err := exec.ExecContext(ctx, query,
+		state.Namespace,
+		state.ClientID,
+		state.LastSeenServerVersion,
+		state.LastSyncedAt,
+		state.MaxDotVersion,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to upsert client state (namespace=%s, client_id=%s): %w", state.Namespace, state.ClientID, err)
+	}
+
+	return nil
+}
+
+// GetClientState fetches the state of a single client in a namespace.
+// Returns nil without an error if the client has never synced.
+func GetClientState(ctx context.Context, exec Execer, namespace string, clientID string) (*DBClientState, error) {
+	const query = `
+		SELECT namespace, client_id, last_seen_server_version, last_synced_at, max_dot_version
+		FROM client_state
+		WHERE namespace = ? AND client_id = ?
+	`
+
+	state := &DBClientState{}
+	err := exec.QueryRowContext(ctx, query, namespace, clientID).Scan(
+		&state.Namespace,
+		&state.ClientID,
+		&state.LastSeenServerVersion,
+		&state.LastSyncedAt,
+		&state.MaxDotVersion,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client state (namespace=%s, client_id=%s): %w", namespace, clientID, err)
+	}
+
+	return state, nil
+}
+
+// GetClientStates retrieves the state of every client in every namespace that
+// last synced before the given Unix timestamp in milliseconds. Pass
+// math.MaxInt64 to get all clients.
+// Results are ordered by last_synced_at ASC, least recently synced first.
+func GetClientStates(ctx context.Context, exec Execer, syncedBefore int64) ([]*DBClientState, error) {
+	const query = `
+		SELECT namespace, client_id, last_seen_server_version, last_synced_at, max_dot_version
+		FROM client_state
+		WHERE last_synced_at < ?
+		ORDER BY last_synced_at ASC, namespace ASC, client_id ASC
+	`
+
+	rows, err := exec.QueryContext(ctx, query, syncedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var states []*DBClientState
+	for rows.Next() {
+		state := &DBClientState{}
+		err := rows.Scan(
+			&state.Namespace,
+			&state.ClientID,
+			&state.LastSeenServerVersion,
+			&state.LastSyncedAt,
+			&state.MaxDotVersion,
+		)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return states, nil
+}
+
+// DeleteClientState forgets a client, so it no longer holds back the acknowledged watermark.
+// Returns false if the client was unknown.
+func DeleteClientState(ctx context.Context, exec Execer, namespace string, clientID string) (bool, error) {
+	const query = `
+		DELETE FROM client_state
+		WHERE namespace = ? AND client_id = ?
+	`
+
+	result, err := exec.ExecContext(ctx, query, namespace, clientID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete client state (namespace=%s, client_id=%s): %w", namespace, clientID, err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// GetAcknowledgedWatermarks returns the lowest last seen server version of the
+// clients in each namespace, every operation in a namespace at or below its
+// watermark has been seen by all of its clients. Clients only fetch operations
+// from their own namespace, so an idle client holds back only its namespace.
+// Clients that haven't seen anything yet are left out, they are bootstrapped
+// from whatever the log holds and can't hold back compaction for everyone.
+// Namespaces where no client has acknowledged anything yet are left out.
+func GetAcknowledgedWatermarks(ctx context.Context, exec Execer) (map[string]int64, error) {
+	const query = `
+		SELECT namespace, MIN(last_seen_server_version)
+		FROM client_state
+		WHERE last_seen_server_version >= 0
+		GROUP BY namespace
+	`
+
+	rows, err := exec.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get acknowledged watermarks: %w", err)
+	}
+	defer rows.Close()
+
+	watermarks := make(map[string]int64)
+	for rows.Next() {
+		var namespace string
+		var watermark int64
+		if err := rows.Scan(&namespace, &watermark); err != nil {
+			return nil, err
+		}
+		watermarks[namespace] = watermark
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return watermarks, nil
+}
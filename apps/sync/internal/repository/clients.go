@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrClientExists is returned when registering a client ID that is already taken.
+var ErrClientExists = errors.New("client already registered")
+
+// DBClient is a client the server issued an ID and secret to.
+type DBClient struct {
+	ClientID  string
+	Namespace string
+	Secret    []byte // HMAC key the client signs its syncs with
+	CreatedAt int64  // Unix timestamp in milliseconds
+}
+
+// InsertClient registers a client. Returns ErrClientExists if the ID is taken.
+func InsertClient(ctx context.Context, exec Execer, client *DBClient) error {
+	const query = `
+		INSERT INTO clients (client_id, namespace, secret, created_at)
+		VALUES (?, ?, ?, ?)
+	`
+
+	_, err := exec.ExecContext(ctx, query,
+		client.ClientID,
+		client.Namespace,
+		client.Secret,
+		client.CreatedAt,
+	)
+	if isUniqueConstraintError(err) {
+		return fmt.Errorf("%w (client_id=%s)", ErrClientExists, client.ClientID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to insert client (client_id=%s): %w", client.ClientID, err)
+	}
+
+	return nil
+}
+
+// GetClient fetches a registered client.
+// Returns nil without an error if the client was never registered.
+func GetClient(ctx context.Context, exec Execer, clientID string) (*DBClient, error) {
+	const query = `
+		SELECT client_id, namespace, secret, created_at
+		FROM clients
+		WHERE client_id = ?
+	`
+
+	client := &DBClient{}
+	err := exec.QueryRowContext(ctx, query, clientID).Scan(
+		&client.ClientID,
+		&client.Namespace,
+		&client.Secret,
+		&client.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client (client_id=%s): %w", clientID, err)
+	}
+
+	return client, nil
+}
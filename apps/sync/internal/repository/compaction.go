@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+)
+
+// DBRowRef identifies a single row across all tables.
+type DBRowRef struct {
+	Namespace string
+	TableName string
+	RowKey    string
+}
+
+// GetCompactedThrough returns the server_version a namespace's log has been compacted through.
+// Returns -1 if the namespace has never been compacted.
+func GetCompactedThrough(ctx context.Context, exec Execer, namespace string) (int64, error) {
+	const query = `
+		SELECT COALESCE((SELECT compacted_through FROM compaction_state WHERE namespace = ?), -1)
+	`
+
+	var compactedThrough int64
+	if err := exec.QueryRowContext(ctx, query, namespace).Scan(&compactedThrough); err != nil {
+		return -1, fmt.Errorf("failed to get compacted through (namespace=%s): %w", namespace, err)
+	}
+
+	return compactedThrough, nil
+}
+
+// SetCompactedThrough records the server_version a namespace's log has been compacted through.
+func SetCompactedThrough(ctx context.Context, exec Execer, namespace string, serverVersion int64) error {
+	const query = `
+		INSERT INTO compaction_state (namespace, compacted_through)
+		VALUES (?, ?)
+		ON CONFLICT (namespace) DO UPDATE SET compacted_through = excluded.compacted_through
+	`
+
+	if _, err := exec.ExecContext(ctx, query, namespace, serverVersion); err != nil {
+		return fmt.Errorf("failed to set compacted through (namespace=%s): %w", namespace, err)
+	}
+
+	return nil
+}
+
+// GetRowsWithOperationsBetween returns every row in a namespace that has at least
+// one operation with a server_version in the range (after, through].
+// Results are ordered by table_name, row_key ASC.
+func GetRowsWithOperationsBetween(ctx context.Context, exec Execer, namespace string, after int64, through int64) ([]DBRowRef, error) {
+	const query = `
+		SELECT DISTINCT namespace, table_name, row_key
+		FROM crdt_operations
+		WHERE namespace = ? AND server_version > ? AND server_version <= ?
+		ORDER BY table_name ASC, row_key ASC
+	`
+
+	rows, err := exec.QueryContext(ctx, query, namespace, after, through)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refs []DBRowRef
+	for rows.Next() {
+		var ref DBRowRef
+		if err := rows.Scan(&ref.Namespace, &ref.TableName, &ref.RowKey); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return refs, nil
+}
+
+// GetCRDTOperationsForRow retrieves every operation on a single row.
+// Results are ordered by server_version ASC.
+func GetCRDTOperationsForRow(ctx context.Context, exec Execer, row DBRowRef) ([]*DBCRDTOperation, error) {
+	const query = `
+		SELECT server_version, namespace, client_id, version, type, table_name, row_key, field, value, context, encrypted
+		FROM crdt_operations
+		WHERE namespace = ? AND table_name = ? AND row_key = ?
+		ORDER BY server_version ASC
+	`
+
+	rows, err := exec.QueryContext(ctx, query, row.Namespace, row.TableName, row.RowKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanCRDTOperations(rows)
+}
+
+// DeleteCRDTOperations deletes operations by server_version and returns how many were deleted.
+func DeleteCRDTOperations(ctx context.Context, exec Execer, serverVersions []int64) (int64, error) {
+	const query = `
+		DELETE FROM crdt_operations
+		WHERE server_version = ?
+	`
+
+	var deleted int64
+	for _, serverVersion := range serverVersions {
+		result, err := exec.ExecContext(ctx, query, serverVersion)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete operation (server_version=%d): %w", serverVersion, err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += affected
+	}
+
+	return deleted, nil
+}
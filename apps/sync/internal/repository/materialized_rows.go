@@ -0,0 +1,131 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// DBMaterializedRow represents the folded state of a single row in the database.
+type DBMaterializedRow struct {
+	Namespace     string
+	TableName     string
+	RowKey        string
+	Fields        string  // JSON stored as TEXT
+	Tombstone     *string // JSON stored as TEXT, nil if the row was never removed
+	ServerVersion int64
+}
+
+// GetMaterializedRow fetches the folded state of a row.
+// Returns nil without an error if no operation has touched the row yet.
+func GetMaterializedRow(ctx context.Context, exec Execer, namespace string, tableName string, rowKey string) (*DBMaterializedRow, error) {
+	const query = `
+		SELECT namespace, table_name, row_key, fields, tombstone, server_version
+		FROM materialized_rows
+		WHERE namespace = ? AND table_name = ? AND row_key = ?
+	`
+
+	row := &DBMaterializedRow{}
+	err := exec.QueryRowContext(ctx, query, namespace, tableName, rowKey).Scan(
+		&row.Namespace,
+		&row.TableName,
+		&row.RowKey,
+		&row.Fields,
+		&row.Tombstone,
+		&row.ServerVersion,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get materialized row (table=%s, row=%s): %w", tableName, rowKey, err)
+	}
+
+	return row, nil
+}
+
+// UpsertMaterializedRow inserts the folded state of a row or replaces the existing one.
+func UpsertMaterializedRow(ctx context.Context, exec Execer, row *DBMaterializedRow) error {
+	const query = `
+		INSERT INTO materialized_rows (namespace, table_name, row_key, fields, tombstone, server_version)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (namespace, table_name, row_key) DO UPDATE SET
+			fields = excluded.fields,
+			tombstone = excluded.tombstone,
+			server_version = excluded.server_version
+	`
+
+	_, err := exec.ExecContext(ctx, query,
+		row.Namespace,
+		row.TableName,
+		row.RowKey,
+		row.Fields,
+		row.Tombstone,
+		row.ServerVersion,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to upsert materialized row (table=%s, row=%s): %w", row.TableName, row.RowKey, err)
+	}
+
+	return nil
+}
+
+// GetMaterializedRows retrieves the folded state of every row of a table in a namespace.
+// An empty tableName returns the rows of all tables in the namespace.
+// Results are ordered by table_name, row_key ASC.
+func GetMaterializedRows(ctx context.Context, exec Execer, namespace string, tableName string) ([]*DBMaterializedRow, error) {
+	const query = `
+		SELECT namespace, table_name, row_key, fields, tombstone, server_version
+		FROM materialized_rows
+		WHERE namespace = ? AND (? = '' OR table_name = ?)
+		ORDER BY table_name ASC, row_key ASC
+	`
+
+	rows, err := exec.QueryContext(ctx, query, namespace, tableName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var materializedRows []*DBMaterializedRow
+	for rows.Next() {
+		row := &DBMaterializedRow{}
+		err := rows.Scan(
+			&row.Namespace,
+			&row.TableName,
+			&row.RowKey,
+			&row.Fields,
+			&row.Tombstone,
+			&row.ServerVersion,
+		)
+		if err != nil {
+			return nil, err
+		}
+		materializedRows = append(materializedRows, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return materializedRows, nil
+}
+
+// GetMaxMaterializedServerVersion returns the highest server_version folded into any row.
+// Returns -1 if nothing has been materialized yet.
+// Comparing it with GetMaxServerVersion tells how far the materialized rows lag behind the log.
+func GetMaxMaterializedServerVersion(ctx context.Context, exec Execer) (int64, error) {
+	const query = `
+		SELECT COALESCE(MAX(server_version), -1)
+		FROM materialized_rows
+	`
+
+	var maxVersion int64
+	err := exec.QueryRowContext(ctx, query).Scan(&maxVersion)
+	if err != nil {
+		return -1, fmt.Errorf("failed to get max materialized server version: %w", err)
+	}
+
+	return maxVersion, nil
+}
@@ -0,0 +1,523 @@
+package repository
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+)
+
+var errReadOnlyTx = errors.New("cannot write in a read-only transaction")
+
+// MemoryStore is an OperationStore that keeps everything in process memory.
+// It's meant for tests and the simulator, nothing survives a restart.
+//
+// Transactions are serialized with a read-write lock: a write transaction
+// holds it exclusively from Begin until Commit or Rollback, read-only
+// transactions share it. Every write records how to undo itself, Rollback
+// replays those in reverse.
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	operations        []*DBCRDTOperation // Ordered by ServerVersion
+	dots              map[memoryDot]*DBCRDTOperation
+	lastServerVersion int64            // Server versions are never reused, like AUTOINCREMENT
+	compactedThrough  map[string]int64 // By namespace
+	rows              map[DBRowRef]*DBMaterializedRow
+	clients           map[memoryClient]*DBClientState
+	registeredClients map[string]*DBClient
+}
+
+type memoryDot struct {
+	namespace string
+	clientID  string
+	version   int64
+}
+
+type memoryClient struct {
+	namespace string
+	clientID  string
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		dots:              make(map[memoryDot]*DBCRDTOperation),
+		compactedThrough:  make(map[string]int64),
+		rows:              make(map[DBRowRef]*DBMaterializedRow),
+		clients:           make(map[memoryClient]*DBClientState),
+		registeredClients: make(map[string]*DBClient),
+	}
+}
+
+func (store *MemoryStore) Begin(ctx context.Context, readOnly bool) (StoreTx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	if readOnly {
+		store.mu.RLock()
+	} else {
+		store.mu.Lock()
+	}
+	return &memoryTx{store: store, readOnly: readOnly}, nil
+}
+
+func (store *MemoryStore) Close() error {
+	return nil
+}
+
+type memoryTx struct {
+	store    *MemoryStore
+	readOnly bool
+	done     bool
+	undo     []func()
+}
+
+func (tx *memoryTx) Commit() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.finish()
+	return nil
+}
+
+func (tx *memoryTx) Rollback() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.finish()
+	return nil
+}
+
+func (tx *memoryTx) finish() {
+	tx.done = true
+	tx.undo = nil
+	if tx.readOnly {
+		tx.store.mu.RUnlock()
+	} else {
+		tx.store.mu.Unlock()
+	}
+}
+
+// checkOpen returns an error if the transaction can't be used anymore.
+func (tx *memoryTx) checkOpen() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	return nil
+}
+
+// checkWritable returns an error if the transaction can't write.
+func (tx *memoryTx) checkWritable() error {
+	if err := tx.checkOpen(); err != nil {
+		return err
+	}
+	if tx.readOnly {
+		return errReadOnlyTx
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------
+// Operations
+
+func (tx *memoryTx) InsertCRDTOperations(ctx context.Context, ops []*DBCRDTOperation) ([]int64, int, error) {
+	if err := tx.checkWritable(); err != nil {
+		return nil, 0, err
+	}
+	store := tx.store
+
+	serverVersions := make([]int64, 0, len(ops))
+	insertedCount := 0
+	for _, op := range ops {
+		dot := memoryDot{namespace: op.Namespace, clientID: op.ClientID, version: op.Version}
+
+		// Retried operations must be identical, same as the UNIQUE constraint check
+		if existing, ok := store.dots[dot]; ok {
+			if !operationsEqual(op, existing) {
+				logConflictingOperation(ctx, existing, op)
+				return nil, 0, duplicateOperationError(op)
+			}
+			logRetriedOperation(ctx, existing)
+			serverVersions = append(serverVersions, existing.ServerVersion)
+			continue
+		}
+
+		previousServerVersion := store.lastServerVersion
+		inserted := *op
+		inserted.ServerVersion = store.lastServerVersion + 1
+		store.lastServerVersion = inserted.ServerVersion
+		store.operations = append(store.operations, &inserted)
+		store.dots[dot] = &inserted
+
+		tx.undo = append(tx.undo, func() {
+			store.operations = store.operations[:len(store.operations)-1]
+			delete(store.dots, dot)
+			store.lastServerVersion = previousServerVersion
+		})
+		serverVersions = append(serverVersions, inserted.ServerVersion)
+		insertedCount++
+	}
+
+	return serverVersions, insertedCount, nil
+}
+
+func (tx *memoryTx) GetCRDTOperationsSince(ctx context.Context, namespace string, serverVersion int64, limit int, excludeClientID string) ([]*DBCRDTOperation, error) {
+	if excludeClientID == "" {
+		return nil, fmt.Errorf("excludeClientID cannot be empty")
+	}
+
+	return tx.operationsSince(serverVersion, limit, func(op *DBCRDTOperation) bool {
+		return op.Namespace == namespace && op.ClientID != excludeClientID
+	})
+}
+
+func (tx *memoryTx) GetAllCRDTOperationsSince(ctx context.Context, serverVersion int64, limit int) ([]*DBCRDTOperation, error) {
+	return tx.operationsSince(serverVersion, limit, func(*DBCRDTOperation) bool { return true })
+}
+
+// operationsSince returns copies of up to limit operations after serverVersion that match.
+func (tx *memoryTx) operationsSince(serverVersion int64, limit int, match func(*DBCRDTOperation) bool) ([]*DBCRDTOperation, error) {
+	if err := tx.checkOpen(); err != nil {
+		return nil, err
+	}
+	operations := tx.store.operations
+
+	var ops []*DBCRDTOperation
+	start := sort.Search(len(operations), func(i int) bool {
+		return operations[i].ServerVersion > serverVersion
+	})
+	for _, op := range operations[start:] {
+		if len(ops) >= limit {
+			break
+		}
+		if match(op) {
+			copied := *op
+			ops = append(ops, &copied)
+		}
+	}
+
+	return ops, nil
+}
+
+func (tx *memoryTx) GetCRDTOperationsForRow(ctx context.Context, row DBRowRef) ([]*DBCRDTOperation, error) {
+	if err := tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	var ops []*DBCRDTOperation
+	for _, op := range tx.store.operations {
+		if op.Namespace == row.Namespace && op.TableName == row.TableName && op.RowKey == row.RowKey {
+			copied := *op
+			ops = append(ops, &copied)
+		}
+	}
+
+	return ops, nil
+}
+
+func (tx *memoryTx) GetRowsWithOperationsBetween(ctx context.Context, namespace string, after int64, through int64) ([]DBRowRef, error) {
+	if err := tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[DBRowRef]bool)
+	var refs []DBRowRef
+	for _, op := range tx.store.operations {
+		ref := DBRowRef{Namespace: op.Namespace, TableName: op.TableName, RowKey: op.RowKey}
+		if op.Namespace == namespace && op.ServerVersion > after && op.ServerVersion <= through && !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+
+	slices.SortFunc(refs, func(a, b DBRowRef) int {
+		return cmp.Or(cmp.Compare(a.TableName, b.TableName), cmp.Compare(a.RowKey, b.RowKey))
+	})
+	return refs, nil
+}
+
+func (tx *memoryTx) DeleteCRDTOperations(ctx context.Context, serverVersions []int64) (int64, error) {
+	if err := tx.checkWritable(); err != nil {
+		return 0, err
+	}
+	store := tx.store
+
+	var deleted int64
+	for _, serverVersion := range serverVersions {
+		index, found := slices.BinarySearchFunc(store.operations, serverVersion, func(op *DBCRDTOperation, target int64) int {
+			return cmp.Compare(op.ServerVersion, target)
+		})
+		if !found {
+			continue
+		}
+
+		op := store.operations[index]
+		dot := memoryDot{namespace: op.Namespace, clientID: op.ClientID, version: op.Version}
+		store.operations = slices.Delete(store.operations, index, index+1)
+		delete(store.dots, dot)
+
+		tx.undo = append(tx.undo, func() {
+			store.operations = slices.Insert(store.operations, index, op)
+			store.dots[dot] = op
+		})
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+func (tx *memoryTx) GetMaxServerVersion(ctx context.Context) (int64, error) {
+	if err := tx.checkOpen(); err != nil {
+		return -1, err
+	}
+	store := tx.store
+
+	maxVersion := int64(-1)
+	for _, compactedThrough := range store.compactedThrough {
+		maxVersion = max(maxVersion, compactedThrough)
+	}
+	if len(store.operations) > 0 {
+		maxVersion = max(maxVersion, store.operations[len(store.operations)-1].ServerVersion)
+	}
+	return maxVersion, nil
+}
+
+func (tx *memoryTx) GetCompactedThrough(ctx context.Context, namespace string) (int64, error) {
+	if err := tx.checkOpen(); err != nil {
+		return -1, err
+	}
+
+	compactedThrough, ok := tx.store.compactedThrough[namespace]
+	if !ok {
+		return -1, nil
+	}
+	return compactedThrough, nil
+}
+
+func (tx *memoryTx) SetCompactedThrough(ctx context.Context, namespace string, serverVersion int64) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	store := tx.store
+
+	previous, existed := store.compactedThrough[namespace]
+	store.compactedThrough[namespace] = serverVersion
+
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			store.compactedThrough[namespace] = previous
+		} else {
+			delete(store.compactedThrough, namespace)
+		}
+	})
+	return nil
+}
+
+// ------------------------------------------------------------------------
+// Materialized rows
+
+func (tx *memoryTx) GetMaterializedRow(ctx context.Context, namespace string, tableName string, rowKey string) (*DBMaterializedRow, error) {
+	if err := tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	row, ok := tx.store.rows[DBRowRef{Namespace: namespace, TableName: tableName, RowKey: rowKey}]
+	if !ok {
+		return nil, nil
+	}
+	copied := *row
+	return &copied, nil
+}
+
+func (tx *memoryTx) UpsertMaterializedRow(ctx context.Context, row *DBMaterializedRow) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	store := tx.store
+
+	ref := DBRowRef{Namespace: row.Namespace, TableName: row.TableName, RowKey: row.RowKey}
+	previous, existed := store.rows[ref]
+	copied := *row
+	store.rows[ref] = &copied
+
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			store.rows[ref] = previous
+		} else {
+			delete(store.rows, ref)
+		}
+	})
+	return nil
+}
+
+func (tx *memoryTx) GetMaterializedRows(ctx context.Context, namespace string, tableName string) ([]*DBMaterializedRow, error) {
+	if err := tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	var rows []*DBMaterializedRow
+	for ref, row := range tx.store.rows {
+		if ref.Namespace == namespace && (tableName == "" || ref.TableName == tableName) {
+			copied := *row
+			rows = append(rows, &copied)
+		}
+	}
+
+	slices.SortFunc(rows, func(a, b *DBMaterializedRow) int {
+		return cmp.Or(cmp.Compare(a.TableName, b.TableName), cmp.Compare(a.RowKey, b.RowKey))
+	})
+	return rows, nil
+}
+
+func (tx *memoryTx) GetMaxMaterializedServerVersion(ctx context.Context) (int64, error) {
+	if err := tx.checkOpen(); err != nil {
+		return -1, err
+	}
+
+	maxVersion := int64(-1)
+	for _, row := range tx.store.rows {
+		maxVersion = max(maxVersion, row.ServerVersion)
+	}
+	return maxVersion, nil
+}
+
+// ------------------------------------------------------------------------
+// Client state
+
+func (tx *memoryTx) UpsertClientState(ctx context.Context, state *DBClientState) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	store := tx.store
+
+	key := memoryClient{namespace: state.Namespace, clientID: state.ClientID}
+	previous, existed := store.clients[key]
+	copied := *state
+	if existed {
+		copied.MaxDotVersion = max(previous.MaxDotVersion, state.MaxDotVersion)
+	}
+	store.clients[key] = &copied
+
+	tx.undo = append(tx.undo, func() {
+		if existed {
+			store.clients[key] = previous
+		} else {
+			delete(store.clients, key)
+		}
+	})
+	return nil
+}
+
+func (tx *memoryTx) GetClientState(ctx context.Context, namespace string, clientID string) (*DBClientState, error) {
+	if err := tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	state, ok := tx.store.clients[memoryClient{namespace: namespace, clientID: clientID}]
+	if !ok {
+		return nil, nil
+	}
+	copied := *state
+	return &copied, nil
+}
+
+func (tx *memoryTx) GetClientStates(ctx context.Context, syncedBefore int64) ([]*DBClientState, error) {
+	if err := tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	var states []*DBClientState
+	for _, state := range tx.store.clients {
+		if state.LastSyncedAt < syncedBefore {
+			copied := *state
+			states = append(states, &copied)
+		}
+	}
+
+	slices.SortFunc(states, func(a, b *DBClientState) int {
+		return cmp.Or(
+			cmp.Compare(a.LastSyncedAt, b.LastSyncedAt),
+			cmp.Compare(a.Namespace, b.Namespace),
+			cmp.Compare(a.ClientID, b.ClientID),
+		)
+	})
+	return states, nil
+}
+
+func (tx *memoryTx) DeleteClientState(ctx context.Context, namespace string, clientID string) (bool, error) {
+	if err := tx.checkWritable(); err != nil {
+		return false, err
+	}
+	store := tx.store
+
+	key := memoryClient{namespace: namespace, clientID: clientID}
+	previous, existed := store.clients[key]
+	if !existed {
+		return false, nil
+	}
+	delete(store.clients, key)
+
+	tx.undo = append(tx.undo, func() { store.clients[key] = previous })
+	return true, nil
+}
+
+func (tx *memoryTx) GetAcknowledgedWatermarks(ctx context.Context) (map[string]int64, error) {
+	if err := tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	watermarks := make(map[string]int64)
+	for _, state := range tx.store.clients {
+		// Clients that haven't seen anything don't hold back compaction
+		if state.LastSeenServerVersion < 0 {
+			continue
+		}
+		if watermark, ok := watermarks[state.Namespace]; !ok || state.LastSeenServerVersion < watermark {
+			watermarks[state.Namespace] = state.LastSeenServerVersion
+		}
+	}
+	return watermarks, nil
+}
+
+// ------------------------------------------------------------------------
+// Registered clients
+
+func (tx *memoryTx) InsertClient(ctx context.Context, client *DBClient) error {
+	if err := tx.checkWritable(); err != nil {
+		return err
+	}
+	store := tx.store
+
+	if _, exists := store.registeredClients[client.ClientID]; exists {
+		return fmt.Errorf("%w (client_id=%s)", ErrClientExists, client.ClientID)
+	}
+	copied := *client
+	copied.Secret = slices.Clone(client.Secret)
+	store.registeredClients[client.ClientID] = &copied
+
+	tx.undo = append(tx.undo, func() { delete(store.registeredClients, client.ClientID) })
+	return nil
+}
+
+func (tx *memoryTx) GetClient(ctx context.Context, clientID string) (*DBClient, error) {
+	if err := tx.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	client, ok := tx.store.registeredClients[clientID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *client
+	copied.Secret = slices.Clone(client.Secret)
+	return &copied, nil
+}
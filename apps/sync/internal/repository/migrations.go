@@ -0,0 +1,483 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Migration is a single, versioned change to the database schema.
+// Migrations are applied in Version order and each one only runs once,
+// applied versions are recorded in the schema_migrations table.
+// Never edit a migration that has shipped, add a new one instead.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, tx *sql.Tx) error
+}
+
+// Migrations lists every schema change in the order it's applied.
+//
+// Databases created before migrations existed have no schema_migrations
+// table, so the early migrations must also work on a schema that already
+// contains some or all of their changes.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create crdt_operations",
+		Up: execSQL(`
+			CREATE TABLE IF NOT EXISTS crdt_operations (
+			    -- server_version is the primary key for global ordering of all operations
+			    server_version INTEGER PRIMARY KEY AUTOINCREMENT,
+
+			    -- Dot: composite key (client_id, version) uniquely identifies each operation
+			    client_id TEXT NOT NULL,
+			    version INTEGER NOT NULL,
+
+			    -- CRDTOperation fields
+			    type TEXT NOT NULL,
+			    table_name TEXT NOT NULL,
+			    row_key TEXT NOT NULL,
+			    field TEXT,
+			    value TEXT,  -- JSON stored as TEXT in SQLite
+			    context TEXT,  -- JSON stored as TEXT in SQLite
+
+			    -- Ensure each Dot is unique
+			    UNIQUE(client_id, version)
+			);
+
+			-- Indexes for common queries
+			CREATE INDEX IF NOT EXISTS idx_table_row ON crdt_operations(table_name, row_key);
+			CREATE INDEX IF NOT EXISTS idx_type ON crdt_operations(type);
+			CREATE INDEX IF NOT EXISTS idx_client_version ON crdt_operations(client_id, version);
+		`),
+	},
+	{
+		Version:     2,
+		Description: "create materialized_rows",
+		Up: execSQL(`
+			CREATE TABLE IF NOT EXISTS materialized_rows (
+			    table_name TEXT NOT NULL,
+			    row_key TEXT NOT NULL,
+
+			    -- Field name -> {value, dot}, JSON stored as TEXT in SQLite
+			    fields TEXT NOT NULL,
+			    -- {dot, context} of the merged remove operations, NULL if never removed
+			    tombstone TEXT,
+
+			    -- Highest server_version folded into this row
+			    server_version INTEGER NOT NULL,
+
+			    PRIMARY KEY (table_name, row_key)
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_materialized_server_version ON materialized_rows(server_version);
+		`),
+	},
+	{
+		Version:     3,
+		Description: "create compaction_state",
+		Up: execSQL(`
+			CREATE TABLE IF NOT EXISTS compaction_state (
+			    -- Single row table
+			    id INTEGER PRIMARY KEY CHECK (id = 1),
+
+			    -- Dominated operations at or below this server_version have been deleted
+			    compacted_through INTEGER NOT NULL
+			);
+		`),
+	},
+	{
+		Version:     4,
+		Description: "create client_state",
+		Up: execSQL(`
+			CREATE TABLE IF NOT EXISTS client_state (
+			    client_id TEXT PRIMARY KEY,
+
+			    -- lastSeenServerVersion from the client's latest sync request
+			    last_seen_server_version INTEGER NOT NULL,
+			    -- Unix timestamp in milliseconds of the latest sync
+			    last_synced_at INTEGER NOT NULL,
+			    -- Highest dot version the client has sent, -1 if it never sent operations
+			    max_dot_version INTEGER NOT NULL
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_client_state_last_synced_at ON client_state(last_synced_at);
+		`),
+	},
+	{
+		Version:     5,
+		Description: "partition operations and materialized rows by namespace",
+		Up:          addNamespaceColumns,
+	},
+	{
+		Version:     6,
+		Description: "mark end-to-end encrypted operations",
+		Up: execSQL(`
+			-- 1 if field and value hold ciphertext only the clients can read
+			ALTER TABLE crdt_operations ADD COLUMN encrypted INTEGER NOT NULL DEFAULT 0;
+		`),
+	},
+	{
+		Version:     7,
+		Description: "create clients",
+		Up: execSQL(`
+			CREATE TABLE IF NOT EXISTS clients (
+			    client_id TEXT PRIMARY KEY,
+			    -- Namespace of the caller that registered the client
+			    namespace TEXT NOT NULL,
+			    -- HMAC key the client signs its syncs with, the server needs
+			    -- the key itself to check signatures, so it can't be hashed
+			    secret BLOB NOT NULL,
+			    -- Unix timestamp in milliseconds
+			    created_at INTEGER NOT NULL
+			);
+		`),
+	},
+	{
+		Version:     8,
+		Description: "key client_state by namespace",
+		Up: execSQL(`
+			-- Client IDs are only unique within a namespace. Existing clients
+			-- move to the default namespace, like their operations did.
+			CREATE TABLE client_state_by_namespace (
+			    namespace TEXT NOT NULL DEFAULT '',
+			    client_id TEXT NOT NULL,
+
+			    -- lastSeenServerVersion from the client's latest sync request
+			    last_seen_server_version INTEGER NOT NULL,
+			    -- Unix timestamp in milliseconds of the latest sync
+			    last_synced_at INTEGER NOT NULL,
+			    -- Highest dot version the client has sent, -1 if it never sent operations
+			    max_dot_version INTEGER NOT NULL,
+
+			    PRIMARY KEY (namespace, client_id)
+			);
+
+			INSERT INTO client_state_by_namespace (client_id, last_seen_server_version, last_synced_at, max_dot_version)
+			SELECT client_id, last_seen_server_version, last_synced_at, max_dot_version
+			FROM client_state;
+
+			DROP TABLE client_state;
+			ALTER TABLE client_state_by_namespace RENAME TO client_state;
+
+			CREATE INDEX IF NOT EXISTS idx_client_state_last_synced_at ON client_state(last_synced_at);
+		`),
+	},
+	{
+		Version:     9,
+		Description: "scope dots by namespace",
+		Up:          scopeDotsByNamespace,
+	},
+	{
+		Version:     10,
+		Description: "track compaction per namespace",
+		Up: execSQL(`
+			-- Every namespace is compacted below the watermark of its own
+			-- clients. The log was compacted through the old single value
+			-- in every namespace, the default namespace keeps it even
+			-- without operations so GetMaxServerVersion doesn't go back.
+			CREATE TABLE compaction_state_by_namespace (
+			    namespace TEXT PRIMARY KEY,
+
+			    -- Dominated operations in the namespace at or below this server_version have been deleted
+			    compacted_through INTEGER NOT NULL
+			);
+
+			INSERT INTO compaction_state_by_namespace (namespace, compacted_through)
+			SELECT namespaces.namespace, compaction_state.compacted_through
+			FROM compaction_state, (
+			    SELECT '' AS namespace
+			    UNION SELECT namespace FROM crdt_operations
+			    UNION SELECT namespace FROM client_state
+			) AS namespaces
+			WHERE compaction_state.id = 1;
+
+			DROP TABLE compaction_state;
+			ALTER TABLE compaction_state_by_namespace RENAME TO compaction_state;
+		`),
+	},
+}
+
+// execSQL returns a migration step that runs the given statements.
+func execSQL(statements string) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, statements)
+		return err
+	}
+}
+
+// addNamespaceColumns partitions the log by namespace. Existing operations move
+// to the default namespace. materialized_rows needs a new primary key, since it
+// only holds derived state it is dropped and rebuilt from the log on startup.
+func addNamespaceColumns(ctx context.Context, tx *sql.Tx) error {
+	hasNamespace, err := hasColumn(ctx, tx, "crdt_operations", "namespace")
+	if err != nil {
+		return err
+	}
+	if !hasNamespace {
+		const alter = `ALTER TABLE crdt_operations ADD COLUMN namespace TEXT NOT NULL DEFAULT ''`
+		if _, err := tx.ExecContext(ctx, alter); err != nil {
+			return fmt.Errorf("failed to add namespace to crdt_operations: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `DROP INDEX IF EXISTS idx_table_row`); err != nil {
+			return fmt.Errorf("failed to drop outdated index: %w", err)
+		}
+	}
+
+	hasNamespace, err = hasColumn(ctx, tx, "materialized_rows", "namespace")
+	if err != nil {
+		return err
+	}
+	if !hasNamespace {
+		if _, err := tx.ExecContext(ctx, `DROP TABLE materialized_rows`); err != nil {
+			return fmt.Errorf("failed to drop materialized_rows: %w", err)
+		}
+	}
+
+	return execSQL(`
+		CREATE INDEX IF NOT EXISTS idx_table_row ON crdt_operations(namespace, table_name, row_key);
+		CREATE INDEX IF NOT EXISTS idx_namespace_server_version ON crdt_operations(namespace, server_version);
+
+		CREATE TABLE IF NOT EXISTS materialized_rows (
+		    namespace TEXT NOT NULL DEFAULT '',
+		    table_name TEXT NOT NULL,
+		    row_key TEXT NOT NULL,
+
+		    -- Field name -> {value, dot}, JSON stored as TEXT in SQLite
+		    fields TEXT NOT NULL,
+		    -- {dot, context} of the merged remove operations, NULL if never removed
+		    tombstone TEXT,
+
+		    -- Highest server_version folded into this row
+		    server_version INTEGER NOT NULL,
+
+		    PRIMARY KEY (namespace, table_name, row_key)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_materialized_server_version ON materialized_rows(server_version);
+	`)(ctx, tx)
+}
+
+// scopeDotsByNamespace makes dots unique per namespace instead of globally, so
+// a client can't claim the dots of a client in another namespace. SQLite can't
+// change a table constraint in place, the table is rebuilt with the same
+// server versions. AUTOINCREMENT continues from the old table's sequence, so
+// the server versions of deleted operations are never handed out again.
+func scopeDotsByNamespace(ctx context.Context, tx *sql.Tx) error {
+	return execSQL(`
+		CREATE TABLE crdt_operations_by_namespace (
+		    -- server_version is the primary key for global ordering of all operations
+		    server_version INTEGER PRIMARY KEY AUTOINCREMENT,
+
+		    namespace TEXT NOT NULL DEFAULT '',
+
+		    -- Dot: composite key (client_id, version) uniquely identifies each
+		    -- operation within a namespace
+		    client_id TEXT NOT NULL,
+		    version INTEGER NOT NULL,
+
+		    -- CRDTOperation fields
+		    type TEXT NOT NULL,
+		    table_name TEXT NOT NULL,
+		    row_key TEXT NOT NULL,
+		    field TEXT,
+		    value TEXT,  -- JSON stored as TEXT in SQLite
+		    context TEXT,  -- JSON stored as TEXT in SQLite
+		    encrypted INTEGER NOT NULL DEFAULT 0,
+
+		    -- Ensure each Dot is unique within its namespace
+		    UNIQUE(namespace, client_id, version)
+		);
+
+		INSERT INTO crdt_operations_by_namespace
+		(server_version, namespace, client_id, version, type, table_name, row_key, field, value, context, encrypted)
+		SELECT server_version, namespace, client_id, version, type, table_name, row_key, field, value, context, encrypted
+		FROM crdt_operations;
+
+		DELETE FROM sqlite_sequence WHERE name = 'crdt_operations_by_namespace';
+		INSERT INTO sqlite_sequence (name, seq)
+		SELECT 'crdt_operations_by_namespace', seq FROM sqlite_sequence WHERE name = 'crdt_operations';
+
+		DROP TABLE crdt_operations;
+		ALTER TABLE crdt_operations_by_namespace RENAME TO crdt_operations;
+
+		CREATE INDEX IF NOT EXISTS idx_table_row ON crdt_operations(namespace, table_name, row_key);
+		CREATE INDEX IF NOT EXISTS idx_type ON crdt_operations(type);
+		CREATE INDEX IF NOT EXISTS idx_namespace_server_version ON crdt_operations(namespace, server_version);
+	`)(ctx, tx)
+}
+
+// hasColumn checks if a table exists and has the given column.
+func hasColumn(ctx context.Context, db Execer, table string, column string) (bool, error) {
+	const query = `
+		SELECT COUNT(*)
+		FROM pragma_table_info(?)
+		WHERE name = ?
+	`
+
+	var count int
+	if err := db.QueryRowContext(ctx, query, table, column).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to inspect %s.%s: %w", table, column, err)
+	}
+
+	return count > 0, nil
+}
+
+// InitSchema brings the database up to the latest schema version.
+func InitSchema(ctx context.Context, db *sql.DB) error {
+	_, err := Migrate(ctx, db, false)
+	return err
+}
+
+// Migrate applies every pending migration in order and returns the ones it applied.
+// Each migration runs in its own transaction together with its schema_migrations
+// row, so a failing migration leaves the database at the previous version.
+//
+// With dryRun, all pending migrations run in a single transaction that is
+// rolled back. The returned migrations are the ones that would be applied,
+// and a migration that would fail returns its error without changing anything.
+func Migrate(ctx context.Context, db *sql.DB, dryRun bool) ([]Migration, error) {
+	if dryRun {
+		return dryRunMigrations(ctx, db)
+	}
+
+	if err := createMigrationsTable(ctx, db); err != nil {
+		return nil, err
+	}
+	pending, err := PendingMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, migration := range pending {
+		if err := applyMigration(ctx, db, migration); err != nil {
+			return pending[:i], err
+		}
+	}
+
+	return pending, nil
+}
+
+// PendingMigrations returns the migrations that haven't been applied yet, in order.
+// Returns an error if the database was migrated by a newer version of the server.
+func PendingMigrations(ctx context.Context, db Execer) ([]Migration, error) {
+	current, err := GetSchemaVersion(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	latest := Migrations[len(Migrations)-1].Version
+	if current > latest {
+		return nil, fmt.Errorf("database schema version %d is newer than the latest known migration %d", current, latest)
+	}
+
+	var pending []Migration
+	for _, migration := range Migrations {
+		if migration.Version > current {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// GetSchemaVersion returns the highest applied migration version.
+// Returns 0 if no migration has been applied yet.
+func GetSchemaVersion(ctx context.Context, exec Execer) (int, error) {
+	exists, err := hasColumn(ctx, exec, "schema_migrations", "version")
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	const query = `
+		SELECT COALESCE(MAX(version), 0)
+		FROM schema_migrations
+	`
+
+	var version int
+	if err := exec.QueryRowContext(ctx, query).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+
+	return version, nil
+}
+
+func createMigrationsTable(ctx context.Context, exec Execer) error {
+	const query = `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+		    version INTEGER PRIMARY KEY,
+		    description TEXT NOT NULL,
+		    -- Unix timestamp in milliseconds
+		    applied_at INTEGER NOT NULL
+		)
+	`
+
+	if _, err := exec.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, migration Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := runMigration(ctx, tx, migration); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %w", migration.Version, err)
+	}
+
+	return nil
+}
+
+func dryRunMigrations(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	// Never committed, the rollback discards every change
+	defer tx.Rollback()
+
+	if err := createMigrationsTable(ctx, tx); err != nil {
+		return nil, err
+	}
+	pending, err := PendingMigrations(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, migration := range pending {
+		if err := runMigration(ctx, tx, migration); err != nil {
+			return nil, err
+		}
+	}
+
+	return pending, nil
+}
+
+// runMigration applies a migration and records it in schema_migrations.
+func runMigration(ctx context.Context, tx *sql.Tx, migration Migration) error {
+	if err := migration.Up(ctx, tx); err != nil {
+		return fmt.Errorf("failed to apply migration %d (%s): %w", migration.Version, migration.Description, err)
+	}
+
+	const query = `
+		INSERT INTO schema_migrations (version, description, applied_at)
+		VALUES (?, ?, ?)
+	`
+
+	if _, err := tx.ExecContext(ctx, query, migration.Version, migration.Description, time.Now().UnixMilli()); err != nil {
+		return fmt.Errorf("failed to record migration %d: %w", migration.Version, err)
+	}
+
+	return nil
+}
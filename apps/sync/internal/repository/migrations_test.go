@@ -0,0 +1,159 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+// -------------------- Migration tests --------------------
+
+func TestMigrate(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	latest := Migrations[len(Migrations)-1].Version
+
+	// Dry run reports every migration without applying any
+	planned, err := Migrate(ctx, db, true)
+	if err != nil {
+		t.Fatalf("dry run error = %v", err)
+	}
+	if len(planned) != len(Migrations) {
+		t.Errorf("expected %d planned migrations, got %d", len(Migrations), len(planned))
+	}
+	if version, _ := GetSchemaVersion(ctx, db); version != 0 {
+		t.Errorf("expected dry run to leave schema version 0, got %d", version)
+	}
+
+	applied, err := Migrate(ctx, db, false)
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	if len(applied) != len(Migrations) {
+		t.Errorf("expected %d applied migrations, got %d", len(Migrations), len(applied))
+	}
+	if version, _ := GetSchemaVersion(ctx, db); version != latest {
+		t.Errorf("expected schema version %d, got %d", latest, version)
+	}
+
+	// Running again is a no-op
+	again, err := Migrate(ctx, db, false)
+	if err != nil || len(again) != 0 {
+		t.Errorf("expected no pending migrations, got %d, %v", len(again), err)
+	}
+
+	// A database migrated by a newer server is refused
+	if _, err := db.ExecContext(ctx, `INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, 'future', 0)`, latest+1); err != nil {
+		t.Fatalf("failed to record future migration: %v", err)
+	}
+	if _, err := Migrate(ctx, db, false); err == nil {
+		t.Errorf("expected error for a newer schema version")
+	}
+}
+
+func TestMigrateUpgradesLegacySchema(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	// Schema created by InitSchema before operations had a namespace
+	// and before migrations were tracked
+	const legacy = `
+		CREATE TABLE crdt_operations (
+		    server_version INTEGER PRIMARY KEY AUTOINCREMENT,
+		    client_id TEXT NOT NULL,
+		    version INTEGER NOT NULL,
+		    type TEXT NOT NULL,
+		    table_name TEXT NOT NULL,
+		    row_key TEXT NOT NULL,
+		    field TEXT,
+		    value TEXT,
+		    context TEXT,
+		    UNIQUE(client_id, version)
+		);
+		CREATE INDEX idx_table_row ON crdt_operations(table_name, row_key);
+		INSERT INTO crdt_operations (client_id, version, type, table_name, row_key, value)
+		VALUES ('a', 1, 'setRow', 'users', '1', '{"name":"Alice"}'), ('a', 2, 'remove', 'users', '1', NULL);
+		DELETE FROM crdt_operations WHERE version = 2;
+	`
+	if _, err := db.ExecContext(ctx, legacy); err != nil {
+		t.Fatalf("failed to create legacy schema: %v", err)
+	}
+
+	if _, err := Migrate(ctx, db, false); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	ops, err := GetCRDTOperationsSince(ctx, db, "", -1, 10, "b")
+	if err != nil {
+		t.Fatalf("GetCRDTOperationsSince() error = %v", err)
+	}
+	if len(ops) != 1 || ops[0].ClientID != "a" {
+		t.Errorf("expected legacy operation in the default namespace, got %+v", ops)
+	}
+	if err := UpsertMaterializedRow(ctx, db, &DBMaterializedRow{Namespace: "tenant", TableName: "users", RowKey: "1", Fields: "{}", ServerVersion: 1}); err != nil {
+		t.Errorf("expected materialized_rows to be partitioned by namespace: %v", err)
+	}
+
+	// Dots are unique per namespace, and the deleted operation's server
+	// version isn't handed out again
+	serverVersion, inserted, err := InsertCRDTOperation(ctx, db, &DBCRDTOperation{Namespace: "tenant", ClientID: "a", Version: 1, Type: "remove", TableName: "users", RowKey: "1"})
+	if err != nil || !inserted || serverVersion != 3 {
+		t.Errorf("expected a new operation with server version 3, got %d, %v, %v", serverVersion, inserted, err)
+	}
+}
+
+func TestMigrateCompactionStatePerNamespace(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	if err := createMigrationsTable(ctx, db); err != nil {
+		t.Fatalf("createMigrationsTable() error = %v", err)
+	}
+	for _, migration := range Migrations[:9] {
+		if err := applyMigration(ctx, db, migration); err != nil {
+			t.Fatalf("migration %d error = %v", migration.Version, err)
+		}
+	}
+
+	// The log was compacted through 4 in every namespace
+	const compacted = `
+		INSERT INTO crdt_operations (namespace, client_id, version, type, table_name, row_key)
+		VALUES ('tenant', 'a', 1, 'remove', 'users', '1');
+		INSERT INTO client_state (namespace, client_id, last_seen_server_version, last_synced_at, max_dot_version)
+		VALUES ('idle', 'b', 0, 0, -1);
+		INSERT INTO compaction_state (id, compacted_through) VALUES (1, 4);
+	`
+	if _, err := db.ExecContext(ctx, compacted); err != nil {
+		t.Fatalf("failed to record compaction: %v", err)
+	}
+
+	if _, err := Migrate(ctx, db, false); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+
+	for _, namespace := range []string{"", "tenant", "idle"} {
+		if compactedThrough, err := GetCompactedThrough(ctx, db, namespace); err != nil || compactedThrough != 4 {
+			t.Errorf("expected namespace %q compacted through 4, got %d, %v", namespace, compactedThrough, err)
+		}
+	}
+	if compactedThrough, _ := GetCompactedThrough(ctx, db, "new"); compactedThrough != -1 {
+		t.Errorf("expected a new namespace to be uncompacted, got %d", compactedThrough)
+	}
+	if maxServerVersion, _ := GetMaxServerVersion(ctx, db); maxServerVersion != 4 {
+		t.Errorf("expected max server version 4, got %d", maxServerVersion)
+	}
+}
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	// Every connection to :memory: gets its own database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
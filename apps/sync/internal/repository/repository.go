@@ -3,42 +3,22 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"reflect"
+	"sync/internal/canonicaljson"
+	"sync/internal/logging"
 )
 
-// Schema contains all table definitions for the sync system.
-// The crdt_operations table stores all CRDT operations received by the server.
-const Schema = `
-CREATE TABLE IF NOT EXISTS crdt_operations (
-    -- server_version is the primary key for global ordering of all operations
-    server_version INTEGER PRIMARY KEY AUTOINCREMENT,
-    
-    -- Dot: composite key (client_id, version) uniquely identifies each operation
-    client_id TEXT NOT NULL,
-    version INTEGER NOT NULL,
-    
-    -- CRDTOperation fields
-    type TEXT NOT NULL,
-    table_name TEXT NOT NULL,
-    row_key TEXT NOT NULL,
-    field TEXT,
-    value TEXT,  -- JSON stored as TEXT in SQLite
-    context TEXT,  -- JSON stored as TEXT in SQLite
-    
-    -- Ensure each Dot is unique
-    UNIQUE(client_id, version)
-);
-
--- Indexes for common queries
-CREATE INDEX IF NOT EXISTS idx_table_row ON crdt_operations(table_name, row_key);
-CREATE INDEX IF NOT EXISTS idx_type ON crdt_operations(type);
-CREATE INDEX IF NOT EXISTS idx_client_version ON crdt_operations(client_id, version);
-`
+// ErrConsistencyViolation is returned when an operation reuses the dot of an
+// existing operation with different data. Retrying won't help, the client
+// generated two different operations with the same dot.
+var ErrConsistencyViolation = errors.New("CRDT consistency violation")
 
 // DBCRDTOperation represents a CRDT operation in the database.
 type DBCRDTOperation struct {
 	ServerVersion int64
+	Namespace     string
 	ClientID      string
 	Version       int64
 	Type          string
@@ -47,6 +27,9 @@ type DBCRDTOperation struct {
 	Field         *string
 	Value         *string // JSON stored as TEXT
 	Context       *string // JSON stored as TEXT
+
+	// Encrypted operations carry ciphertext the server can't read
+	Encrypted bool
 }
 
 // Execer is an interface that represents either *sql.DB or *sql.Tx.
@@ -57,27 +40,23 @@ type Execer interface {
 	QueryRowContext(context.Context, string, ...any) *sql.Row
 }
 
-// InitSchema creates all tables if they don't exist.
-func InitSchema(ctx context.Context, db *sql.DB) error {
-	_, err := db.ExecContext(ctx, Schema)
-	return err
-}
-
-// InsertCRDTOperation inserts a single CRDT operation and returns the auto-generated server_version.
-// If the operation already exists (duplicate client_id, version), it verifies the operation is identical.
+// InsertCRDTOperation inserts a single CRDT operation and returns the auto-generated server_version,
+// and whether the operation was new.
+// If the operation already exists (duplicate namespace, client_id, version), it verifies the operation is identical.
 // If the existing operation differs, this indicates a consistency violation and returns an error.
 // This makes the operation idempotent - safe to retry with the same data.
 // Works with both *sql.DB and *sql.Tx via the Execer interface.
-func InsertCRDTOperation(ctx context.Context, exec Execer, op *DBCRDTOperation) (int64, error) {
+func InsertCRDTOperation(ctx context.Context, exec Execer, op *DBCRDTOperation) (int64, bool, error) {
 	const insertQuery = `
 		INSERT INTO crdt_operations 
-		(client_id, version, type, table_name, row_key, field, value, context)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		(namespace, client_id, version, type, table_name, row_key, field, value, context, encrypted)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		RETURNING server_version
 	`
 
 	var serverVersion int64
 	err := exec.QueryRowContext(ctx, insertQuery,
+		op.Namespace,
 		op.ClientID,
 		op.Version,
 		op.Type,
@@ -86,20 +65,22 @@ func InsertCRDTOperation(ctx context.Context, exec Execer, op *DBCRDTOperation)
 		op.Field,
 		op.Value,
 		op.Context,
+		op.Encrypted,
 	).Scan(&serverVersion)
 
 	// If no error, we successfully inserted and got the server_version
 	if err == nil {
-		return serverVersion, nil
+		return serverVersion, true, nil
 	}
 
 	// Check if this is a UNIQUE constraint violation (duplicate operation)
 	if isUniqueConstraintError(err) {
-		return handleDuplicateOperation(ctx, exec, op)
+		serverVersion, err := handleDuplicateOperation(ctx, exec, op)
+		return serverVersion, false, err
 	}
 
 	// Some other error occurred
-	return 0, err
+	return 0, false, err
 }
 
 // isUniqueConstraintError checks if the error is a UNIQUE constraint violation
@@ -115,16 +96,17 @@ func isUniqueConstraintError(err error) bool {
 // Returns the existing server_version if identical, or an error if different (consistency violation).
 func handleDuplicateOperation(ctx context.Context, exec Execer, op *DBCRDTOperation) (int64, error) {
 	const selectQuery = `
-		SELECT server_version, type, table_name, row_key, field, value, context
+		SELECT server_version, type, table_name, row_key, field, value, context, encrypted
 		FROM crdt_operations 
-		WHERE client_id = ? AND version = ?
+		WHERE namespace = ? AND client_id = ? AND version = ?
 	`
 
 	var existing DBCRDTOperation
+	existing.Namespace = op.Namespace
 	existing.ClientID = op.ClientID
 	existing.Version = op.Version
 
-	err := exec.QueryRowContext(ctx, selectQuery, op.ClientID, op.Version).Scan(
+	err := exec.QueryRowContext(ctx, selectQuery, op.Namespace, op.ClientID, op.Version).Scan(
 		&existing.ServerVersion,
 		&existing.Type,
 		&existing.TableName,
@@ -132,6 +114,7 @@ func handleDuplicateOperation(ctx context.Context, exec Execer, op *DBCRDTOperat
 		&existing.Field,
 		&existing.Value,
 		&existing.Context,
+		&existing.Encrypted,
 	)
 	if err != nil {
 		return 0, fmt.Errorf("failed to fetch existing operation for duplicate check: %w", err)
@@ -139,30 +122,67 @@ func handleDuplicateOperation(ctx context.Context, exec Execer, op *DBCRDTOperat
 
 	// Compare the operation data (excluding ServerVersion which is auto-generated)
 	if !operationsEqual(op, &existing) {
-		return 0, fmt.Errorf(
-			"CRDT consistency violation: duplicate operation (client_id=%s, version=%d) with different data. "+
-				"Existing: type=%s, table=%s, row=%s. Incoming: type=%s, table=%s, row=%s",
-			op.ClientID, op.Version,
-			existing.Type, existing.TableName, existing.RowKey,
-			op.Type, op.TableName, op.RowKey,
-		)
+		logConflictingOperation(ctx, &existing, op)
+		return 0, duplicateOperationError(op)
 	}
 
 	// Operation is identical - this is a valid retry, return existing server_version
+	logRetriedOperation(ctx, &existing)
 	return existing.ServerVersion, nil
 }
 
+// logRetriedOperation notes an operation the client sent again, usually
+// because the response to an earlier sync got lost.
+func logRetriedOperation(ctx context.Context, existing *DBCRDTOperation) {
+	logging.FromContext(ctx).Debug("Ignoring retried operation",
+		"dot_client_id", existing.ClientID, "dot_version", existing.Version,
+		"server_version", existing.ServerVersion)
+}
+
+// logConflictingOperation records what an incoming operation collided with.
+// The existing operation is only logged, the error sent back to the client
+// must not reveal it.
+func logConflictingOperation(ctx context.Context, existing, op *DBCRDTOperation) {
+	logging.FromContext(ctx).Warn("Operation reuses the dot of a different operation",
+		"dot_client_id", op.ClientID, "dot_version", op.Version,
+		"existing_type", existing.Type, "existing_table", existing.TableName, "existing_row_key", existing.RowKey,
+		"server_version", existing.ServerVersion)
+}
+
+// duplicateOperationError describes an incoming operation that reuses the dot
+// of an existing operation with different data. It only describes the
+// incoming operation, it ends up in the response to the client.
+func duplicateOperationError(op *DBCRDTOperation) error {
+	return fmt.Errorf(
+		"%w: duplicate operation (client_id=%s, version=%d) with different data: type=%s, table=%s, row=%s",
+		ErrConsistencyViolation, op.ClientID, op.Version,
+		op.Type, op.TableName, op.RowKey,
+	)
+}
+
 // operationsEqual checks if two operations have identical data (excluding ServerVersion).
-// Uses deep equality for nullable fields.
+// Uses deep equality for nullable fields and compares JSON by its canonical form.
 func operationsEqual(a, b *DBCRDTOperation) bool {
-	return a.ClientID == b.ClientID &&
+	return a.Namespace == b.Namespace &&
+		a.ClientID == b.ClientID &&
 		a.Version == b.Version &&
 		a.Type == b.Type &&
 		a.TableName == b.TableName &&
 		a.RowKey == b.RowKey &&
 		reflect.DeepEqual(a.Field, b.Field) &&
-		reflect.DeepEqual(a.Value, b.Value) &&
-		reflect.DeepEqual(a.Context, b.Context)
+		jsonEqual(a.Value, b.Value) &&
+		jsonEqual(a.Context, b.Context) &&
+		a.Encrypted == b.Encrypted
+}
+
+// jsonEqual compares two nullable JSON texts by their canonical form, a
+// retry from a client that formats its JSON differently is still the same
+// operation. Values stored before they were canonicalized compare too.
+func jsonEqual(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return canonicaljson.Equal([]byte(*a), []byte(*b))
 }
 
 // nullableStringEqual compares two nullable strings for equality
@@ -176,54 +196,87 @@ func nullableStringEqual(a, b *string) bool {
 	return *a == *b
 }
 
-// InsertCRDTOperations batch inserts multiple CRDT operations and returns their server_versions.
+// InsertCRDTOperations batch inserts multiple CRDT operations and returns their server_versions,
+// and how many of them were new rather than retries of stored operations.
 // This is more efficient than calling InsertCRDTOperation multiple times.
-func InsertCRDTOperations(ctx context.Context, exec Execer, ops []*DBCRDTOperation) ([]int64, error) {
+func InsertCRDTOperations(ctx context.Context, exec Execer, ops []*DBCRDTOperation) ([]int64, int, error) {
 	if len(ops) == 0 {
-		return []int64{}, nil
+		return []int64{}, 0, nil
 	}
 
 	serverVersions := make([]int64, 0, len(ops))
+	inserted := 0
 
 	for _, op := range ops {
-		serverVersion, err := InsertCRDTOperation(ctx, exec, op)
+		serverVersion, isNew, err := InsertCRDTOperation(ctx, exec, op)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
+		}
+		if isNew {
+			inserted++
 		}
 		serverVersions = append(serverVersions, serverVersion)
 	}
 
-	return serverVersions, nil
+	return serverVersions, inserted, nil
 }
 
-// GetCRDTOperationsSince retrieves all CRDT operations since a given server_version with a limit,
-// excluding operations from the specified client.
+// GetCRDTOperationsSince retrieves all CRDT operations in a namespace since a given server_version
+// with a limit, excluding operations from the specified client.
 // This is used by the sync endpoint to send operations that the client hasn't seen yet.
 // Results are ordered by server_version ASC.
-func GetCRDTOperationsSince(ctx context.Context, db Execer, serverVersion int64, limit int, excludeClientID string) ([]*DBCRDTOperation, error) {
+func GetCRDTOperationsSince(ctx context.Context, db Execer, namespace string, serverVersion int64, limit int, excludeClientID string) ([]*DBCRDTOperation, error) {
 	if excludeClientID == "" {
 		return nil, fmt.Errorf("excludeClientID cannot be empty")
 	}
 
 	const query = `
-		SELECT server_version, client_id, version, type, table_name, row_key, field, value, context
+		SELECT server_version, namespace, client_id, version, type, table_name, row_key, field, value, context, encrypted
 		FROM crdt_operations
-		WHERE server_version > ? AND client_id != ?
+		WHERE namespace = ? AND server_version > ? AND client_id != ?
 		ORDER BY server_version ASC
 		LIMIT ?
 	`
 
-	rows, err := db.QueryContext(ctx, query, serverVersion, excludeClientID, limit)
+	rows, err := db.QueryContext(ctx, query, namespace, serverVersion, excludeClientID, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	return scanCRDTOperations(rows)
+}
+
+// GetAllCRDTOperationsSince retrieves CRDT operations from every client and namespace since
+// a given server_version with a limit. Used when folding the log into materialized rows.
+// Results are ordered by server_version ASC.
+func GetAllCRDTOperationsSince(ctx context.Context, db Execer, serverVersion int64, limit int) ([]*DBCRDTOperation, error) {
+	const query = `
+		SELECT server_version, namespace, client_id, version, type, table_name, row_key, field, value, context, encrypted
+		FROM crdt_operations
+		WHERE server_version > ?
+		ORDER BY server_version ASC
+		LIMIT ?
+	`
+
+	rows, err := db.QueryContext(ctx, query, serverVersion, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanCRDTOperations(rows)
+}
+
+// scanCRDTOperations reads all rows selected as
+// server_version, namespace, client_id, version, type, table_name, row_key, field, value, context, encrypted.
+func scanCRDTOperations(rows *sql.Rows) ([]*DBCRDTOperation, error) {
 	var ops []*DBCRDTOperation
 	for rows.Next() {
 		op := &DBCRDTOperation{}
 		err := rows.Scan(
 			&op.ServerVersion,
+			&op.Namespace,
 			&op.ClientID,
 			&op.Version,
 			&op.Type,
@@ -232,6 +285,7 @@ func GetCRDTOperationsSince(ctx context.Context, db Execer, serverVersion int64,
 			&op.Field,
 			&op.Value,
 			&op.Context,
+			&op.Encrypted,
 		)
 		if err != nil {
 			return nil, err
@@ -250,10 +304,14 @@ func GetCRDTOperationsSince(ctx context.Context, db Execer, serverVersion int64,
 // Returns -1 if the table is empty (no operations yet).
 // This is useful for detecting when a client's lastSeenServerVersion is out of sync
 // with the server (e.g., after a server database reset).
+// Compaction can delete the newest operation, so the highest compaction
+// watermark of any namespace counts as a server_version that has existed.
 func GetMaxServerVersion(ctx context.Context, db Execer) (int64, error) {
 	const query = `
-		SELECT COALESCE(MAX(server_version), -1)
-		FROM crdt_operations
+		SELECT MAX(
+			COALESCE((SELECT MAX(server_version) FROM crdt_operations), -1),
+			COALESCE((SELECT MAX(compacted_through) FROM compaction_state), -1)
+		)
 	`
 
 	var maxVersion int64
@@ -0,0 +1,202 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+)
+
+// SQLiteStore is an OperationStore backed by the SQLite schema in this package.
+// Every method of its transactions forwards to the query function of the same name.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore wraps a database whose schema has been initialized with InitSchema.
+// The store takes ownership of the database, Close closes it.
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: db}
+}
+
+// Begin starts read-only transactions deferred, so they run alongside each
+// other and the writer. Write transactions start with BEGIN IMMEDIATE and
+// take the write lock up front: a deferred transaction that reads first has
+// to upgrade its lock later, and SQLite fails that upgrade with SQLITE_BUSY
+// right away instead of waiting out the busy timeout.
+func (store *SQLiteStore) Begin(ctx context.Context, readOnly bool) (StoreTx, error) {
+	if !readOnly {
+		return store.beginImmediate(ctx)
+	}
+
+	tx, err := store.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	return &sqliteTx{tx: tx}, nil
+}
+
+// beginImmediate starts a write transaction on a connection of its own,
+// database/sql can't issue BEGIN IMMEDIATE itself.
+func (store *SQLiteStore) beginImmediate(ctx context.Context) (StoreTx, error) {
+	conn, err := store.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	return &sqliteTx{tx: &immediateTx{Conn: conn}}, nil
+}
+
+func (store *SQLiteStore) Close() error {
+	return store.db.Close()
+}
+
+// CheckpointWAL copies every page of the write-ahead log into the database
+// file and truncates the log, so a stopped server leaves a self-contained
+// database behind. Does nothing when the database isn't in WAL mode.
+func CheckpointWAL(ctx context.Context, exec Execer) error {
+	const query = `PRAGMA wal_checkpoint(TRUNCATE)`
+
+	var busy, logPages, checkpointedPages int
+	if err := exec.QueryRowContext(ctx, query).Scan(&busy, &logPages, &checkpointedPages); err != nil {
+		return fmt.Errorf("failed to checkpoint WAL: %w", err)
+	}
+	if busy != 0 {
+		return fmt.Errorf("failed to checkpoint WAL: database is busy, %d of %d pages checkpointed", checkpointedPages, logPages)
+	}
+	return nil
+}
+
+// sqlTx is satisfied by *sql.Tx and immediateTx.
+type sqlTx interface {
+	Execer
+	Commit() error
+	Rollback() error
+}
+
+type sqliteTx struct {
+	tx sqlTx
+}
+
+// immediateTx is a transaction begun with BEGIN IMMEDIATE on a dedicated
+// connection, which goes back to the pool once the transaction is done.
+type immediateTx struct {
+	*sql.Conn
+	done bool
+}
+
+func (tx *immediateTx) Commit() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	// Commit and rollback must run even if the request was cancelled
+	if _, err := tx.ExecContext(context.Background(), "COMMIT"); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	tx.done = true
+	return tx.Conn.Close()
+}
+
+func (tx *immediateTx) Rollback() error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+	if _, err := tx.ExecContext(context.Background(), "ROLLBACK"); err != nil {
+		// Never hand a connection with an open transaction back to the pool
+		tx.Raw(func(any) error { return driver.ErrBadConn })
+		return fmt.Errorf("failed to roll back transaction: %w", err)
+	}
+	return tx.Conn.Close()
+}
+
+func (tx *sqliteTx) InsertCRDTOperations(ctx context.Context, ops []*DBCRDTOperation) ([]int64, int, error) {
+	return InsertCRDTOperations(ctx, tx.tx, ops)
+}
+
+func (tx *sqliteTx) GetCRDTOperationsSince(ctx context.Context, namespace string, serverVersion int64, limit int, excludeClientID string) ([]*DBCRDTOperation, error) {
+	return GetCRDTOperationsSince(ctx, tx.tx, namespace, serverVersion, limit, excludeClientID)
+}
+
+func (tx *sqliteTx) GetAllCRDTOperationsSince(ctx context.Context, serverVersion int64, limit int) ([]*DBCRDTOperation, error) {
+	return GetAllCRDTOperationsSince(ctx, tx.tx, serverVersion, limit)
+}
+
+func (tx *sqliteTx) GetCRDTOperationsForRow(ctx context.Context, row DBRowRef) ([]*DBCRDTOperation, error) {
+	return GetCRDTOperationsForRow(ctx, tx.tx, row)
+}
+
+func (tx *sqliteTx) GetRowsWithOperationsBetween(ctx context.Context, namespace string, after int64, through int64) ([]DBRowRef, error) {
+	return GetRowsWithOperationsBetween(ctx, tx.tx, namespace, after, through)
+}
+
+func (tx *sqliteTx) DeleteCRDTOperations(ctx context.Context, serverVersions []int64) (int64, error) {
+	return DeleteCRDTOperations(ctx, tx.tx, serverVersions)
+}
+
+func (tx *sqliteTx) GetMaxServerVersion(ctx context.Context) (int64, error) {
+	return GetMaxServerVersion(ctx, tx.tx)
+}
+
+func (tx *sqliteTx) GetCompactedThrough(ctx context.Context, namespace string) (int64, error) {
+	return GetCompactedThrough(ctx, tx.tx, namespace)
+}
+
+func (tx *sqliteTx) SetCompactedThrough(ctx context.Context, namespace string, serverVersion int64) error {
+	return SetCompactedThrough(ctx, tx.tx, namespace, serverVersion)
+}
+
+func (tx *sqliteTx) GetMaterializedRow(ctx context.Context, namespace string, tableName string, rowKey string) (*DBMaterializedRow, error) {
+	return GetMaterializedRow(ctx, tx.tx, namespace, tableName, rowKey)
+}
+
+func (tx *sqliteTx) UpsertMaterializedRow(ctx context.Context, row *DBMaterializedRow) error {
+	return UpsertMaterializedRow(ctx, tx.tx, row)
+}
+
+func (tx *sqliteTx) GetMaterializedRows(ctx context.Context, namespace string, tableName string) ([]*DBMaterializedRow, error) {
+	return GetMaterializedRows(ctx, tx.tx, namespace, tableName)
+}
+
+func (tx *sqliteTx) GetMaxMaterializedServerVersion(ctx context.Context) (int64, error) {
+	return GetMaxMaterializedServerVersion(ctx, tx.tx)
+}
+
+func (tx *sqliteTx) UpsertClientState(ctx context.Context, state *DBClientState) error {
+	return UpsertClientState(ctx, tx.tx, state)
+}
+
+func (tx *sqliteTx) GetClientState(ctx context.Context, namespace string, clientID string) (*DBClientState, error) {
+	return GetClientState(ctx, tx.tx, namespace, clientID)
+}
+
+func (tx *sqliteTx) GetClientStates(ctx context.Context, syncedBefore int64) ([]*DBClientState, error) {
+	return GetClientStates(ctx, tx.tx, syncedBefore)
+}
+
+func (tx *sqliteTx) DeleteClientState(ctx context.Context, namespace string, clientID string) (bool, error) {
+	return DeleteClientState(ctx, tx.tx, namespace, clientID)
+}
+
+func (tx *sqliteTx) GetAcknowledgedWatermarks(ctx context.Context) (map[string]int64, error) {
+	return GetAcknowledgedWatermarks(ctx, tx.tx)
+}
+
+func (tx *sqliteTx) InsertClient(ctx context.Context, client *DBClient) error {
+	return InsertClient(ctx, tx.tx, client)
+}
+
+func (tx *sqliteTx) GetClient(ctx context.Context, clientID string) (*DBClient, error) {
+	return GetClient(ctx, tx.tx, clientID)
+}
+
+func (tx *sqliteTx) Commit() error {
+	return tx.tx.Commit()
+}
+
+func (tx *sqliteTx) Rollback() error {
+	return tx.tx.Rollback()
+}
@@ -0,0 +1,94 @@
+package repository
+
+import "context"
+
+// OperationStore persists the operation log and the state derived from it.
+// SQLiteStore is used by the server, MemoryStore keeps everything in process
+// for tests and the simulator. Other backends only need to implement this
+// interface, sync_engine never talks to a database directly.
+type OperationStore interface {
+	// Begin starts a transaction. Transactions must be serializable, Sync
+	// relies on reading its own inserts and on nothing else interleaving.
+	// A read-only transaction rejects writes.
+	Begin(ctx context.Context, readOnly bool) (StoreTx, error)
+
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+// StoreTx is a transaction on an OperationStore.
+// Nothing is visible to other transactions until Commit. Rollback discards
+// every change and is safe to call after Commit, so it can be deferred.
+type StoreTx interface {
+	// InsertCRDTOperations inserts operations and returns the server_version
+	// assigned to each of them, and how many were new. Inserting an operation
+	// with an existing dot is idempotent if the data is identical and an
+	// error otherwise.
+	InsertCRDTOperations(ctx context.Context, ops []*DBCRDTOperation) ([]int64, int, error)
+
+	// GetCRDTOperationsSince returns up to limit operations in a namespace after
+	// serverVersion that were not sent by excludeClientID, ordered by server_version.
+	GetCRDTOperationsSince(ctx context.Context, namespace string, serverVersion int64, limit int, excludeClientID string) ([]*DBCRDTOperation, error)
+
+	// GetAllCRDTOperationsSince returns up to limit operations from every client
+	// and namespace after serverVersion, ordered by server_version.
+	GetAllCRDTOperationsSince(ctx context.Context, serverVersion int64, limit int) ([]*DBCRDTOperation, error)
+
+	// GetCRDTOperationsForRow returns every operation on a row, ordered by server_version.
+	GetCRDTOperationsForRow(ctx context.Context, row DBRowRef) ([]*DBCRDTOperation, error)
+
+	// GetRowsWithOperationsBetween returns every row in a namespace with an operation
+	// in (after, through], ordered by table name and row key.
+	GetRowsWithOperationsBetween(ctx context.Context, namespace string, after int64, through int64) ([]DBRowRef, error)
+
+	// DeleteCRDTOperations deletes operations by server_version and returns how many were deleted.
+	DeleteCRDTOperations(ctx context.Context, serverVersions []int64) (int64, error)
+
+	// GetMaxServerVersion returns the highest server_version that has existed, -1 if none.
+	GetMaxServerVersion(ctx context.Context) (int64, error)
+
+	// GetCompactedThrough returns the server_version a namespace has been compacted through, -1 if never.
+	GetCompactedThrough(ctx context.Context, namespace string) (int64, error)
+
+	// SetCompactedThrough records the server_version a namespace has been compacted through.
+	SetCompactedThrough(ctx context.Context, namespace string, serverVersion int64) error
+
+	// GetMaterializedRow returns the folded state of a row, nil if no operation touched it.
+	GetMaterializedRow(ctx context.Context, namespace string, tableName string, rowKey string) (*DBMaterializedRow, error)
+
+	// UpsertMaterializedRow inserts or replaces the folded state of a row.
+	UpsertMaterializedRow(ctx context.Context, row *DBMaterializedRow) error
+
+	// GetMaterializedRows returns the rows of a table in a namespace, or of all
+	// its tables when tableName is empty, ordered by table name and row key.
+	GetMaterializedRows(ctx context.Context, namespace string, tableName string) ([]*DBMaterializedRow, error)
+
+	// GetMaxMaterializedServerVersion returns the highest server_version folded into any row, -1 if none.
+	GetMaxMaterializedServerVersion(ctx context.Context) (int64, error)
+
+	// UpsertClientState records a sync from a client, the max dot version never decreases.
+	UpsertClientState(ctx context.Context, state *DBClientState) error
+
+	// GetClientState returns the state of a client in a namespace, nil if it has never synced.
+	GetClientState(ctx context.Context, namespace string, clientID string) (*DBClientState, error)
+
+	// GetClientStates returns every client in every namespace that last synced
+	// before the Unix timestamp in milliseconds, least recently synced first.
+	GetClientStates(ctx context.Context, syncedBefore int64) ([]*DBClientState, error)
+
+	// DeleteClientState forgets a client in a namespace, returns false if it was unknown.
+	DeleteClientState(ctx context.Context, namespace string, clientID string) (bool, error)
+
+	// GetAcknowledgedWatermarks returns the lowest last seen server version of the
+	// clients that have seen anything in each namespace, keyed by namespace.
+	GetAcknowledgedWatermarks(ctx context.Context) (map[string]int64, error)
+
+	// InsertClient registers a client, ErrClientExists if its ID is taken.
+	InsertClient(ctx context.Context, client *DBClient) error
+
+	// GetClient returns a registered client, nil if it was never registered.
+	GetClient(ctx context.Context, clientID string) (*DBClient, error)
+
+	Commit() error
+	Rollback() error
+}
@@ -0,0 +1,328 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"maps"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// -------------------- Store conformance tests --------------------
+
+// testStores returns a fresh instance of every OperationStore implementation.
+func testStores(t *testing.T) map[string]OperationStore {
+	t.Helper()
+
+	db := openTestDB(t)
+	if err := InitSchema(context.Background(), db); err != nil {
+		t.Fatalf("failed to init schema: %v", err)
+	}
+
+	stores := map[string]OperationStore{
+		"sqlite": NewSQLiteStore(db),
+		"memory": NewMemoryStore(),
+	}
+	for _, store := range stores {
+		t.Cleanup(func() { store.Close() })
+	}
+	return stores
+}
+
+func TestStoreOperations(t *testing.T) {
+	ctx := context.Background()
+	value := `"Alice"`
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			tx, err := store.Begin(ctx, false)
+			if err != nil {
+				t.Fatalf("Begin() error = %v", err)
+			}
+			defer tx.Rollback()
+
+			ops := []*DBCRDTOperation{
+				{ClientID: "a", Version: 1, Type: "set", TableName: "users", RowKey: "1", Value: &value},
+				{ClientID: "b", Version: 1, Type: "set", TableName: "users", RowKey: "2", Value: &value},
+				{Namespace: "other", ClientID: "c", Version: 1, Type: "set", TableName: "users", RowKey: "1", Value: &value},
+			}
+			serverVersions, inserted, err := tx.InsertCRDTOperations(ctx, ops)
+			if err != nil {
+				t.Fatalf("InsertCRDTOperations() error = %v", err)
+			}
+			if inserted != 3 {
+				t.Errorf("expected 3 new operations, got %d", inserted)
+			}
+			if len(serverVersions) != 3 || serverVersions[0] >= serverVersions[1] || serverVersions[1] >= serverVersions[2] {
+				t.Fatalf("expected increasing server versions, got %v", serverVersions)
+			}
+
+			// Retrying an identical operation returns its server version
+			retried, inserted, err := tx.InsertCRDTOperations(ctx, ops[:1])
+			if err != nil || retried[0] != serverVersions[0] || inserted != 0 {
+				t.Errorf("expected idempotent retry, got %v, %d new, %v", retried, inserted, err)
+			}
+
+			// A retry is the same operation however its JSON is formatted
+			reformatted := *ops[0]
+			spaced := ` "Alice" `
+			reformatted.Value = &spaced
+			if retried, _, err := tx.InsertCRDTOperations(ctx, []*DBCRDTOperation{&reformatted}); err != nil || retried[0] != serverVersions[0] {
+				t.Errorf("expected reformatted retry to be idempotent, got %v, %v", retried, err)
+			}
+
+			// Reusing a dot with different data is rejected
+			changed := *ops[0]
+			changed.TableName = "posts"
+			if _, _, err := tx.InsertCRDTOperations(ctx, []*DBCRDTOperation{&changed}); err == nil {
+				t.Errorf("expected error for conflicting duplicate")
+			} else if strings.Contains(err.Error(), "users") {
+				t.Errorf("expected the error not to describe the existing operation, got %v", err)
+			}
+
+			since, err := tx.GetCRDTOperationsSince(ctx, "", -1, 10, "a")
+			if err != nil {
+				t.Fatalf("GetCRDTOperationsSince() error = %v", err)
+			}
+			if len(since) != 1 || since[0].ClientID != "b" {
+				t.Errorf("expected only b's operation in the default namespace, got %+v", since)
+			}
+
+			all, err := tx.GetAllCRDTOperationsSince(ctx, serverVersions[0], 1)
+			if err != nil {
+				t.Fatalf("GetAllCRDTOperationsSince() error = %v", err)
+			}
+			if len(all) != 1 || all[0].ServerVersion != serverVersions[1] {
+				t.Errorf("expected limited page starting at %d, got %+v", serverVersions[1], all)
+			}
+
+			deleted, err := tx.DeleteCRDTOperations(ctx, []int64{serverVersions[2], serverVersions[2]})
+			if err != nil || deleted != 1 {
+				t.Errorf("expected 1 deleted operation, got %d, %v", deleted, err)
+			}
+			if err := tx.SetCompactedThrough(ctx, "", serverVersions[2]); err != nil {
+				t.Fatalf("SetCompactedThrough() error = %v", err)
+			}
+			maxServerVersion, err := tx.GetMaxServerVersion(ctx)
+			if err != nil || maxServerVersion != serverVersions[2] {
+				t.Errorf("expected max server version %d, got %d, %v", serverVersions[2], maxServerVersion, err)
+			}
+
+			if compactedThrough, _ := tx.GetCompactedThrough(ctx, "other"); compactedThrough != -1 {
+				t.Errorf("expected another namespace to be uncompacted, got %d", compactedThrough)
+			}
+
+			rows, err := tx.GetRowsWithOperationsBetween(ctx, "", -1, maxServerVersion)
+			if err != nil {
+				t.Fatalf("GetRowsWithOperationsBetween() error = %v", err)
+			}
+			if len(rows) != 2 || rows[0].RowKey != "1" || rows[1].RowKey != "2" {
+				t.Errorf("expected rows 1 and 2, got %+v", rows)
+			}
+		})
+	}
+}
+
+func TestStoreRollback(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			tx, err := store.Begin(ctx, false)
+			if err != nil {
+				t.Fatalf("Begin() error = %v", err)
+			}
+			if _, _, err := tx.InsertCRDTOperations(ctx, []*DBCRDTOperation{
+				{ClientID: "a", Version: 1, Type: "remove", TableName: "users", RowKey: "1"},
+			}); err != nil {
+				t.Fatalf("InsertCRDTOperations() error = %v", err)
+			}
+			if err := tx.UpsertMaterializedRow(ctx, &DBMaterializedRow{TableName: "users", RowKey: "1", Fields: "{}", ServerVersion: 1}); err != nil {
+				t.Fatalf("UpsertMaterializedRow() error = %v", err)
+			}
+			if err := tx.UpsertClientState(ctx, &DBClientState{ClientID: "a", LastSeenServerVersion: 1, MaxDotVersion: 1}); err != nil {
+				t.Fatalf("UpsertClientState() error = %v", err)
+			}
+			if err := tx.Rollback(); err != nil {
+				t.Fatalf("Rollback() error = %v", err)
+			}
+
+			tx, err = store.Begin(ctx, true)
+			if err != nil {
+				t.Fatalf("Begin() error = %v", err)
+			}
+			defer tx.Rollback()
+
+			if ops, _ := tx.GetAllCRDTOperationsSince(ctx, -1, 10); len(ops) != 0 {
+				t.Errorf("expected no operations after rollback, got %d", len(ops))
+			}
+			if row, _ := tx.GetMaterializedRow(ctx, "", "users", "1"); row != nil {
+				t.Errorf("expected no materialized row after rollback, got %+v", row)
+			}
+			if watermarks, _ := tx.GetAcknowledgedWatermarks(ctx); len(watermarks) != 0 {
+				t.Errorf("expected no acknowledged watermark after rollback, got %v", watermarks)
+			}
+		})
+	}
+}
+
+func TestStoreDotsPerNamespace(t *testing.T) {
+	ctx := context.Background()
+	value := `"Alice"`
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			tx, err := store.Begin(ctx, false)
+			if err != nil {
+				t.Fatalf("Begin() error = %v", err)
+			}
+			defer tx.Rollback()
+
+			op := DBCRDTOperation{ClientID: "a", Version: 1, Type: "set", TableName: "users", RowKey: "1", Value: &value}
+			claimed := op
+			claimed.Namespace = "tenant"
+			claimed.TableName = "posts"
+
+			// The same dot in another namespace belongs to another client
+			for _, op := range []*DBCRDTOperation{&op, &claimed} {
+				if _, inserted, err := tx.InsertCRDTOperations(ctx, []*DBCRDTOperation{op}); err != nil || inserted != 1 {
+					t.Errorf("expected a new operation in namespace %q, got %d new, %v", op.Namespace, inserted, err)
+				}
+			}
+
+			// Conflicts don't reveal the operation they collided with
+			claimed.RowKey = "2"
+			_, _, err = tx.InsertCRDTOperations(ctx, []*DBCRDTOperation{&claimed})
+			if !errors.Is(err, ErrConsistencyViolation) || strings.Contains(err.Error(), "row=1") {
+				t.Errorf("expected a consistency violation naming only the incoming operation, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreClientState(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			tx, err := store.Begin(ctx, false)
+			if err != nil {
+				t.Fatalf("Begin() error = %v", err)
+			}
+			defer tx.Rollback()
+
+			states := []*DBClientState{
+				{ClientID: "a", LastSeenServerVersion: 5, LastSyncedAt: 200, MaxDotVersion: 3},
+				{ClientID: "b", LastSeenServerVersion: 2, LastSyncedAt: 100, MaxDotVersion: -1},
+				// The max dot version never decreases
+				{ClientID: "a", LastSeenServerVersion: 6, LastSyncedAt: 300, MaxDotVersion: 1},
+				// The same client ID in another namespace is another client,
+				// one that hasn't seen anything doesn't hold back the watermark
+				{Namespace: "other", ClientID: "a", LastSeenServerVersion: -1, LastSyncedAt: 400, MaxDotVersion: 9},
+				// Idle clients only hold back their own namespace
+				{Namespace: "idle", ClientID: "c", LastSeenServerVersion: 1, LastSyncedAt: 400, MaxDotVersion: -1},
+			}
+			for _, state := range states {
+				if err := tx.UpsertClientState(ctx, state); err != nil {
+					t.Fatalf("UpsertClientState() error = %v", err)
+				}
+			}
+
+			state, err := tx.GetClientState(ctx, "", "a")
+			if err != nil || state == nil || state.LastSeenServerVersion != 6 || state.MaxDotVersion != 3 {
+				t.Errorf("unexpected client state %+v, %v", state, err)
+			}
+			state, err = tx.GetClientState(ctx, "other", "a")
+			if err != nil || state == nil || state.Namespace != "other" || state.MaxDotVersion != 9 {
+				t.Errorf("unexpected client state in other namespace %+v, %v", state, err)
+			}
+
+			stale, err := tx.GetClientStates(ctx, 300)
+			if err != nil || len(stale) != 1 || stale[0].ClientID != "b" {
+				t.Errorf("expected only b to be stale, got %+v, %v", stale, err)
+			}
+
+			watermarks, err := tx.GetAcknowledgedWatermarks(ctx)
+			if err != nil || !maps.Equal(watermarks, map[string]int64{"": 2, "idle": 1}) {
+				t.Errorf("expected watermarks 2 and 1 for the idle namespace, got %v, %v", watermarks, err)
+			}
+			if deleted, _ := tx.DeleteClientState(ctx, "other", "b"); deleted {
+				t.Errorf("expected b not to be deleted from another namespace")
+			}
+			if deleted, _ := tx.DeleteClientState(ctx, "", "b"); !deleted {
+				t.Errorf("expected b to be deleted")
+			}
+			if deleted, _ := tx.DeleteClientState(ctx, "", "b"); deleted {
+				t.Errorf("expected unknown client not to be deleted")
+			}
+			if watermarks, _ := tx.GetAcknowledgedWatermarks(ctx); watermarks[""] != 6 {
+				t.Errorf("expected watermark 6, got %v", watermarks)
+			}
+			if _, err := tx.DeleteClientState(ctx, "", "a"); err != nil {
+				t.Fatalf("DeleteClientState() error = %v", err)
+			}
+			if watermarks, _ := tx.GetAcknowledgedWatermarks(ctx); len(watermarks) != 1 {
+				t.Errorf("expected no watermark once no client in the namespace has seen anything, got %v", watermarks)
+			}
+		})
+	}
+}
+
+func TestStoreRegisteredClients(t *testing.T) {
+	ctx := context.Background()
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			tx, err := store.Begin(ctx, false)
+			if err != nil {
+				t.Fatalf("Begin() error = %v", err)
+			}
+			defer tx.Rollback()
+
+			client := &DBClient{ClientID: "a", Namespace: "tenant", Secret: []byte("secret"), CreatedAt: 100}
+			if err := tx.InsertClient(ctx, client); err != nil {
+				t.Fatalf("InsertClient() error = %v", err)
+			}
+			if err := tx.InsertClient(ctx, client); !errors.Is(err, ErrClientExists) {
+				t.Errorf("expected ErrClientExists for a taken ID, got %v", err)
+			}
+
+			got, err := tx.GetClient(ctx, "a")
+			if err != nil || got == nil || got.Namespace != "tenant" || string(got.Secret) != "secret" || got.CreatedAt != 100 {
+				t.Errorf("unexpected client %+v, %v", got, err)
+			}
+			if got, err := tx.GetClient(ctx, "b"); err != nil || got != nil {
+				t.Errorf("expected no unregistered client, got %+v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestCheckpointWAL(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "sync.db")+"?_journal_mode=WAL")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := InitSchema(ctx, db); err != nil {
+		t.Fatalf("failed to init schema: %v", err)
+	}
+	if err := CheckpointWAL(ctx, db); err != nil {
+		t.Fatalf("CheckpointWAL() error = %v", err)
+	}
+
+	// TRUNCATE leaves an empty log behind
+	var busy, logPages, checkpointedPages int
+	if err := db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(PASSIVE)`).Scan(&busy, &logPages, &checkpointedPages); err != nil {
+		t.Fatalf("failed to read checkpoint state: %v", err)
+	}
+	if logPages != 0 {
+		t.Errorf("expected an empty WAL after checkpoint, got %d pages", logPages)
+	}
+}
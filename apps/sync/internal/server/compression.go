@@ -0,0 +1,156 @@
+package server
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/internal/sync_engine"
+)
+
+// Content codings the server understands, in order of preference. HTTP's
+// "deflate" is the zlib format (RFC 9110 8.4.1.2), which is also what
+// browsers produce with CompressionStream("deflate").
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+var supportedEncodings = []string{encodingGzip, encodingDeflate}
+
+// acceptedEncodings is sent with ErrUnsupportedEncoding so clients can fall back.
+const acceptedEncodings = "gzip, deflate"
+
+// minCompressBytes is the smallest response worth compressing, below it the
+// compression framing eats most of the savings.
+const minCompressBytes = 1024
+
+// ------------------------------------------------------------------------
+// Requests
+// ------------------------------------------------------------------------
+
+// decodeRequestBody returns the request body with its Content-Encoding removed.
+// Size limits must be applied to the returned reader, a small compressed body
+// can expand to any size.
+func decodeRequestBody(request *http.Request) (io.ReadCloser, error) {
+	encoding := strings.ToLower(strings.TrimSpace(request.Header.Get("Content-Encoding")))
+
+	var decompressor io.ReadCloser
+	var err error
+	switch encoding {
+	case "", "identity":
+		return request.Body, nil
+	case encodingGzip, "x-gzip":
+		decompressor, err = gzip.NewReader(request.Body)
+	case encodingDeflate:
+		decompressor, err = zlib.NewReader(request.Body)
+	default:
+		return nil, sync_engine.NewSyncErrorf(sync_engine.ErrUnsupportedEncoding,
+			"content encoding %q is not supported, use one of: %s", encoding, acceptedEncodings)
+	}
+	if err != nil {
+		return nil, sync_engine.NewSyncErrorf(sync_engine.ErrBadRequest, "request body is not valid %s", encoding)
+	}
+
+	return &decompressedBody{Reader: decompressor, decompressor: decompressor, body: request.Body}, nil
+}
+
+type decompressedBody struct {
+	io.Reader
+	decompressor io.Closer
+	body         io.Closer
+}
+
+func (body *decompressedBody) Close() error {
+	body.decompressor.Close()
+	return body.body.Close()
+}
+
+// ------------------------------------------------------------------------
+// Responses
+// ------------------------------------------------------------------------
+
+// negotiateEncoding picks the best supported encoding from an Accept-Encoding
+// header, or an empty string for no encoding. Higher q-values win, ties go to
+// the server's preference.
+func negotiateEncoding(acceptEncoding string) string {
+	weights := make(map[string]float64)
+	wildcard := -1.0
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		weight := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			weight = parsed
+		}
+
+		if name == "*" {
+			wildcard = weight
+		} else if name != "" {
+			weights[name] = weight
+		}
+	}
+
+	best, bestWeight := "", 0.0
+	for _, encoding := range supportedEncodings {
+		weight, ok := weights[encoding]
+		if !ok {
+			weight = wildcard
+		}
+		if weight > bestWeight {
+			best, bestWeight = encoding, weight
+		}
+	}
+	return best
+}
+
+// compressor is implemented by both gzip.Writer and zlib.Writer.
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+var compressorPools = map[string]*sync.Pool{
+	encodingGzip:    {New: func() any { return gzip.NewWriter(io.Discard) }},
+	encodingDeflate: {New: func() any { return zlib.NewWriter(io.Discard) }},
+}
+
+// writeBody writes a response body, compressed with the encoding the client
+// prefers when it is large enough to benefit.
+func writeBody(writer http.ResponseWriter, request *http.Request, status int, body []byte) {
+	writer.Header().Add("Vary", "Accept-Encoding")
+
+	encoding := ""
+	if len(body) >= minCompressBytes {
+		encoding = negotiateEncoding(request.Header.Get("Accept-Encoding"))
+	}
+	if encoding == "" {
+		writer.WriteHeader(status)
+		writer.Write(body)
+		return
+	}
+
+	writer.Header().Set("Content-Encoding", encoding)
+	writer.Header().Del("Content-Length")
+	writer.WriteHeader(status)
+
+	pool := compressorPools[encoding]
+	compressor := pool.Get().(compressor)
+	defer func() {
+		// Don't keep the response writer alive while pooled
+		compressor.Reset(io.Discard)
+		pool.Put(compressor)
+	}()
+
+	compressor.Reset(writer)
+	compressor.Write(body)
+	compressor.Close()
+}
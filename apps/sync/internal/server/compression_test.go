@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/internal/sync_engine"
+	"testing"
+)
+
+// -------------------- Compression tests --------------------
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		want           string
+	}{
+		{name: "empty", acceptEncoding: "", want: ""},
+		{name: "gzip", acceptEncoding: "gzip", want: encodingGzip},
+		{name: "deflate", acceptEncoding: "deflate", want: encodingDeflate},
+		{name: "server preference on ties", acceptEncoding: "deflate, gzip", want: encodingGzip},
+		{name: "higher q-value wins", acceptEncoding: "gzip;q=0.5, deflate", want: encodingDeflate},
+		{name: "unsupported only", acceptEncoding: "br, zstd", want: ""},
+		{name: "wildcard", acceptEncoding: "br, *", want: encodingGzip},
+		{name: "wildcard with gzip refused", acceptEncoding: "gzip;q=0, *", want: encodingDeflate},
+		{name: "identity only", acceptEncoding: "identity", want: ""},
+		{name: "case insensitive", acceptEncoding: "GZIP", want: encodingGzip},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiateEncoding(tt.acceptEncoding); got != tt.want {
+				t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleSyncCompressed(t *testing.T) {
+	const client = "11111111-1111-1111-1111-111111111111"
+	mux := NewServer(newLegacySyncService(), nil, DefaultConfig())
+
+	// Enough operations that the response is worth compressing
+	operations := []sync_engine.CRDTOperation{}
+	for i := 1; i <= 20; i++ {
+		operations = append(operations, sync_engine.CRDTOperation{
+			Type:    "setRow",
+			Table:   "users",
+			RowKey:  fmt.Sprintf("user-%d", i),
+			Value:   json.RawMessage(`{"name":"someone"}`),
+			Context: map[string]int64{},
+			Dot:     sync_engine.Dot{ClientID: client, Version: int64(i)},
+		})
+	}
+	syncReq := sync_engine.SyncRequest{ClientID: client, Operations: operations, LastSeenServerVersion: -1}
+	hash, err := sync_engine.HashSyncRequest(syncReq)
+	if err != nil {
+		t.Fatalf("failed to hash request: %v", err)
+	}
+	syncReq.RequestHash = hash
+	plain, _ := json.Marshal(syncReq)
+
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	gzipWriter.Write(plain)
+	gzipWriter.Close()
+
+	tests := []struct {
+		name            string
+		body            []byte
+		contentEncoding string
+		acceptEncoding  string
+		wantStatus      int
+		wantEncoding    string
+	}{
+		{name: "plain", body: plain, wantStatus: http.StatusOK},
+		{name: "gzip request", body: compressed.Bytes(), contentEncoding: "gzip", wantStatus: http.StatusOK},
+		{name: "gzip response", body: plain, acceptEncoding: "gzip", wantStatus: http.StatusOK, wantEncoding: encodingGzip},
+		{name: "deflate response", body: compressed.Bytes(), contentEncoding: "gzip", acceptEncoding: "deflate", wantStatus: http.StatusOK, wantEncoding: encodingDeflate},
+		{name: "corrupt gzip", body: plain, contentEncoding: "gzip", wantStatus: http.StatusBadRequest},
+		{name: "unsupported encoding", body: plain, contentEncoding: "br", wantStatus: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader(tt.body))
+			if tt.contentEncoding != "" {
+				request.Header.Set("Content-Encoding", tt.contentEncoding)
+			}
+			if tt.acceptEncoding != "" {
+				request.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, tt.wantStatus, recorder.Body.String())
+			}
+			if tt.wantStatus == http.StatusUnsupportedMediaType && recorder.Header().Get("Accept-Encoding") != acceptedEncodings {
+				t.Errorf("Accept-Encoding = %q, want %q", recorder.Header().Get("Accept-Encoding"), acceptedEncodings)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if encoding := recorder.Header().Get("Content-Encoding"); encoding != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", encoding, tt.wantEncoding)
+			}
+			body, err := decodeRequestBody(&http.Request{
+				Header: http.Header{"Content-Encoding": {tt.wantEncoding}},
+				Body:   io.NopCloser(recorder.Body),
+			})
+			if err != nil {
+				t.Fatalf("failed to decompress response: %v", err)
+			}
+
+			var syncResp sync_engine.SyncResponse
+			if err := json.NewDecoder(body).Decode(&syncResp); err != nil {
+				t.Fatalf("response is not a sync response: %v", err)
+			}
+			if len(syncResp.SyncedOperations) != len(operations) && len(syncResp.Operations) != len(operations) {
+				t.Errorf("response covers %d synced and %d returned operations, want %d",
+					len(syncResp.SyncedOperations), len(syncResp.Operations), len(operations))
+			}
+		})
+	}
+}
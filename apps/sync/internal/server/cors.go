@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CorsPolicy decides which browser origins can call the server.
+// Requests without an Origin header are not affected.
+type CorsPolicy struct {
+	// AllowedOrigins lists origins such as "https://app.example.com".
+	// "*" allows every origin, an empty list allows none.
+	AllowedOrigins []string
+
+	// AllowCredentials lets browsers send cookies and auth headers.
+	// It can't be combined with "*".
+	AllowCredentials bool
+
+	// AllowedHeaders are the request headers browsers may send.
+	AllowedHeaders []string
+
+	// ExposedHeaders are the response headers scripts may read.
+	ExposedHeaders []string
+
+	// MaxAge is how long browsers may cache a preflight response, zero leaves it to the browser.
+	MaxAge time.Duration
+}
+
+// DefaultCorsPolicy allows every origin without credentials.
+func DefaultCorsPolicy() CorsPolicy {
+	return CorsPolicy{
+		AllowedOrigins: []string{"*"},
+		AllowedHeaders: []string{"Content-Type", "Content-Encoding", "Authorization", RequestIDHeader, ClientIDHeader},
+		ExposedHeaders: []string{RequestIDHeader, "Retry-After"},
+		MaxAge:         10 * time.Minute,
+	}
+}
+
+// Validate reports the first setting that can't be used.
+func (policy CorsPolicy) Validate() error {
+	for _, origin := range policy.AllowedOrigins {
+		if origin == "*" {
+			if policy.AllowCredentials {
+				return fmt.Errorf("cors: credentials can't be allowed for every origin")
+			}
+			continue
+		}
+
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+			parsed.Path != "" || parsed.RawQuery != "" || parsed.Fragment != "" || parsed.User != nil {
+			return fmt.Errorf("cors: origin %q must look like https://example.com", origin)
+		}
+	}
+	if policy.MaxAge < 0 {
+		return fmt.Errorf("cors: max age can't be negative, got %s", policy.MaxAge)
+	}
+	return nil
+}
+
+// allowsAnyOrigin reports whether the policy contains "*".
+func (policy CorsPolicy) allowsAnyOrigin() bool {
+	return slices.Contains(policy.AllowedOrigins, "*")
+}
+
+func (policy CorsPolicy) allowsOrigin(origin string) bool {
+	return policy.allowsAnyOrigin() || slices.Contains(policy.AllowedOrigins, origin)
+}
+
+// wrap applies the policy to every route of mux. Preflight requests are
+// answered here, with the methods mux has registered for the path.
+func (policy CorsPolicy) wrap(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get("Origin")
+		if origin == "" {
+			mux.ServeHTTP(writer, request)
+			return
+		}
+
+		// Responses differ by origin unless every origin gets the same "*"
+		if !policy.allowsAnyOrigin() || policy.AllowCredentials {
+			writer.Header().Add("Vary", "Origin")
+		}
+
+		isPreflight := request.Method == http.MethodOptions && request.Header.Get("Access-Control-Request-Method") != ""
+		if !policy.allowsOrigin(origin) {
+			if isPreflight {
+				writer.WriteHeader(http.StatusForbidden)
+				return
+			}
+			// Without CORS headers the browser hides the response from the page
+			mux.ServeHTTP(writer, request)
+			return
+		}
+
+		policy.setOriginHeaders(writer, origin)
+		if !isPreflight {
+			mux.ServeHTTP(writer, request)
+			return
+		}
+
+		methods := routeMethods(mux, request)
+		if len(methods) == 0 {
+			mux.ServeHTTP(writer, request)
+			return
+		}
+
+		writer.Header().Add("Vary", "Access-Control-Request-Method")
+		writer.Header().Add("Vary", "Access-Control-Request-Headers")
+		writer.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		writer.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+		if policy.MaxAge > 0 {
+			writer.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (policy CorsPolicy) setOriginHeaders(writer http.ResponseWriter, origin string) {
+	if policy.allowsAnyOrigin() && !policy.AllowCredentials {
+		writer.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if policy.AllowCredentials {
+		writer.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(policy.ExposedHeaders) > 0 {
+		writer.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+	}
+}
+
+// corsMethods are the methods checked against the routes of a path.
+var corsMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// routeMethods returns the methods mux has a route for at the request's path.
+func routeMethods(mux *http.ServeMux, request *http.Request) []string {
+	var methods []string
+	for _, method := range corsMethods {
+		probe := request.Clone(request.Context())
+		probe.Method = method
+		if _, pattern := mux.Handler(probe); pattern != "" {
+			methods = append(methods, method)
+		}
+	}
+	return methods
+}
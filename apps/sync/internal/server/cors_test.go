@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// -------------------- CORS tests --------------------
+
+func TestCorsPolicy(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /sync", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /snapshot", func(w http.ResponseWriter, r *http.Request) {})
+
+	restricted := CorsPolicy{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+		AllowedHeaders:   []string{"Content-Type"},
+		MaxAge:           time.Minute,
+	}
+
+	tests := []struct {
+		name        string
+		policy      CorsPolicy
+		method      string
+		path        string
+		origin      string
+		preflight   bool
+		wantStatus  int
+		wantOrigin  string
+		wantMethods string
+	}{
+		{name: "no origin", policy: restricted, method: http.MethodPost, path: "/sync", wantStatus: http.StatusOK},
+		{name: "allowed origin", policy: restricted, method: http.MethodPost, path: "/sync", origin: "https://app.example.com", wantStatus: http.StatusOK, wantOrigin: "https://app.example.com"},
+		{name: "other origin", policy: restricted, method: http.MethodPost, path: "/sync", origin: "https://evil.example.com", wantStatus: http.StatusOK},
+		{name: "preflight", policy: restricted, path: "/sync", origin: "https://app.example.com", preflight: true, wantStatus: http.StatusNoContent, wantOrigin: "https://app.example.com", wantMethods: "POST"},
+		{name: "preflight with GET route", policy: DefaultCorsPolicy(), path: "/snapshot", origin: "https://any.example.com", preflight: true, wantStatus: http.StatusNoContent, wantOrigin: "*", wantMethods: "GET, HEAD"},
+		{name: "preflight from other origin", policy: restricted, path: "/sync", origin: "https://evil.example.com", preflight: true, wantStatus: http.StatusForbidden},
+		{name: "preflight for unknown path", policy: restricted, path: "/missing", origin: "https://app.example.com", preflight: true, wantStatus: http.StatusNotFound, wantOrigin: "https://app.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if tt.preflight {
+				method = http.MethodOptions
+			}
+			request := httptest.NewRequest(method, tt.path, nil)
+			if tt.origin != "" {
+				request.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				request.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+
+			recorder := httptest.NewRecorder()
+			tt.policy.wrap(mux).ServeHTTP(recorder, request)
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if got := recorder.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := recorder.Header().Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, tt.wantMethods)
+			}
+		})
+	}
+}
+
+func TestCorsPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  CorsPolicy
+		wantErr bool
+	}{
+		{name: "default", policy: DefaultCorsPolicy()},
+		{name: "no origins", policy: CorsPolicy{}},
+		{name: "origin with port", policy: CorsPolicy{AllowedOrigins: []string{"http://localhost:5173"}}},
+		{name: "credentials with wildcard", policy: CorsPolicy{AllowedOrigins: []string{"*"}, AllowCredentials: true}, wantErr: true},
+		{name: "origin with path", policy: CorsPolicy{AllowedOrigins: []string{"https://example.com/app"}}, wantErr: true},
+		{name: "bare host", policy: CorsPolicy{AllowedOrigins: []string{"example.com"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/internal/sync_engine"
+	"sync/internal/wire"
+)
+
+// isBinaryRequest reports whether the request body uses the binary wire format.
+// Anything else is decoded as JSON, which clients sent before Content-Type mattered.
+func isBinaryRequest(request *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return err == nil && mediaType == wire.ContentType
+}
+
+// decodeSyncRequest reads a sync request from body one operation at a time,
+// so a request with too many operations or an oversized value is rejected as
+// soon as the limit is crossed instead of after the whole body was parsed.
+// body should be an http.MaxBytesReader, its limit is reported as ErrRequestTooLarge.
+func decodeSyncRequest(body io.Reader, config Config) (sync_engine.SyncRequest, error) {
+	var syncReq sync_engine.SyncRequest
+
+	decoder := json.NewDecoder(body)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return syncReq, decodeError(err)
+	}
+
+	// Everything but the operations is small, it's collected and
+	// unmarshalled at the end so the usual struct tags apply
+	fields := make(map[string]json.RawMessage)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return syncReq, decodeError(err)
+		}
+		key, _ := token.(string)
+
+		if !strings.EqualFold(key, "operations") {
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return syncReq, decodeError(err)
+			}
+			fields[key] = value
+			continue
+		}
+
+		syncReq.Operations, err = decodeOperations(decoder, config)
+		if err != nil {
+			return syncReq, err
+		}
+	}
+	if err := expectDelim(decoder, '}'); err != nil {
+		return syncReq, decodeError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return syncReq, decodeError(errors.New("unexpected data after the request"))
+	}
+
+	operations := syncReq.Operations
+	remaining, _ := json.Marshal(fields)
+	if err := json.Unmarshal(remaining, &syncReq); err != nil {
+		return syncReq, decodeError(err)
+	}
+	syncReq.Operations = operations
+
+	return syncReq, nil
+}
+
+// decodeBinarySyncRequest is decodeSyncRequest for the binary wire format.
+func decodeBinarySyncRequest(body io.Reader, config Config) (sync_engine.SyncRequest, error) {
+	syncReq, err := wire.DecodeSyncRequest(body, wire.Limits{MaxOperations: config.MaxOperations, MaxValueBytes: config.MaxValueBytes})
+	if err == nil {
+		return syncReq, nil
+	}
+
+	var syncErr *sync_engine.SyncError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &syncErr):
+		return syncReq, syncErr
+	case errors.As(err, &maxBytesErr):
+		return syncReq, decodeError(err)
+	default:
+		return syncReq, sync_engine.NewSyncError(sync_engine.ErrBadRequest, "invalid binary request format")
+	}
+}
+
+// decodeOperations decodes the operations array. null leaves the operations
+// nil, which the handler rejects as omitted.
+func decodeOperations(decoder *json.Decoder, config Config) ([]sync_engine.CRDTOperation, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	if token == nil {
+		return nil, nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return nil, sync_engine.NewSyncError(sync_engine.ErrBadRequest, "operations must be an array")
+	}
+
+	operations := []sync_engine.CRDTOperation{}
+	for decoder.More() {
+		if len(operations) == config.MaxOperations {
+			return nil, sync_engine.NewSyncErrorf(sync_engine.ErrTooManyOperations,
+				"a sync request can carry at most %d operations, send the rest in another sync", config.MaxOperations)
+		}
+
+		var operation sync_engine.CRDTOperation
+		if err := decoder.Decode(&operation); err != nil {
+			return nil, decodeError(err)
+		}
+		if len(operation.Value) > config.MaxValueBytes {
+			syncErr := sync_engine.NewSyncErrorf(sync_engine.ErrValueTooLarge, "operation values can be at most %d bytes", config.MaxValueBytes)
+			syncErr.Details = []sync_engine.OperationError{{
+				Index:  len(operations),
+				Dot:    operation.Dot,
+				Reason: fmt.Sprintf("value is %d bytes", len(operation.Value)),
+			}}
+			return nil, syncErr
+		}
+		operations = append(operations, operation)
+	}
+	if err := expectDelim(decoder, ']'); err != nil {
+		return nil, decodeError(err)
+	}
+
+	return operations, nil
+}
+
+func expectDelim(decoder *json.Decoder, want json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("expected %q", want)
+	}
+	return nil
+}
+
+// decodeError turns a read or parse failure into a SyncError. Hitting the
+// body limit surfaces as a read error of the http.MaxBytesReader.
+func decodeError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return sync_engine.NewSyncErrorf(sync_engine.ErrRequestTooLarge, "request body can be at most %d bytes", maxBytesErr.Limit)
+	}
+	return sync_engine.NewSyncError(sync_engine.ErrBadRequest, "invalid JSON format")
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/internal/sync_engine"
+	"testing"
+)
+
+// -------------------- Request decoding tests --------------------
+
+func TestDecodeSyncRequest(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxBodyBytes = 400
+	config.MaxOperations = 2
+	config.MaxValueBytes = 10
+
+	operation := func(value string) string {
+		return `{"type":"set","table":"users","rowKey":"1","field":"name","value":` + value + `,"dot":{"clientId":"a","version":1}}`
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode sync_engine.SyncErrorCode
+		check    func(t *testing.T, syncReq sync_engine.SyncRequest)
+	}{
+		{
+			name: "valid",
+			body: `{"clientId":"a","lastSeenServerVersion":3,"pageSize":5,"requestHash":"h","operations":[` + operation(`"Al"`) + `]}`,
+			check: func(t *testing.T, syncReq sync_engine.SyncRequest) {
+				if syncReq.ClientID != "a" || syncReq.LastSeenServerVersion != 3 || syncReq.PageSize != 5 || syncReq.RequestHash != "h" {
+					t.Errorf("fields not decoded: %+v", syncReq)
+				}
+				if len(syncReq.Operations) != 1 || string(syncReq.Operations[0].Value) != `"Al"` {
+					t.Errorf("operations not decoded: %+v", syncReq.Operations)
+				}
+			},
+		},
+		{
+			name: "empty operations stay non-nil",
+			body: `{"clientId":"a","operations":[]}`,
+			check: func(t *testing.T, syncReq sync_engine.SyncRequest) {
+				if syncReq.Operations == nil {
+					t.Errorf("expected empty, non-nil operations")
+				}
+			},
+		},
+		{
+			name: "null operations are omitted",
+			body: `{"clientId":"a","operations":null}`,
+			check: func(t *testing.T, syncReq sync_engine.SyncRequest) {
+				if syncReq.Operations != nil {
+					t.Errorf("expected nil operations, got %+v", syncReq.Operations)
+				}
+			},
+		},
+		{
+			name:     "too many operations",
+			body:     `{"operations":[` + operation("1") + `,` + operation("2") + `,` + operation("3") + `]}`,
+			wantCode: sync_engine.ErrTooManyOperations,
+		},
+		{
+			name:     "value too large",
+			body:     `{"operations":[` + operation(`"far too long"`) + `]}`,
+			wantCode: sync_engine.ErrValueTooLarge,
+		},
+		{
+			name:     "body too large",
+			body:     `{"clientId":"` + strings.Repeat("a", 500) + `"}`,
+			wantCode: sync_engine.ErrRequestTooLarge,
+		},
+		{
+			name:     "operations not an array",
+			body:     `{"operations":{}}`,
+			wantCode: sync_engine.ErrBadRequest,
+		},
+		{
+			name:     "trailing data",
+			body:     `{"operations":[]} {}`,
+			wantCode: sync_engine.ErrBadRequest,
+		},
+		{
+			name:     "truncated",
+			body:     `{"operations":[` + operation("1"),
+			wantCode: sync_engine.ErrBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := http.MaxBytesReader(httptest.NewRecorder(), io.NopCloser(strings.NewReader(tt.body)), config.MaxBodyBytes)
+			syncReq, err := decodeSyncRequest(body, config)
+
+			var syncErr *sync_engine.SyncError
+			if tt.wantCode != "" {
+				if !errors.As(err, &syncErr) || syncErr.Code != tt.wantCode {
+					t.Fatalf("expected %s, got %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeSyncRequest() error = %v", err)
+			}
+			tt.check(t, syncReq)
+		})
+	}
+}
@@ -2,10 +2,17 @@ package server
 
 import (
 	"encoding/json"
-	"io"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"sync/internal/auth"
+	"sync/internal/logging"
+	"sync/internal/metrics"
 	"sync/internal/sync_engine"
+	"sync/internal/wire"
+	"time"
 
 	// TODO: remove dependency
 	"github.com/google/uuid"
@@ -15,26 +22,162 @@ import (
 // Server
 // ------------------------------------------------------------------------
 
+// Config tunes the HTTP layer. Start from DefaultConfig, the zero value is not valid.
+type Config struct {
+	// MaxConcurrentConnections limits the sync and snapshot requests
+	// handled at once. Requests above the limit wait in a queue.
+	MaxConcurrentConnections int
+
+	// MaxQueuedRequests limits the requests waiting for a free slot,
+	// requests beyond it get ErrServerBusy right away.
+	MaxQueuedRequests int
+
+	// QueueTimeout is how long a request waits for a free slot before it
+	// gets ErrServerBusy.
+	QueueTimeout time.Duration
+
+	// ClientRate is the sustained syncs per second allowed per client ID,
+	// ClientBurst how many it can send at once. Zero disables the limit.
+	ClientRate  float64
+	ClientBurst int
+
+	// IPRate and IPBurst limit sync and snapshot requests per remote
+	// address the same way. Zero disables the limit.
+	IPRate  float64
+	IPBurst int
+
+	// TrustForwardedFor takes the remote address from X-Forwarded-For,
+	// only enable it behind a proxy that sets the header.
+	TrustForwardedFor bool
+
+	// Cors decides which browser origins can call the server.
+	Cors CorsPolicy
+
+	// MaxBodyBytes limits the size of a sync request body.
+	MaxBodyBytes int64
+
+	// MaxOperations limits the operations in a single sync request.
+	MaxOperations int
+
+	// MaxValueBytes limits the encoded size of a single operation's value.
+	MaxValueBytes int
+
+	// MaxEventStreams limits the event streams open at once per namespace.
+	// Streams are long lived and skip the concurrency limit, this keeps a
+	// single namespace from holding every connection.
+	MaxEventStreams int
+
+	// ServeMetrics serves GET /metrics to authenticated callers. Turn it
+	// off when the metrics are served on a separate address.
+	ServeMetrics bool
+}
+
+// DefaultConfig returns the settings the server runs with out of the box.
+func DefaultConfig() Config {
+	return Config{
+		MaxConcurrentConnections: 100,
+		MaxQueuedRequests:        100,
+		QueueTimeout:             2 * time.Second,
+		ClientRate:               10,
+		ClientBurst:              20,
+		IPRate:                   50,
+		IPBurst:                  100,
+		MaxBodyBytes:             16 << 20,
+		MaxOperations:            10000,
+		MaxValueBytes:            1 << 20,
+		MaxEventStreams:          100,
+		ServeMetrics:             true,
+		Cors:                     DefaultCorsPolicy(),
+	}
+}
+
+// Validate reports the first setting that can't be used.
+func (config Config) Validate() error {
+	if config.MaxConcurrentConnections <= 0 {
+		return fmt.Errorf("max concurrent connections must be positive, got %d", config.MaxConcurrentConnections)
+	}
+	if config.MaxQueuedRequests < 0 || config.QueueTimeout < 0 {
+		return fmt.Errorf("max queued requests and queue timeout can't be negative")
+	}
+	if config.ClientRate < 0 || (config.ClientRate > 0 && config.ClientBurst < 1) {
+		return fmt.Errorf("client rate can't be negative and needs a burst of at least 1, got %g/%d", config.ClientRate, config.ClientBurst)
+	}
+	if config.IPRate < 0 || (config.IPRate > 0 && config.IPBurst < 1) {
+		return fmt.Errorf("ip rate can't be negative and needs a burst of at least 1, got %g/%d", config.IPRate, config.IPBurst)
+	}
+	if config.MaxBodyBytes <= 0 {
+		return fmt.Errorf("max body bytes must be positive, got %d", config.MaxBodyBytes)
+	}
+	if config.MaxOperations <= 0 {
+		return fmt.Errorf("max operations must be positive, got %d", config.MaxOperations)
+	}
+	if config.MaxValueBytes <= 0 || int64(config.MaxValueBytes) > config.MaxBodyBytes {
+		return fmt.Errorf("max value bytes must be between 1 and max body bytes, got %d", config.MaxValueBytes)
+	}
+	if config.MaxEventStreams <= 0 {
+		return fmt.Errorf("max event streams must be positive, got %d", config.MaxEventStreams)
+	}
+	return config.Cors.Validate()
+}
+
 type Server struct {
 	SyncService sync_engine.SyncServiceInterface
+	Config      Config
+
+	clientLimiter *rateLimiter
+	eventStreams  *streamLimiter
 }
 
-func NewServer(syncService sync_engine.SyncServiceInterface, maxConcurrentConnections int) *http.ServeMux {
+// NewServer registers all routes and applies the CORS policy to them. If
+// authenticator is nil requests are not authenticated and every client shares
+// the default namespace. The config must be valid, see Config.Validate.
+func NewServer(syncService sync_engine.SyncServiceInterface, authenticator auth.Authenticator, config Config) http.Handler {
 	server := Server{
-		SyncService: syncService,
+		SyncService:   syncService,
+		Config:        config,
+		clientLimiter: newRateLimiter(config.ClientRate, config.ClientBurst),
+		eventStreams:  newStreamLimiter(config.MaxEventStreams),
 	}
 
-	mux := http.NewServeMux()
+	// Syncs and snapshots share the limits, the per client limit is
+	// applied in HandleSync once the client ID is known
+	ipLimiter := newRateLimiter(config.IPRate, config.IPBurst)
+	concurrency := newConcurrencyLimiter(config.MaxConcurrentConnections, config.MaxQueuedRequests, config.QueueTimeout)
+	limit := func(next http.HandlerFunc) http.HandlerFunc {
+		return limitRate(concurrency.limit(next), ipLimiter, config.TrustForwardedFor)
+	}
 
-	// Handle OPTIONS for CORS preflight
-	mux.HandleFunc("OPTIONS /sync", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNoContent)
-	})
+	mux := http.NewServeMux()
 
 	// Handle POST for actual sync requests
-	mux.HandleFunc("POST /sync", limitConcurrency(server.HandleSync, maxConcurrentConnections))
+	mux.HandleFunc("POST /sync", limit(requireAuth(server.HandleSync, authenticator)))
+
+	// Handle POST for issuing a client ID and the secret it signs syncs with
+	mux.HandleFunc("POST /clients", limit(requireAuth(server.HandleRegisterClient, authenticator)))
 
-	return mux
+	// Handle GET for bootstrapping new clients from the current state
+	mux.HandleFunc("GET /snapshot", limit(requireAuth(server.HandleSnapshot, authenticator)))
+
+	// Handle GET for streaming notifications about new operations. Streams are
+	// long lived, so they don't count against the concurrency limit but
+	// against a limit per namespace. Browsers can't set headers on
+	// EventSource connections, this is the only route that takes the token
+	// from the query string.
+	mux.HandleFunc("GET /events", allowQueryToken(requireAuth(server.HandleEvents, authenticator)))
+
+	// Handle GET for scraping metrics in the Prometheus text format. The
+	// counters cover every namespace, so scrapers need a token too.
+	if config.ServeMetrics {
+		mux.HandleFunc("GET /metrics", requireAuth(metrics.Handler().ServeHTTP, authenticator))
+	}
+
+	// Handle GET for liveness and readiness probes. Probes must keep
+	// answering under load, so they skip auth and the concurrency limit.
+	mux.HandleFunc("GET /healthz", server.HandleHealth)
+	mux.HandleFunc("GET /readyz", server.HandleReady)
+
+	// CORS preflights are answered by the policy for every route
+	return config.Cors.wrap(mux)
 }
 
 // ------------------------------------------------------------------------
@@ -47,118 +190,532 @@ func (server Server) HandleSync(writer http.ResponseWriter, request *http.Reques
 	// responses get the correct content type.
 	writer.Header().Set("Content-Type", "application/json")
 
-	body, err := io.ReadAll(request.Body)
+	// Clients that name themselves in the header are turned away before the
+	// body is read when they're out of syncs, a throttled client costs no
+	// decoding. The header isn't verified, so it's only checked here, the
+	// syncs are charged once the request is verified.
+	headerClientID := request.Header.Get(ClientIDHeader)
+	if headerClientID != "" {
+		if err := uuid.Validate(headerClientID); err != nil {
+			writeError(writer, sync_engine.NewSyncError(sync_engine.ErrInvalidClientID, ClientIDHeader+" must be a valid uuid"))
+			return
+		}
+		if allowed, wait := server.clientLimiter.check(clientLimitKey(request, headerClientID)); !allowed {
+			rejectClient(writer, wait)
+			return
+		}
+	}
+
+	body, err := decodeRequestBody(request)
 	if err != nil {
-		writer.WriteHeader(http.StatusBadRequest)
-		writer.Write([]byte(`{"error": "Failed to read request body"}`))
+		writer.Header().Set("Accept-Encoding", acceptedEncodings)
+		writeError(writer, err)
 		return
 	}
-	defer request.Body.Close()
+	defer body.Close()
+
+	// The limit applies to the decompressed body
+	limitedBody := http.MaxBytesReader(writer, body, server.Config.MaxBodyBytes)
+	binaryFormat := isBinaryRequest(request)
 
 	var syncReq sync_engine.SyncRequest
-	if err := json.Unmarshal(body, &syncReq); err != nil {
-		writer.WriteHeader(http.StatusBadRequest)
-		writer.Write([]byte(`{"error": "Invalid JSON format"}`))
-		return
+	if binaryFormat {
+		syncReq, err = decodeBinarySyncRequest(limitedBody, server.Config)
+	} else {
+		syncReq, err = decodeSyncRequest(limitedBody, server.Config)
 	}
-	// TODO: maybe this should not be assertions but handled with returned error
-	err = uuid.Validate(syncReq.ClientID)
-
 	if err != nil {
-		writer.WriteHeader(http.StatusBadRequest)
-		writer.Write([]byte(`{"error": "ClientID must be a valid uuid"}`))
+		writeError(writer, err)
+		return
+	}
+	// Checked first, the other fields mean something else in unknown versions
+	if err := sync_engine.CheckProtocolVersion(syncReq.ProtocolVersion); err != nil {
+		writeError(writer, err)
+		return
+	}
+	if err := uuid.Validate(syncReq.ClientID); err != nil {
+		writeError(writer, sync_engine.NewSyncError(sync_engine.ErrInvalidClientID, "clientId must be a valid uuid"))
+		return
+	}
+	if headerClientID != "" && headerClientID != syncReq.ClientID {
+		writeError(writer, sync_engine.NewSyncError(sync_engine.ErrInvalidClientID, "clientId must match the "+ClientIDHeader+" header"))
 		return
 	}
 	if syncReq.LastSeenServerVersion < -1 {
-		writer.WriteHeader(http.StatusBadRequest)
-		writer.Write([]byte(`{"error": "LastSeenServerVersion cannot be less than -1"}`))
+		writeError(writer, sync_engine.NewSyncError(sync_engine.ErrBadRequest, "lastSeenServerVersion cannot be less than -1"))
+		return
+	}
+	if syncReq.PageSize < 0 {
+		writeError(writer, sync_engine.NewSyncError(sync_engine.ErrBadRequest, "pageSize cannot be negative"))
 		return
 	}
 	if syncReq.Operations == nil {
-		writer.WriteHeader(http.StatusBadRequest)
-		writer.Write([]byte(`{"error": "Operations cannot be omitted"}`))
+		writeError(writer, sync_engine.NewSyncError(sync_engine.ErrBadRequest, "operations cannot be omitted"))
 		return
 	}
 
-	// Validate request integrity
-	if err := sync_engine.ValidateSyncRequestIntegrity(syncReq); err != nil {
-		writer.WriteHeader(http.StatusBadRequest)
-		writer.Write([]byte(`{"error": "Request integrity check failed"}`))
+	// Scope the sync to the caller's data
+	syncReq.Namespace = namespaceFromRequest(request)
+
+	// Only requests that prove they come from their client use up its
+	// syncs, otherwise anyone could throttle another client
+	if err := server.SyncService.VerifySyncRequest(request.Context(), syncReq); err != nil {
+		logSyncError(request, syncReq, err)
+		writeError(writer, err)
+		return
+	}
+	if allowed, wait := server.clientLimiter.allow(clientLimitKey(request, syncReq.ClientID)); !allowed {
+		rejectClient(writer, wait)
 		return
 	}
 
 	syncResp, err := server.SyncService.Sync(request.Context(), syncReq)
 	if err != nil {
-		log.Printf("Sync request failed for client %s: %v", syncReq.ClientID, err)
-
-		// Check if this is a SyncError with a code
-		if syncErr, ok := err.(*sync_engine.SyncError); ok {
-			// Return structured error with code
-			errorBody, _ := json.Marshal(syncErr)
-			writer.WriteHeader(http.StatusInternalServerError)
-			writer.Write(errorBody)
-			return
-		}
-
-		// Fallback for non-SyncError errors
-		fallbackErr := sync_engine.NewSyncError(sync_engine.ErrDatabaseError, err.Error())
-		errorBody, _ := json.Marshal(fallbackErr)
-		writer.WriteHeader(http.StatusInternalServerError)
-		writer.Write(errorBody)
+		logSyncError(request, syncReq, err)
+		writeError(writer, err)
 		return
 	}
 	if syncResp == nil {
-		syncErr := sync_engine.NewSyncError(sync_engine.ErrDatabaseError, "sync response is nil")
-		errorBody, _ := json.Marshal(syncErr)
-		writer.WriteHeader(http.StatusInternalServerError)
-		writer.Write(errorBody)
+		writeError(writer, sync_engine.NewSyncError(sync_engine.ErrInternal, "sync response is nil"))
+		return
+	}
+
+	// Responses use the request's format, errors are always JSON
+	if binaryFormat {
+		writer.Header().Set("Content-Type", wire.ContentType)
+		writeBody(writer, request, http.StatusOK, wire.MarshalSyncResponse(*syncResp))
 		return
 	}
 
 	respBody, err := json.Marshal(syncResp)
 	if err != nil {
-		syncErr := sync_engine.NewSyncError(sync_engine.ErrDatabaseError, "failed to encode response")
-		errorBody, _ := json.Marshal(syncErr)
-		writer.WriteHeader(http.StatusInternalServerError)
-		writer.Write(errorBody)
+		writeError(writer, sync_engine.NewSyncError(sync_engine.ErrInternal, "failed to encode response"))
+		return
+	}
+
+	writeBody(writer, request, http.StatusOK, respBody)
+}
+
+// logSyncError logs why a sync failed.
+func logSyncError(request *http.Request, syncReq sync_engine.SyncRequest, err error) {
+	// Failed integrity checks are expected now and then, corruption in transit or a forged signature
+	var syncErr *sync_engine.SyncError
+	if errors.As(err, &syncErr) && syncErr.Code == sync_engine.ErrRequestIntegrity {
+		logging.FromContext(request.Context()).Warn("Rejected sync request", "client_id", syncReq.ClientID, "error", err)
+	} else {
+		logging.FromContext(request.Context()).Error("Sync request failed", "client_id", syncReq.ClientID, "error", err)
+	}
+}
+
+// clientLimitKey is the rate limiter key of a client, IDs are only unique
+// within a namespace.
+func clientLimitKey(request *http.Request, clientID string) string {
+	return namespaceFromRequest(request) + "/" + clientID
+}
+
+// rejectClient answers a sync from a client that is over its rate limit.
+func rejectClient(writer http.ResponseWriter, wait time.Duration) {
+	rejectedRequests.WithLabelValues("client_rate").Inc()
+	setRetryAfter(writer, wait)
+	writeError(writer, sync_engine.NewSyncError(sync_engine.ErrRateLimited, "too many syncs from this client, try again later"))
+}
+
+// HandleRegisterClient issues a new client ID and secret in the caller's
+// namespace. Syncs with that ID must be signed with the secret.
+func (server Server) HandleRegisterClient(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	registration, err := server.SyncService.RegisterClient(request.Context(), namespaceFromRequest(request))
+	if err != nil {
+		logging.FromContext(request.Context()).Error("Client registration failed", "error", err)
+		writeError(writer, err)
+		return
+	}
+
+	respBody, err := json.Marshal(registration)
+	if err != nil {
+		writeError(writer, sync_engine.NewSyncError(sync_engine.ErrInternal, "failed to encode registration"))
+		return
+	}
+
+	// Never cache a response that carries a secret
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusCreated)
+	writer.Write(respBody)
+}
+
+// HandleSnapshot returns the materialized state of all rows, optionally
+// filtered by the "table" query parameter
+func (server Server) HandleSnapshot(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	table := request.URL.Query().Get("table")
+
+	snapshot, err := server.SyncService.Snapshot(request.Context(), namespaceFromRequest(request), table)
+	if err != nil {
+		logging.FromContext(request.Context()).Error("Snapshot request failed", "table", table, "error", err)
+		writeError(writer, err)
+		return
+	}
+
+	respBody, err := json.Marshal(snapshot)
+	if err != nil {
+		writeError(writer, sync_engine.NewSyncError(sync_engine.ErrInternal, "failed to encode snapshot"))
+		return
+	}
+
+	writeBody(writer, request, http.StatusOK, respBody)
+}
+
+// eventsHeartbeatInterval keeps idle event streams from being closed by proxies
+const eventsHeartbeatInterval = 15 * time.Second
+
+// HandleEvents streams a server-sent "sync" event whenever another client
+// commits operations in the caller's namespace. Clients pass their own ID in
+// the "clientId" query parameter to skip notifications about their own writes.
+func (server Server) HandleEvents(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writeError(writer, sync_engine.NewSyncError(sync_engine.ErrInternal, "streaming is not supported"))
+		return
+	}
+
+	namespace := namespaceFromRequest(request)
+	if !server.eventStreams.acquire(namespace) {
+		rejectedRequests.WithLabelValues("event_streams").Inc()
+		setRetryAfter(writer, eventsHeartbeatInterval)
+		writeError(writer, sync_engine.NewSyncError(sync_engine.ErrRateLimited, "too many open event streams, try again later"))
+		return
+	}
+	defer server.eventStreams.release(namespace)
+
+	clientID := request.URL.Query().Get("clientId")
+	notifications, unsubscribe := server.SyncService.Subscribe(namespace)
+	defer unsubscribe()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case notification, ok := <-notifications:
+			if !ok {
+				return
+			}
+			if notification.ClientID == clientID {
+				continue
+			}
+
+			data, err := json.Marshal(notification)
+			if err != nil {
+				logging.FromContext(request.Context()).Error("Failed to encode sync notification", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(writer, "event: sync\nid: %d\ndata: %s\n\n", notification.LatestServerVersion, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// HealthResponse is returned by the health and readiness probes.
+type HealthResponse struct {
+	Status        string `json:"status"`
+	ServerVersion int64  `json:"serverVersion"` // Latest server version, proves the database is readable
+}
+
+// HandleHealth reports whether the server is alive and can read the database.
+func (server Server) HandleHealth(writer http.ResponseWriter, request *http.Request) {
+	server.writeHealth(writer, request)
+}
+
+// HandleReady reports whether the server should receive traffic. It fails as
+// soon as a shutdown starts, so load balancers stop routing new requests to a
+// server that is draining.
+func (server Server) HandleReady(writer http.ResponseWriter, request *http.Request) {
+	if server.SyncService.ShuttingDown() {
+		writeError(writer, sync_engine.NewSyncError(sync_engine.ErrServerBusy, "server is shutting down"))
+		return
+	}
+	server.writeHealth(writer, request)
+}
+
+func (server Server) writeHealth(writer http.ResponseWriter, request *http.Request) {
+	serverVersion, err := server.SyncService.Ping(request.Context())
+	if err != nil {
+		logging.FromContext(request.Context()).Error("Health check failed", "error", err)
+		writeError(writer, err)
 		return
 	}
 
+	respBody, _ := json.Marshal(HealthResponse{Status: "ok", ServerVersion: serverVersion})
+	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(http.StatusOK)
 	writer.Write(respBody)
 }
 
+// ------------------------------------------------------------------------
+// Errors
+// ------------------------------------------------------------------------
+
+// statusForCode maps a sync error code to the HTTP status it is sent with.
+//   - 400/401/403/413/415/422: the server can't accept the request as sent
+//   - 409: the client's state conflicts with the server, the client must reset
+//   - 429/503: a transient failure, the same request can be retried
+//
+// Clients should decide whether to retry from SyncError.Retryable, a
+// corrupted request is a 400 but sending it again usually succeeds.
+func statusForCode(code sync_engine.SyncErrorCode) int {
+	switch code {
+	case sync_engine.ErrBadRequest, sync_engine.ErrInvalidClientID, sync_engine.ErrRequestIntegrity, sync_engine.ErrUnsupportedProtocol:
+		return http.StatusBadRequest
+	case sync_engine.ErrUnauthorized:
+		return http.StatusUnauthorized
+	case sync_engine.ErrUnknownClient:
+		return http.StatusForbidden
+	case sync_engine.ErrClientStateOutOfSync:
+		return http.StatusConflict
+	case sync_engine.ErrInvalidOperation, sync_engine.ErrSchemaViolation:
+		return http.StatusUnprocessableEntity
+	case sync_engine.ErrRequestTooLarge, sync_engine.ErrTooManyOperations, sync_engine.ErrValueTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case sync_engine.ErrRateLimited:
+		return http.StatusTooManyRequests
+	case sync_engine.ErrUnsupportedEncoding:
+		return http.StatusUnsupportedMediaType
+	case sync_engine.ErrDatabaseError, sync_engine.ErrServerBusy:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError sends err as a SyncError envelope with the matching status.
+// Errors that aren't SyncErrors are reported as ErrInternal.
+func writeError(writer http.ResponseWriter, err error) {
+	var syncErr *sync_engine.SyncError
+	if !errors.As(err, &syncErr) {
+		syncErr = sync_engine.NewSyncError(sync_engine.ErrInternal, err.Error())
+	}
+
+	errorBody, _ := json.Marshal(syncErr)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusForCode(syncErr.Code))
+	writer.Write(errorBody)
+}
+
 // ------------------------------------------------------------------------
 // Middleware
 // ------------------------------------------------------------------------
 
-func Cors(next http.Handler) http.Handler {
+// RequestIDHeader carries the ID of a request in both directions. Clients and
+// proxies can pass their own ID to correlate their logs with the server's.
+const RequestIDHeader = "X-Request-ID"
+
+// ClientIDHeader optionally carries the client ID of a sync, so the client's
+// rate limit is checked before the body is decoded. It must match the
+// clientId in the body.
+const ClientIDHeader = "X-Client-ID"
+
+// RequestID assigns every request an ID, echoes it in the response and adds
+// it to the logger in the request context. Incoming IDs are reused unless
+// they are too long or contain anything but letters, digits, '-', '_' and '.'.
+func RequestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		writer.Header().Set("Access-Control-Allow-Origin", "*")
-		writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		requestID := request.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.NewString()
+		}
+		writer.Header().Set(RequestIDHeader, requestID)
+
+		ctx := logging.WithRequestID(request.Context(), requestID)
+		ctx = logging.With(ctx, "method", request.Method, "path", request.URL.Path)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > 128 {
+		return false
+	}
+	for _, char := range requestID {
+		isAlphanumeric := (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9')
+		if !isAlphanumeric && char != '-' && char != '_' && char != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// requireAuth rejects requests the authenticator can't verify and stores the
+// caller's identity in the request context. A nil authenticator lets every
+// request through unauthenticated.
+func requireAuth(next http.HandlerFunc, authenticator auth.Authenticator) http.HandlerFunc {
+	if authenticator == nil {
+		return next
+	}
 
-		if request.Method == http.MethodOptions {
-			writer.WriteHeader(http.StatusNoContent)
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, err := authenticator.Authenticate(r)
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("Authentication failed", "error", err)
+
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, sync_engine.NewSyncError(sync_engine.ErrUnauthorized, "missing or invalid credentials"))
 			return
 		}
 
-		next.ServeHTTP(writer, request)
-	})
+		next(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+	}
+}
 
+// allowQueryToken lets the authenticator take the bearer token from the
+// "access_token" query parameter, see auth.AllowQueryToken.
+func allowQueryToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r.WithContext(auth.AllowQueryToken(r.Context())))
+	}
 }
 
-// limitConcurrency limits all requests across all routes
-func limitConcurrency(next http.HandlerFunc, maxConcurrentConnections int) http.HandlerFunc {
-	semaphore := make(chan struct{}, maxConcurrentConnections)
+// namespaceFromRequest returns the namespace of the authenticated caller,
+// or the default namespace when authentication is disabled.
+func namespaceFromRequest(request *http.Request) string {
+	identity, ok := auth.IdentityFromContext(request.Context())
+	if !ok {
+		return ""
+	}
+	return identity.Namespace
+}
 
+var rejectedRequests = metrics.NewCounterVec(
+	"sync_http_rejected_total",
+	"Requests rejected by a rate or concurrency limit, by the limit that was hit.",
+	"limit",
+)
+
+// concurrencyLimiter bounds the requests handled at once across every route
+// it wraps. Requests over the limit wait in a bounded queue, waiting senders
+// on a channel are served in order so the queue is first come, first served.
+type concurrencyLimiter struct {
+	semaphore    chan struct{}
+	queued       atomic.Int64
+	maxQueued    int64
+	queueTimeout time.Duration
+}
+
+func newConcurrencyLimiter(maxConcurrent int, maxQueued int, queueTimeout time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		semaphore:    make(chan struct{}, maxConcurrent),
+		maxQueued:    int64(maxQueued),
+		queueTimeout: queueTimeout,
+	}
+}
+
+func (limiter *concurrencyLimiter) limit(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		select {
-		case semaphore <- struct{}{}:
-			defer func() { <-semaphore }()
-			next(w, r)
-		default:
-			http.Error(w, "Server too busy, try again later", http.StatusServiceUnavailable)
+		if !limiter.acquire(r) {
+			if r.Context().Err() != nil {
+				// The client is gone, nobody reads the response
+				return
+			}
+			rejectedRequests.WithLabelValues("concurrency").Inc()
+			setRetryAfter(w, limiter.queueTimeout)
+			writeError(w, sync_engine.NewSyncError(sync_engine.ErrServerBusy, "server too busy, try again later"))
+			return
+		}
+		defer func() { <-limiter.semaphore }()
+		next(w, r)
+	}
+}
+
+// acquire takes a slot, waiting in the queue if there is room in it.
+func (limiter *concurrencyLimiter) acquire(r *http.Request) bool {
+	select {
+	case limiter.semaphore <- struct{}{}:
+		return true
+	default:
+	}
+
+	if limiter.queued.Add(1) > limiter.maxQueued {
+		limiter.queued.Add(-1)
+		return false
+	}
+	defer limiter.queued.Add(-1)
+
+	timer := time.NewTimer(limiter.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case limiter.semaphore <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// streamLimiter counts the open event streams per namespace.
+type streamLimiter struct {
+	max int
+
+	mu   sync.Mutex
+	open map[string]int
+}
+
+func newStreamLimiter(max int) *streamLimiter {
+	return &streamLimiter{max: max, open: make(map[string]int)}
+}
+
+// acquire reserves a stream in the namespace, false if it has the maximum
+// open already. Every successful acquire must be released.
+func (limiter *streamLimiter) acquire(namespace string) bool {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if limiter.open[namespace] >= limiter.max {
+		return false
+	}
+	limiter.open[namespace]++
+	return true
+}
+
+func (limiter *streamLimiter) release(namespace string) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if limiter.open[namespace]--; limiter.open[namespace] <= 0 {
+		delete(limiter.open, namespace)
+	}
+}
+
+// limitRate rejects requests from addresses that ran out of tokens.
+func limitRate(next http.HandlerFunc, limiter *rateLimiter, trustForwardedFor bool) http.HandlerFunc {
+	if limiter == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if allowed, wait := limiter.allow(clientIP(r, trustForwardedFor)); !allowed {
+			rejectedRequests.WithLabelValues("ip_rate").Inc()
+			setRetryAfter(w, wait)
+			writeError(w, sync_engine.NewSyncError(sync_engine.ErrRateLimited, "too many requests from this address, try again later"))
+			return
 		}
+		next(w, r)
 	}
 }
@@ -0,0 +1,476 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/internal/auth"
+	"sync/internal/logging"
+	"sync/internal/repository"
+	"sync/internal/sync_engine"
+	"sync/internal/wire"
+	"testing"
+	"time"
+)
+
+// newLegacySyncService returns a sync service accepting unregistered
+// clients, most tests sync with made up client IDs.
+func newLegacySyncService() *sync_engine.SyncService {
+	config := sync_engine.DefaultConfig()
+	config.AllowUnregisteredClients = true
+	return sync_engine.NewSyncService(repository.NewMemoryStore(), config)
+}
+
+// -------------------- Error envelope tests --------------------
+
+func TestHandleSyncErrors(t *testing.T) {
+	const client = "11111111-1111-1111-1111-111111111111"
+	mux := NewServer(newLegacySyncService(), nil, DefaultConfig())
+
+	signed := func(req sync_engine.SyncRequest) string {
+		hash, err := sync_engine.HashSyncRequest(req)
+		if err != nil {
+			t.Fatalf("failed to hash request: %v", err)
+		}
+		req.RequestHash = hash
+		body, _ := json.Marshal(req)
+		return string(body)
+	}
+
+	tests := []struct {
+		name          string
+		body          string
+		wantStatus    int
+		wantCode      sync_engine.SyncErrorCode
+		wantRetryable bool
+	}{
+		{
+			name:       "malformed JSON",
+			body:       `{"clientId":`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   sync_engine.ErrBadRequest,
+		},
+		{
+			name:       "unsupported protocol",
+			body:       `{"protocolVersion":99,"clientId":"` + client + `","operations":[],"lastSeenServerVersion":-1}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   sync_engine.ErrUnsupportedProtocol,
+		},
+		{
+			name:       "invalid client ID",
+			body:       `{"clientId":"nope","operations":[],"lastSeenServerVersion":-1}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   sync_engine.ErrInvalidClientID,
+		},
+		{
+			name:          "integrity failure",
+			body:          `{"clientId":"` + client + `","operations":[],"lastSeenServerVersion":-1,"requestHash":"bad"}`,
+			wantStatus:    http.StatusBadRequest,
+			wantCode:      sync_engine.ErrRequestIntegrity,
+			wantRetryable: true,
+		},
+		{
+			name:       "client ahead of server",
+			body:       signed(sync_engine.SyncRequest{ClientID: client, Operations: []sync_engine.CRDTOperation{}, LastSeenServerVersion: 10}),
+			wantStatus: http.StatusConflict,
+			wantCode:   sync_engine.ErrClientStateOutOfSync,
+		},
+		{
+			name: "invalid operation",
+			body: signed(sync_engine.SyncRequest{ClientID: client, Operations: []sync_engine.CRDTOperation{
+				{Type: "unknown", Table: "users", RowKey: "1", Context: map[string]int64{}, Dot: sync_engine.Dot{ClientID: client, Version: 1}},
+			}, LastSeenServerVersion: -1}),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantCode:   sync_engine.ErrInvalidOperation,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/sync", bytes.NewBufferString(tt.body)))
+
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", contentType)
+			}
+
+			var syncErr sync_engine.SyncError
+			if err := json.Unmarshal(recorder.Body.Bytes(), &syncErr); err != nil {
+				t.Fatalf("body is not an error envelope: %s", recorder.Body.String())
+			}
+			if syncErr.Code != tt.wantCode || syncErr.Retryable != tt.wantRetryable || syncErr.Message == "" {
+				t.Errorf("got %+v, want code %s retryable %v", syncErr, tt.wantCode, tt.wantRetryable)
+			}
+		})
+	}
+}
+
+// -------------------- Request ID tests --------------------
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		wantSame bool
+	}{
+		{name: "generated", incoming: "", wantSame: false},
+		{name: "reused", incoming: "abc-123_x.y", wantSame: true},
+		{name: "invalid characters", incoming: "abc\n123", wantSame: false},
+		{name: "too long", incoming: strings.Repeat("a", 129), wantSame: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fromContext string
+			handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fromContext = logging.RequestIDFromContext(r.Context())
+			}))
+
+			request := httptest.NewRequest(http.MethodGet, "/snapshot", nil)
+			request.Header.Set(RequestIDHeader, tt.incoming)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			header := recorder.Header().Get(RequestIDHeader)
+			if header == "" || header != fromContext {
+				t.Fatalf("expected matching request IDs, header %q, context %q", header, fromContext)
+			}
+			if (header == tt.incoming) != tt.wantSame {
+				t.Errorf("request ID = %q, incoming %q, wantSame %v", header, tt.incoming, tt.wantSame)
+			}
+		})
+	}
+}
+
+// -------------------- Probe tests --------------------
+
+func TestHealthProbes(t *testing.T) {
+	syncService := newLegacySyncService()
+	mux := NewServer(syncService, nil, DefaultConfig())
+
+	probe := func(path string) int {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code
+	}
+
+	if status := probe("/healthz"); status != http.StatusOK {
+		t.Errorf("GET /healthz = %d, want 200", status)
+	}
+	if status := probe("/readyz"); status != http.StatusOK {
+		t.Errorf("GET /readyz = %d, want 200", status)
+	}
+
+	// A draining server is still alive but no longer ready
+	syncService.Shutdown()
+	if status := probe("/healthz"); status != http.StatusOK {
+		t.Errorf("GET /healthz while shutting down = %d, want 200", status)
+	}
+	if status := probe("/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("GET /readyz while shutting down = %d, want 503", status)
+	}
+}
+
+func TestMetricsRequireAuth(t *testing.T) {
+	authenticator, _ := auth.NewHMACAuthenticator([]byte("0123456789abcdef0123456789abcdef"))
+	token, _ := authenticator.IssueToken("scraper", "", time.Hour)
+	syncService := newLegacySyncService()
+
+	scrape := func(config Config, token string) int {
+		request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		NewServer(syncService, authenticator, config).ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	if status := scrape(DefaultConfig(), ""); status != http.StatusUnauthorized {
+		t.Errorf("GET /metrics without a token = %d, want 401", status)
+	}
+	if status := scrape(DefaultConfig(), token); status != http.StatusOK {
+		t.Errorf("GET /metrics with a token = %d, want 200", status)
+	}
+
+	// Served on a separate address instead
+	config := DefaultConfig()
+	config.ServeMetrics = false
+	if status := scrape(config, token); status != http.StatusNotFound {
+		t.Errorf("GET /metrics with ServeMetrics off = %d, want 404", status)
+	}
+}
+
+func TestHandleEventsLimitsStreams(t *testing.T) {
+	authenticator, _ := auth.NewHMACAuthenticator([]byte("0123456789abcdef0123456789abcdef"))
+	tokenA, _ := authenticator.IssueToken("user-a", "", time.Hour)
+	tokenB, _ := authenticator.IssueToken("user-b", "", time.Hour)
+
+	config := DefaultConfig()
+	config.MaxEventStreams = 1
+	syncService := newLegacySyncService()
+	mux := NewServer(syncService, authenticator, config)
+
+	// The query token only works for event streams
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/snapshot?access_token="+tokenA, nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("snapshot with a query token = %d, want 401", recorder.Code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opened := make(chan struct{})
+	go func() {
+		request := httptest.NewRequest(http.MethodGet, "/events?access_token="+tokenA, nil).WithContext(ctx)
+		mux.ServeHTTP(&flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushed: opened}, request)
+	}()
+	<-opened
+
+	stream := func(token string) int {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/events?access_token="+token, nil).WithContext(canceledContext()))
+		return recorder.Code
+	}
+	if status := stream(tokenA); status != http.StatusTooManyRequests {
+		t.Errorf("second stream in the namespace = %d, want 429", status)
+	}
+	// Other namespaces have their own limit, the stream ends with the
+	// cancelled request
+	if status := stream(tokenB); status != http.StatusOK {
+		t.Errorf("stream in another namespace = %d, want 200", status)
+	}
+}
+
+// flushRecorder signals the first flush, when an event stream is open.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed chan struct{}
+	once    sync.Once
+}
+
+func (recorder *flushRecorder) Flush() {
+	recorder.once.Do(func() { close(recorder.flushed) })
+}
+
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func TestHandleSyncRateLimited(t *testing.T) {
+	config := DefaultConfig()
+	config.ClientRate = 1
+	config.ClientBurst = 1
+	mux := NewServer(newLegacySyncService(), nil, config)
+
+	sync := func(clientID string) *httptest.ResponseRecorder {
+		req := sync_engine.SyncRequest{ClientID: clientID, LastSeenServerVersion: -1, Operations: []sync_engine.CRDTOperation{}}
+		req.RequestHash, _ = sync_engine.HashSyncRequest(req)
+		body, _ := json.Marshal(req)
+
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader(body)))
+		return recorder
+	}
+
+	const client = "11111111-1111-1111-1111-111111111111"
+	if recorder := sync(client); recorder.Code != http.StatusOK {
+		t.Fatalf("first sync = %d, want 200: %s", recorder.Code, recorder.Body)
+	}
+	recorder := sync(client)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("second sync = %d with Retry-After %q, want 429", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	var syncErr sync_engine.SyncError
+	if err := json.Unmarshal(recorder.Body.Bytes(), &syncErr); err != nil || syncErr.Code != sync_engine.ErrRateLimited || !syncErr.Retryable {
+		t.Errorf("unexpected error envelope %s", recorder.Body)
+	}
+
+	// Other clients have their own budget
+	if recorder := sync("22222222-2222-2222-2222-222222222222"); recorder.Code != http.StatusOK {
+		t.Errorf("other client sync = %d, want 200", recorder.Code)
+	}
+
+	// With the client ID in the header the limit is checked before the
+	// body is decoded, a malformed body still gets 429
+	request := httptest.NewRequest(http.MethodPost, "/sync", strings.NewReader(`{"clientId":`))
+	request.Header.Set(ClientIDHeader, client)
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Errorf("throttled sync with header = %d, want 429", recorder.Code)
+	}
+
+	// The header has to name the client in the body
+	req := sync_engine.SyncRequest{ClientID: client, LastSeenServerVersion: -1, Operations: []sync_engine.CRDTOperation{}}
+	req.RequestHash, _ = sync_engine.HashSyncRequest(req)
+	body, _ := json.Marshal(req)
+	request = httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader(body))
+	request.Header.Set(ClientIDHeader, "33333333-3333-3333-3333-333333333333")
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("sync with mismatched header = %d, want 400", recorder.Code)
+	}
+}
+
+func TestHandleSyncRateLimitNeedsVerifiedRequests(t *testing.T) {
+	config := DefaultConfig()
+	config.ClientRate = 1
+	config.ClientBurst = 1
+	mux := NewServer(newLegacySyncService(), nil, config)
+
+	const victim = "11111111-1111-1111-1111-111111111111"
+	send := func(header string, req sync_engine.SyncRequest) int {
+		body, _ := json.Marshal(req)
+		request := httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader(body))
+		request.Header.Set(ClientIDHeader, header)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// Naming the victim in the header with another client's body, or with
+	// an unsigned body, must not use up the victim's syncs
+	other := sync_engine.SyncRequest{ClientID: "22222222-2222-2222-2222-222222222222", LastSeenServerVersion: -1, Operations: []sync_engine.CRDTOperation{}}
+	other.RequestHash, _ = sync_engine.HashSyncRequest(other)
+	unsigned := sync_engine.SyncRequest{ClientID: victim, LastSeenServerVersion: -1, Operations: []sync_engine.CRDTOperation{}, RequestHash: "forged"}
+	for range 3 {
+		if status := send(victim, other); status != http.StatusBadRequest {
+			t.Errorf("mismatched sync = %d, want 400", status)
+		}
+		if status := send(victim, unsigned); status != http.StatusBadRequest {
+			t.Errorf("unsigned sync = %d, want 400", status)
+		}
+	}
+
+	req := sync_engine.SyncRequest{ClientID: victim, LastSeenServerVersion: -1, Operations: []sync_engine.CRDTOperation{}}
+	req.RequestHash, _ = sync_engine.HashSyncRequest(req)
+	if status := send(victim, req); status != http.StatusOK {
+		t.Errorf("victim sync = %d, want 200", status)
+	}
+}
+
+func TestHandleRegisterClient(t *testing.T) {
+	mux := NewServer(newLegacySyncService(), nil, DefaultConfig())
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/clients", nil))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", recorder.Code, http.StatusCreated, recorder.Body)
+	}
+	if cacheControl := recorder.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", cacheControl)
+	}
+
+	var registration sync_engine.ClientRegistration
+	if err := json.Unmarshal(recorder.Body.Bytes(), &registration); err != nil || registration.ClientID == "" || len(registration.Secret) == 0 {
+		t.Fatalf("unexpected registration %s", recorder.Body)
+	}
+
+	// Syncs with the issued ID must be signed with the issued secret
+	req := sync_engine.SyncRequest{ProtocolVersion: sync_engine.ProtocolV4, ClientID: registration.ClientID, LastSeenServerVersion: -1, Operations: []sync_engine.CRDTOperation{}}
+	req.RequestHash, _ = sync_engine.SignSyncRequest(req, registration.Secret)
+	body, _ := json.Marshal(req)
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("signed sync = %d, want 200: %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestHandleSyncClientKeys(t *testing.T) {
+	const client = "11111111-1111-1111-1111-111111111111"
+	key := []byte("0123456789abcdef0123456789abcdef")
+	keys, err := sync_engine.ParseClientKeys([]byte(`{"clients": [{"clientId": "` + client + `", "key": "` + base64.StdEncoding.EncodeToString(key) + `"}]}`))
+	if err != nil {
+		t.Fatalf("ParseClientKeys() error = %v", err)
+	}
+	syncService := newLegacySyncService()
+	syncService.SetClientKeys(keys)
+	mux := NewServer(syncService, nil, DefaultConfig())
+
+	sync := func(key []byte) *httptest.ResponseRecorder {
+		req := sync_engine.SyncRequest{ProtocolVersion: sync_engine.ProtocolV4, ClientID: client, LastSeenServerVersion: -1, Operations: []sync_engine.CRDTOperation{}}
+		req.RequestHash, _ = sync_engine.SignSyncRequest(req, key)
+		body, _ := json.Marshal(req)
+
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader(body)))
+		return recorder
+	}
+
+	if recorder := sync(nil); recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), string(sync_engine.ErrRequestIntegrity)) {
+		t.Errorf("unsigned sync = %d: %s, want %s", recorder.Code, recorder.Body, sync_engine.ErrRequestIntegrity)
+	}
+
+	recorder := sync(key)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("signed sync = %d, want 200: %s", recorder.Code, recorder.Body)
+	}
+	var syncResp sync_engine.SyncResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &syncResp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if hash, _ := sync_engine.SignSyncResponse(syncResp, key); hash != syncResp.ResponseHash {
+		t.Errorf("response isn't signed with the client's key")
+	}
+}
+
+// -------------------- Wire format tests --------------------
+
+func TestHandleSyncBinary(t *testing.T) {
+	const client = "11111111-1111-1111-1111-111111111111"
+	mux := NewServer(newLegacySyncService(), nil, DefaultConfig())
+
+	syncReq := sync_engine.SyncRequest{ClientID: client, LastSeenServerVersion: -1, Operations: []sync_engine.CRDTOperation{
+		{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`{"name":"Ada"}`), Context: map[string]int64{}, Dot: sync_engine.Dot{ClientID: client, Version: 1}},
+	}}
+	hash, err := sync_engine.HashSyncRequest(syncReq)
+	if err != nil {
+		t.Fatalf("failed to hash request: %v", err)
+	}
+	syncReq.RequestHash = hash
+
+	request := httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader(wire.MarshalSyncRequest(syncReq)))
+	request.Header.Set("Content-Type", wire.ContentType)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != wire.ContentType {
+		t.Errorf("Content-Type = %q, want %q", contentType, wire.ContentType)
+	}
+
+	syncResp, err := wire.DecodeSyncResponse(recorder.Body)
+	if err != nil {
+		t.Fatalf("response is not a binary sync response: %v", err)
+	}
+	if len(syncResp.SyncedOperations) != 1 {
+		t.Errorf("synced %d operations, want 1", len(syncResp.SyncedOperations))
+	}
+	if hash, _ := sync_engine.HashSyncResponse(syncResp); hash != syncResp.ResponseHash {
+		t.Errorf("response hash %q doesn't match the decoded response %q", syncResp.ResponseHash, hash)
+	}
+
+	// Malformed binary bodies get the usual JSON error envelope
+	request = httptest.NewRequest(http.MethodPost, "/sync", bytes.NewReader([]byte{1, 9}))
+	request.Header.Set("Content-Type", wire.ContentType)
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("malformed body: status = %d, Content-Type = %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------------------------------------------------------------
+// Token bucket
+// ------------------------------------------------------------------------
+
+// rateLimiter keeps a token bucket per key. Each request takes a token,
+// buckets refill at rate tokens per second up to burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// sweepInterval is how often buckets that refilled completely are dropped,
+// a full bucket behaves the same as a missing one.
+const sweepInterval = time.Minute
+
+// newRateLimiter returns nil when rate is zero, a nil limiter allows everything.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the key's bucket. When the bucket is empty it
+// returns false and how long until the next token is available.
+func (limiter *rateLimiter) allow(key string) (bool, time.Duration) {
+	if limiter == nil {
+		return true, 0
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.now()
+	limiter.sweep(now)
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.tokens = min(limiter.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*limiter.rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / limiter.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// check is allow without taking the token.
+func (limiter *rateLimiter) check(key string) (bool, time.Duration) {
+	if limiter == nil {
+		return true, 0
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		return true, 0
+	}
+	tokens := min(limiter.burst, bucket.tokens+limiter.now().Sub(bucket.updated).Seconds()*limiter.rate)
+	if tokens < 1 {
+		return false, time.Duration((1 - tokens) / limiter.rate * float64(time.Second))
+	}
+	return true, 0
+}
+
+func (limiter *rateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < sweepInterval {
+		return
+	}
+	limiter.lastSweep = now
+
+	refill := time.Duration(limiter.burst / limiter.rate * float64(time.Second))
+	for key, bucket := range limiter.buckets {
+		if now.Sub(bucket.updated) >= refill {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// ------------------------------------------------------------------------
+// Helpers
+// ------------------------------------------------------------------------
+
+// clientIP returns the address the request came from. With trustForwardedFor
+// the last X-Forwarded-For entry is used, the one added by the proxy in front
+// of the server. Only enable it behind a proxy, clients can set the header.
+func clientIP(request *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		if forwardedFor := request.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+			entries := strings.Split(forwardedFor, ",")
+			return strings.TrimSpace(entries[len(entries)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// setRetryAfter tells the client how many whole seconds to wait, at least one.
+func setRetryAfter(writer http.ResponseWriter, wait time.Duration) {
+	seconds := max(1, int(math.Ceil(wait.Seconds())))
+	writer.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// -------------------- Rate limit tests --------------------
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := newRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.allow("a"); !allowed {
+			t.Fatalf("request %d within the burst was rejected", i)
+		}
+	}
+	allowed, wait := limiter.allow("a")
+	if allowed || wait != 500*time.Millisecond {
+		t.Errorf("expected rejection with 500ms wait, got %v, %v", allowed, wait)
+	}
+	if allowed, _ := limiter.allow("b"); !allowed {
+		t.Errorf("expected other keys to have their own bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if allowed, _ := limiter.allow("a"); !allowed {
+		t.Errorf("expected a token after refilling")
+	}
+
+	// Idle buckets are refilled completely and dropped
+	now = now.Add(sweepInterval)
+	limiter.allow("c")
+	if _, ok := limiter.buckets["a"]; ok {
+		t.Errorf("expected full bucket to be swept")
+	}
+
+	var disabled *rateLimiter = newRateLimiter(0, 0)
+	if allowed, _ := disabled.allow("a"); !allowed {
+		t.Errorf("expected a disabled limiter to allow everything")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/sync", nil)
+	request.RemoteAddr = "10.0.0.1:5000"
+	request.Header.Set("X-Forwarded-For", "1.1.1.1, 203.0.113.7")
+
+	if ip := clientIP(request, false); ip != "10.0.0.1" {
+		t.Errorf("clientIP() = %s, want the remote address", ip)
+	}
+	if ip := clientIP(request, true); ip != "203.0.113.7" {
+		t.Errorf("clientIP() = %s, want the last forwarded entry", ip)
+	}
+}
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	limiter := newConcurrencyLimiter(1, 1, time.Second)
+	release := make(chan struct{})
+	handler := limiter.limit(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+
+	// Occupy the only slot
+	done := make(chan struct{})
+	go func() {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/sync", nil))
+		close(done)
+	}()
+	for len(limiter.semaphore) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queued request waits for the slot
+	queued := make(chan int)
+	go func() {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(http.MethodGet, "/sync", nil))
+		queued <- recorder.Code
+	}()
+	for limiter.queued.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, the next request is rejected right away
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodGet, "/sync", nil))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected 503 with Retry-After, got %d %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	<-done
+	if code := <-queued; code != http.StatusOK {
+		t.Errorf("expected queued request to succeed, got %d", code)
+	}
+
+	// A cancelled request leaves the queue without a response
+	limiter = newConcurrencyLimiter(1, 1, time.Second)
+	limiter.semaphore <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if limiter.acquire(httptest.NewRequest(http.MethodGet, "/sync", nil).WithContext(ctx)) {
+		t.Errorf("expected a cancelled request not to get a slot")
+	}
+}
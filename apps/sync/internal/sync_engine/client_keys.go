@@ -0,0 +1,102 @@
+package sync_engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// ClientKeys looks up the HMAC key a client signs its requests with. Clients
+// with a key must speak ProtocolV3 or later, their request hashes are then
+// checked with the key and their responses signed with it. Clients issued
+// their ID by RegisterClient always use the secret they were issued.
+type ClientKeys interface {
+	// ClientKey returns the client's key, or nil if the client has none.
+	ClientKey(ctx context.Context, namespace string, clientID string) ([]byte, error)
+}
+
+// ClientKeysFunc adapts a function to ClientKeys.
+type ClientKeysFunc func(ctx context.Context, namespace string, clientID string) ([]byte, error)
+
+// ClientKey implements ClientKeys.
+func (fn ClientKeysFunc) ClientKey(ctx context.Context, namespace string, clientID string) ([]byte, error) {
+	return fn(ctx, namespace, clientID)
+}
+
+// StaticClientKeys is a fixed set of client keys by namespace and client ID,
+// the server loads it from the file passed with -client-keys.
+type StaticClientKeys map[string]map[string][]byte
+
+// ParseClientKeys reads client keys from JSON of the form
+//
+//	{"clients": [{"namespace": "team-1", "clientId": "...", "key": "<base64>"}]}
+//
+// Keys must be at least clientSecretBytes long, the length RegisterClient issues.
+func ParseClientKeys(data []byte) (StaticClientKeys, error) {
+	var document struct {
+		Clients []struct {
+			Namespace string `json:"namespace"`
+			ClientID  string `json:"clientId"`
+			Key       []byte `json:"key"`
+		} `json:"clients"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("failed to parse client keys: %w", err)
+	}
+
+	keys := StaticClientKeys{}
+	for _, client := range document.Clients {
+		if client.ClientID == "" {
+			return nil, fmt.Errorf("client key needs a client ID")
+		}
+		if len(client.Key) < clientSecretBytes {
+			return nil, fmt.Errorf("key of client %s must be at least %d bytes, got %d", client.ClientID, clientSecretBytes, len(client.Key))
+		}
+		if keys[client.Namespace] == nil {
+			keys[client.Namespace] = make(map[string][]byte)
+		}
+		if _, exists := keys[client.Namespace][client.ClientID]; exists {
+			return nil, fmt.Errorf("client %s has more than one key", client.ClientID)
+		}
+		keys[client.Namespace][client.ClientID] = client.Key
+	}
+	return keys, nil
+}
+
+// ClientKey implements ClientKeys.
+func (keys StaticClientKeys) ClientKey(ctx context.Context, namespace string, clientID string) ([]byte, error) {
+	return keys[namespace][clientID], nil
+}
+
+// SetClientKeys makes the service verify requests with the clients' keys.
+// Without it no client has a key. It must be called before the service
+// handles syncs.
+func (sync_service *SyncService) SetClientKeys(keys ClientKeys) {
+	sync_service.clientKeys = keys
+}
+
+// clientKey returns the key of the request's client. Clients without one are
+// rejected with ErrUnknownClient, unless unregistered clients are allowed,
+// then the key is nil.
+func (sync_service *SyncService) clientKey(ctx context.Context, req SyncRequest) ([]byte, error) {
+	key, err := sync_service.registeredClientKey(ctx, req)
+	if key != nil || err != nil {
+		return key, err
+	}
+
+	if sync_service.clientKeys != nil {
+		key, err = sync_service.clientKeys.ClientKey(ctx, req.Namespace, req.ClientID)
+		if err != nil {
+			return nil, NewSyncErrorf(ErrDatabaseError, "failed to look up the client's key: %v", err)
+		}
+	}
+
+	// Without a key nothing proves the client owns its ID
+	if key == nil && !sync_service.config.AllowUnregisteredClients {
+		return nil, NewSyncErrorf(ErrUnknownClient, "client %s is not registered", req.ClientID)
+	}
+	return key, nil
+}
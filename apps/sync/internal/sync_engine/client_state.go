@@ -0,0 +1,132 @@
+package sync_engine
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sync/internal/repository"
+	"time"
+)
+
+// ClientState describes how far a client has caught up with the server.
+type ClientState struct {
+	Namespace             string    `json:"namespace"`
+	ClientID              string    `json:"clientId"`
+	LastSeenServerVersion int64     `json:"lastSeenServerVersion"`
+	LastSyncedAt          time.Time `json:"lastSyncedAt"`
+	MaxDotVersion         int64     `json:"maxDotVersion"` // -1 if the client never sent operations
+}
+
+// recordClientState stores the acknowledgement carried by a sync request.
+func recordClientState(ctx context.Context, tx repository.StoreTx, req SyncRequest, syncedAt time.Time) error {
+	maxDotVersion := int64(-1)
+	for _, operation := range req.Operations {
+		if operation.Dot.ClientID == req.ClientID {
+			maxDotVersion = max(maxDotVersion, operation.Dot.Version)
+		}
+	}
+
+	return tx.UpsertClientState(ctx, &repository.DBClientState{
+		Namespace:             req.Namespace,
+		ClientID:              req.ClientID,
+		LastSeenServerVersion: req.LastSeenServerVersion,
+		LastSyncedAt:          syncedAt.UnixMilli(),
+		MaxDotVersion:         maxDotVersion,
+	})
+}
+
+// ClientState returns the state of a client in a namespace, or nil if it has never synced.
+func (sync_service *SyncService) ClientState(ctx context.Context, namespace string, clientID string) (*ClientState, error) {
+	var dbState *repository.DBClientState
+	err := sync_service.withTx(ctx, true, func(tx repository.StoreTx) (err error) {
+		dbState, err = tx.GetClientState(ctx, namespace, clientID)
+		return err
+	})
+	if err != nil || dbState == nil {
+		return nil, err
+	}
+
+	state := fromDatabaseClientState(dbState)
+	return &state, nil
+}
+
+// ClientStates returns the state of every known client in every namespace,
+// least recently synced first.
+func (sync_service *SyncService) ClientStates(ctx context.Context) ([]ClientState, error) {
+	return sync_service.clientStatesSyncedBefore(ctx, math.MaxInt64)
+}
+
+// StaleClients returns clients that haven't synced within maxAge.
+// Stale clients hold back the acknowledged watermark and with it compaction.
+func (sync_service *SyncService) StaleClients(ctx context.Context, maxAge time.Duration) ([]ClientState, error) {
+	return sync_service.clientStatesSyncedBefore(ctx, time.Now().Add(-maxAge).UnixMilli())
+}
+
+// ForgetClient removes a client from acknowledgement tracking so it no longer
+// holds back compaction. If the client comes back it must reset its state,
+// operations it hasn't seen may have been compacted away.
+func (sync_service *SyncService) ForgetClient(ctx context.Context, namespace string, clientID string) (bool, error) {
+	var deleted bool
+	err := sync_service.withTx(ctx, false, func(tx repository.StoreTx) (err error) {
+		deleted, err = tx.DeleteClientState(ctx, namespace, clientID)
+		return err
+	})
+	return deleted, err
+}
+
+// CompactAcknowledged compacts every namespace up to the lowest server version
+// all of its known clients have acknowledged. Clients only fetch operations
+// from their own namespace, so an idle client holds back compaction only
+// there. Clients that haven't seen anything yet don't count, a client can't
+// stop compaction for everyone by sending a lastSeenServerVersion of -1.
+// Results are ordered by namespace.
+func (sync_service *SyncService) CompactAcknowledged(ctx context.Context) ([]*CompactionResult, error) {
+	var watermarks map[string]int64
+	err := sync_service.withTx(ctx, true, func(tx repository.StoreTx) (err error) {
+		watermarks, err = tx.GetAcknowledgedWatermarks(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*CompactionResult, 0, len(watermarks))
+	for _, namespace := range slices.Sorted(maps.Keys(watermarks)) {
+		result, err := sync_service.Compact(ctx, namespace, watermarks[namespace])
+		if err != nil {
+			return results, fmt.Errorf("failed to compact namespace %q: %w", namespace, err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (sync_service *SyncService) clientStatesSyncedBefore(ctx context.Context, syncedBefore int64) ([]ClientState, error) {
+	var dbStates []*repository.DBClientState
+	err := sync_service.withTx(ctx, true, func(tx repository.StoreTx) (err error) {
+		dbStates, err = tx.GetClientStates(ctx, syncedBefore)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get client states: %w", err)
+	}
+
+	states := make([]ClientState, len(dbStates))
+	for i, dbState := range dbStates {
+		states[i] = fromDatabaseClientState(dbState)
+	}
+
+	return states, nil
+}
+
+func fromDatabaseClientState(dbState *repository.DBClientState) ClientState {
+	return ClientState{
+		Namespace:             dbState.Namespace,
+		ClientID:              dbState.ClientID,
+		LastSeenServerVersion: dbState.LastSeenServerVersion,
+		LastSyncedAt:          time.UnixMilli(dbState.LastSyncedAt),
+		MaxDotVersion:         dbState.MaxDotVersion,
+	}
+}
@@ -0,0 +1,138 @@
+package sync_engine
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// -------------------- Client state tests --------------------
+
+func TestSyncRecordsClientState(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	writer := "11111111-1111-1111-1111-111111111111"
+	reader := "22222222-2222-2222-2222-222222222222"
+
+	if _, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID: writer,
+		Operations: []CRDTOperation{
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Alice"`), Context: map[string]int64{}, Dot: Dot{ClientID: writer, Version: 7}},
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Bob"`), Context: map[string]int64{}, Dot: Dot{ClientID: writer, Version: 8}},
+		},
+		LastSeenServerVersion: -1,
+	})); err != nil {
+		t.Fatalf("writer sync failed: %v", err)
+	}
+	if _, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID:              reader,
+		Operations:            []CRDTOperation{},
+		LastSeenServerVersion: 1,
+	})); err != nil {
+		t.Fatalf("reader sync failed: %v", err)
+	}
+
+	state, err := service.ClientState(ctx, "", writer)
+	if err != nil {
+		t.Fatalf("ClientState() error = %v", err)
+	}
+	if state == nil {
+		t.Fatalf("expected writer state to be recorded")
+	}
+	if state.LastSeenServerVersion != -1 || state.MaxDotVersion != 8 {
+		t.Errorf("unexpected writer state %+v", state)
+	}
+	if time.Since(state.LastSyncedAt) > time.Minute {
+		t.Errorf("expected recent sync time, got %v", state.LastSyncedAt)
+	}
+
+	states, err := service.ClientStates(ctx)
+	if err != nil {
+		t.Fatalf("ClientStates() error = %v", err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("expected 2 client states, got %d", len(states))
+	}
+
+	stale, err := service.StaleClients(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("StaleClients() error = %v", err)
+	}
+	if len(stale) != 0 {
+		t.Errorf("expected no stale clients, got %+v", stale)
+	}
+
+	// The same client ID in another namespace is tracked separately
+	if _, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		Namespace:             "other",
+		ClientID:              writer,
+		Operations:            []CRDTOperation{},
+		LastSeenServerVersion: -1,
+	})); err != nil {
+		t.Fatalf("other namespace sync failed: %v", err)
+	}
+	if state, err := service.ClientState(ctx, "", writer); err != nil || state.MaxDotVersion != 8 {
+		t.Errorf("expected the writer's state to be untouched, got %+v, %v", state, err)
+	}
+
+	// The writer hasn't seen anything yet, it doesn't hold back the reader's
+	// acknowledgement
+	results, err := service.CompactAcknowledged(ctx)
+	if err != nil {
+		t.Fatalf("CompactAcknowledged() error = %v", err)
+	}
+	if len(results) != 1 || results[0].CompactedThrough != 1 || results[0].OperationsDeleted != 1 {
+		t.Errorf("expected first operation compacted, got %+v", results)
+	}
+
+	// Once the reader is forgotten nobody has acknowledged anything
+	forgotten, err := service.ForgetClient(ctx, "", reader)
+	if err != nil || !forgotten {
+		t.Fatalf("ForgetClient() = %v, %v", forgotten, err)
+	}
+	if forgotten, _ := service.ForgetClient(ctx, "other", reader); forgotten {
+		t.Errorf("expected the reader not to be known in another namespace")
+	}
+}
+
+func TestCompactAcknowledgedPerNamespace(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	writer := "11111111-1111-1111-1111-111111111111"
+	idle := "22222222-2222-2222-2222-222222222222"
+
+	write := SyncRequest{
+		Namespace: "busy",
+		ClientID:  writer,
+		Operations: []CRDTOperation{
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Alice"`), Context: map[string]int64{}, Dot: Dot{ClientID: writer, Version: 1}},
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Bob"`), Context: map[string]int64{}, Dot: Dot{ClientID: writer, Version: 2}},
+		},
+		LastSeenServerVersion: -1,
+	}
+	// A client in another namespace that stopped syncing early on
+	stalled := SyncRequest{Namespace: "idle", ClientID: idle, Operations: []CRDTOperation{}, LastSeenServerVersion: 0}
+	acknowledge := SyncRequest{Namespace: "busy", ClientID: writer, Operations: []CRDTOperation{}, LastSeenServerVersion: 2}
+	for _, req := range []SyncRequest{write, stalled, acknowledge} {
+		if _, err := service.Sync(ctx, signedRequest(t, req)); err != nil {
+			t.Fatalf("sync in namespace %q failed: %v", req.Namespace, err)
+		}
+	}
+
+	results, err := service.CompactAcknowledged(ctx)
+	if err != nil {
+		t.Fatalf("CompactAcknowledged() error = %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected a result per namespace, got %+v", results)
+	}
+	if busy := results[0]; busy.Namespace != "busy" || busy.CompactedThrough != 2 || busy.OperationsDeleted != 1 {
+		t.Errorf("expected the idle client not to hold back the busy namespace, got %+v", busy)
+	}
+	if stalled := results[1]; stalled.Namespace != "idle" || stalled.CompactedThrough != 0 {
+		t.Errorf("expected the idle namespace compacted through its own watermark, got %+v", stalled)
+	}
+}
@@ -0,0 +1,70 @@
+package sync_engine
+
+import (
+	"context"
+	"crypto/rand"
+	"sync/internal/logging"
+	"sync/internal/repository"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// clientSecretBytes is the length of the HMAC keys issued to clients.
+const clientSecretBytes = 32
+
+// ClientRegistration is issued to a client by RegisterClient. The secret is
+// only ever sent once, the client signs every sync with it.
+type ClientRegistration struct {
+	ClientID string `json:"clientId"`
+	Secret   []byte `json:"secret"` // Base64 in JSON
+}
+
+// RegisterClient issues a new client ID in a namespace together with the
+// secret it must sign its syncs with. From then on syncs with that ID are
+// only accepted from the namespace and with a valid signature, so no other
+// client can write dots in its name.
+func (sync_service *SyncService) RegisterClient(ctx context.Context, namespace string) (*ClientRegistration, error) {
+	secret := make([]byte, clientSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, NewSyncErrorf(ErrInternal, "failed to generate client secret: %v", err)
+	}
+
+	client := &repository.DBClient{
+		ClientID:  uuid.NewString(),
+		Namespace: namespace,
+		Secret:    secret,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+	err := sync_service.withTx(ctx, false, func(tx repository.StoreTx) error {
+		return tx.InsertClient(ctx, client)
+	})
+	if err != nil {
+		return nil, NewSyncErrorf(ErrDatabaseError, "failed to register client: %v", err)
+	}
+
+	logging.FromContext(ctx).Info("Registered client", "client_id", client.ClientID)
+	return &ClientRegistration{ClientID: client.ClientID, Secret: secret}, nil
+}
+
+// registeredClientKey returns the secret of a registered client, nil if the
+// client isn't registered. A client registered in another namespace is
+// rejected, its ID isn't free to use.
+func (sync_service *SyncService) registeredClientKey(ctx context.Context, req SyncRequest) ([]byte, error) {
+	var client *repository.DBClient
+	err := sync_service.withTx(ctx, true, func(tx repository.StoreTx) (err error) {
+		client, err = tx.GetClient(ctx, req.ClientID)
+		return err
+	})
+	if err != nil {
+		return nil, NewSyncErrorf(ErrDatabaseError, "failed to look up the client: %v", err)
+	}
+
+	if client == nil {
+		return nil, nil
+	}
+	if client.Namespace != req.Namespace {
+		return nil, NewSyncErrorf(ErrUnknownClient, "client %s is not registered in this namespace", req.ClientID)
+	}
+	return client.Secret, nil
+}
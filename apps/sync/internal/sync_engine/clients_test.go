@@ -0,0 +1,90 @@
+package sync_engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// -------------------- Client registration tests --------------------
+
+func TestRegisteredClientSync(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	registration, err := service.RegisterClient(ctx, "team-a")
+	if err != nil {
+		t.Fatalf("RegisterClient failed: %v", err)
+	}
+	if len(registration.Secret) != clientSecretBytes {
+		t.Fatalf("secret has %d bytes, want %d", len(registration.Secret), clientSecretBytes)
+	}
+
+	sign := func(req SyncRequest, key []byte) SyncRequest {
+		hash, err := SignSyncRequest(req, key)
+		if err != nil {
+			t.Fatalf("failed to sign request: %v", err)
+		}
+		req.RequestHash = hash
+		return req
+	}
+	req := SyncRequest{ProtocolVersion: ProtocolV4, ClientID: registration.ClientID, Namespace: "team-a", Operations: []CRDTOperation{}, LastSeenServerVersion: -1}
+
+	resp, err := service.Sync(ctx, sign(req, registration.Secret))
+	if err != nil {
+		t.Fatalf("signed sync failed: %v", err)
+	}
+	if hash, _ := SignSyncResponse(*resp, registration.Secret); hash != resp.ResponseHash {
+		t.Errorf("response isn't signed with the client's secret")
+	}
+
+	var syncErr *SyncError
+	if _, err := service.Sync(ctx, signedRequest(t, req)); !errors.As(err, &syncErr) || syncErr.Code != ErrRequestIntegrity {
+		t.Errorf("expected %s for an unsigned request, got %v", ErrRequestIntegrity, err)
+	}
+
+	other := req
+	other.Namespace = "team-b"
+	if _, err := service.Sync(ctx, sign(other, registration.Secret)); !errors.As(err, &syncErr) || syncErr.Code != ErrUnknownClient {
+		t.Errorf("expected %s from another namespace, got %v", ErrUnknownClient, err)
+	}
+}
+
+func TestRequireClientRegistration(t *testing.T) {
+	service := newTestSyncService(t)
+	service.config = DefaultConfig()
+	ctx := context.Background()
+
+	req := SyncRequest{ClientID: "11111111-1111-1111-1111-111111111111", Operations: []CRDTOperation{}, LastSeenServerVersion: -1}
+	var syncErr *SyncError
+	if _, err := service.Sync(ctx, signedRequest(t, req)); !errors.As(err, &syncErr) || syncErr.Code != ErrUnknownClient {
+		t.Errorf("expected %s for an unregistered client, got %v", ErrUnknownClient, err)
+	}
+
+	registration, err := service.RegisterClient(ctx, "")
+	if err != nil {
+		t.Fatalf("RegisterClient failed: %v", err)
+	}
+	req = SyncRequest{ProtocolVersion: ProtocolV4, ClientID: registration.ClientID, Operations: []CRDTOperation{}, LastSeenServerVersion: -1}
+	req.RequestHash, _ = SignSyncRequest(req, registration.Secret)
+	if _, err := service.Sync(ctx, req); err != nil {
+		t.Errorf("registered client sync failed: %v", err)
+	}
+
+	// Clients given a key don't need to register
+	const keyed = "22222222-2222-2222-2222-222222222222"
+	key := []byte("0123456789abcdef0123456789abcdef")
+	service.SetClientKeys(StaticClientKeys{"": {keyed: key}})
+	req = SyncRequest{ProtocolVersion: ProtocolV4, ClientID: keyed, Operations: []CRDTOperation{}, LastSeenServerVersion: -1}
+	req.RequestHash, _ = SignSyncRequest(req, key)
+	if _, err := service.Sync(ctx, req); err != nil {
+		t.Errorf("keyed client sync failed: %v", err)
+	}
+
+	// The legacy opt-out accepts unregistered clients again
+	service.config.AllowUnregisteredClients = true
+	req = SyncRequest{ClientID: "11111111-1111-1111-1111-111111111111", Operations: []CRDTOperation{}, LastSeenServerVersion: -1}
+	if _, err := service.Sync(ctx, signedRequest(t, req)); err != nil {
+		t.Errorf("unregistered client sync with AllowUnregisteredClients failed: %v", err)
+	}
+}
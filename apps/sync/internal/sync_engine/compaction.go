@@ -0,0 +1,200 @@
+package sync_engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/internal/logging"
+	"sync/internal/repository"
+)
+
+// CompactionResult describes what a compaction run did.
+type CompactionResult struct {
+	Namespace         string `json:"namespace"`
+	CompactedThrough  int64  `json:"compactedThrough"`
+	RowsScanned       int    `json:"rowsScanned"`
+	OperationsDeleted int64  `json:"operationsDeleted"`
+}
+
+// Compact deletes operations in a namespace at or below the watermark whose
+// effect is dominated by other operations on the same row. Folding the remaining log
+// in any order gives the same rows as folding the full log, so lagging
+// clients still converge by fetching operations after their last seen version.
+//
+// The watermark must be a server version every known client in the namespace
+// has acknowledged, see CompactAcknowledged. A client that hasn't seen its own operations
+// confirmed yet may retry them, and a retried operation that was compacted
+// away would be inserted again.
+func (sync_service *SyncService) Compact(ctx context.Context, namespace string, watermark int64) (*CompactionResult, error) {
+	tx, err := sync_service.store.Begin(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	compactedThrough, err := tx.GetCompactedThrough(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	maxServerVersion, err := tx.GetMaxServerVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	watermark = min(watermark, maxServerVersion)
+
+	result := &CompactionResult{Namespace: namespace, CompactedThrough: compactedThrough}
+	if watermark <= compactedThrough {
+		return result, nil
+	}
+
+	// Rows without new operations since the last run can't have gained
+	// a dominating operation, so only rows touched since then are scanned.
+	// Operations above the watermark can still dominate older ones.
+	rows, err := tx.GetRowsWithOperationsBetween(ctx, namespace, compactedThrough, watermark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rows to compact: %w", err)
+	}
+
+	for _, row := range rows {
+		dbOperations, err := tx.GetCRDTOperationsForRow(ctx, row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get operations for row (table=%s, rowKey=%s): %w", row.TableName, row.RowKey, err)
+		}
+
+		deleted, err := tx.DeleteCRDTOperations(ctx, dominatedOperations(ctx, dbOperations, watermark))
+		if err != nil {
+			return nil, err
+		}
+
+		result.RowsScanned++
+		result.OperationsDeleted += deleted
+	}
+
+	if err := tx.SetCompactedThrough(ctx, namespace, watermark); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit compaction: %w", err)
+	}
+
+	result.CompactedThrough = watermark
+	return result, nil
+}
+
+// dominatedOperations returns the server versions of operations at or below
+// the watermark that don't affect the folded row, whatever order the
+// operations are applied in. All operations passed in must belong to the same row.
+//
+//   - set/setRow is dominated if the merged tombstone covers its dot, or if every
+//     field it writes has a higher write that the tombstone doesn't cover.
+//     A covered winner can't dominate, applying the remove before both
+//     writes would let the lower write through.
+//   - remove is dominated by another remove with a higher dot and a context
+//     that is at least as high for every client.
+func dominatedOperations(ctx context.Context, dbOperations []*repository.DBCRDTOperation, watermark int64) []int64 {
+	ops := make([]CRDTOperation, 0, len(dbOperations))
+	serverVersions := make([]int64, 0, len(dbOperations))
+	for _, dbOperation := range dbOperations {
+		op, err := fromDatabaseOperation(dbOperation)
+		if err != nil {
+			// Never compact what we can't reason about
+			logging.FromContext(ctx).Warn("Skipping operation during compaction",
+				"server_version", dbOperation.ServerVersion, "error", err)
+			continue
+		}
+		ops = append(ops, op)
+		serverVersions = append(serverVersions, dbOperation.ServerVersion)
+	}
+
+	// Fold every remove into a single tombstone and find the
+	// winning uncovered write for every field
+	tombstone := newMaterializedRow("", "")
+	writes := make([]map[string]json.RawMessage, len(ops))
+	for i, op := range ops {
+		if op.Type == "remove" {
+			tombstone.applyOperation(op)
+		}
+		writes[i] = writtenFields(op)
+	}
+
+	winners := newMaterializedRow("", "")
+	for i, op := range ops {
+		if writes[i] == nil || tombstone.dominatedByTombstone(op.Dot) {
+			continue
+		}
+		for field, value := range writes[i] {
+			winners.setField(field, LWWField{Value: value, Dot: op.Dot})
+		}
+	}
+
+	var dominated []int64
+	for i, op := range ops {
+		if serverVersions[i] > watermark {
+			continue
+		}
+
+		switch op.Type {
+		case "set", "setRow":
+			if writes[i] == nil {
+				continue
+			}
+			if tombstone.dominatedByTombstone(op.Dot) || allFieldsSuperseded(writes[i], op.Dot, winners) {
+				dominated = append(dominated, serverVersions[i])
+			}
+		case "remove":
+			for j, other := range ops {
+				if i != j && other.Type == "remove" && removeDominates(other, op) {
+					dominated = append(dominated, serverVersions[i])
+					break
+				}
+			}
+		}
+	}
+
+	return dominated
+}
+
+// writtenFields returns the fields a set or setRow writes, or nil if the
+// operation isn't a write the merge engine would accept.
+func writtenFields(op CRDTOperation) map[string]json.RawMessage {
+	switch op.Type {
+	case "set":
+		if op.Field == nil || *op.Field == "" {
+			return nil
+		}
+		return map[string]json.RawMessage{*op.Field: op.Value}
+	case "setRow":
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &fields); err != nil || fields == nil {
+			return nil
+		}
+		return fields
+	}
+	return nil
+}
+
+// allFieldsSuperseded reports whether every written field has a different winner.
+func allFieldsSuperseded(fields map[string]json.RawMessage, dot Dot, winners *MaterializedRow) bool {
+	for field, value := range fields {
+		winner, ok := winners.Fields[field]
+		if !ok || (winner.Dot == dot && compareValues(winner.Value, value) == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// removeDominates reports whether merging a into a tombstone makes b redundant.
+func removeDominates(a CRDTOperation, b CRDTOperation) bool {
+	if compareDots(a.Dot, b.Dot) <= 0 {
+		return false
+	}
+	for clientID, version := range b.Context {
+		if seen, ok := a.Context[clientID]; !ok || seen < version {
+			return false
+		}
+	}
+	return true
+}
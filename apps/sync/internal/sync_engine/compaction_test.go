@@ -0,0 +1,141 @@
+package sync_engine
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// -------------------- Compaction tests --------------------
+
+func TestCompact(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	client := "11111111-1111-1111-1111-111111111111"
+	resp, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID: client,
+		Operations: []CRDTOperation{
+			// Superseded by version 2
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Alice"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 1}},
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Bob"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 2}},
+			// Only partially superseded, name is overwritten but age is not
+			{Type: "setRow", Table: "users", RowKey: "2", Value: json.RawMessage(`{"name":"Carol","age":30}`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 3}},
+			{Type: "set", Table: "users", RowKey: "2", Field: stringPtr("name"), Value: json.RawMessage(`"Dave"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 4}},
+			// Covered by the remove
+			{Type: "set", Table: "posts", RowKey: "p1", Field: stringPtr("title"), Value: json.RawMessage(`"Hello"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 5}},
+			{Type: "remove", Table: "posts", RowKey: "p1", Context: map[string]int64{client: 5}, Dot: Dot{ClientID: client, Version: 6}},
+		},
+		LastSeenServerVersion: -1,
+	}))
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	before, err := service.Snapshot(ctx, "", "")
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+
+	result, err := service.Compact(ctx, "", resp.LatestServerVersion)
+	if err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	if result.OperationsDeleted != 2 {
+		t.Errorf("expected 2 operations deleted, got %d", result.OperationsDeleted)
+	}
+	if result.CompactedThrough != 6 {
+		t.Errorf("expected compacted through 6, got %d", result.CompactedThrough)
+	}
+
+	// A client that has seen nothing must still converge to the same rows
+	reader := "22222222-2222-2222-2222-222222222222"
+	readerResp, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID:              reader,
+		Operations:            []CRDTOperation{},
+		LastSeenServerVersion: -1,
+	}))
+	if err != nil {
+		t.Fatalf("reader sync failed: %v", err)
+	}
+	if len(readerResp.Operations) != 4 {
+		t.Errorf("expected 4 remaining operations, got %d", len(readerResp.Operations))
+	}
+	if readerResp.LatestServerVersion != 6 {
+		t.Errorf("expected latest server version 6, got %d", readerResp.LatestServerVersion)
+	}
+
+	rows := make(map[string]*MaterializedRow)
+	for _, op := range readerResp.Operations {
+		key := op.Table + "/" + op.RowKey
+		if rows[key] == nil {
+			rows[key] = newMaterializedRow(op.Table, op.RowKey)
+		}
+		if err := rows[key].applyOperation(op); err != nil {
+			t.Fatalf("applyOperation() error = %v", err)
+		}
+	}
+	for _, want := range before.Rows {
+		got := rows[want.Table+"/"+want.RowKey]
+		if got == nil || len(got.Fields) != len(want.Fields) {
+			t.Fatalf("row %s/%s diverged after compaction: got %+v, want %+v", want.Table, want.RowKey, got, want)
+		}
+		for field, state := range want.Fields {
+			if string(got.Fields[field].Value) != string(state.Value) {
+				t.Errorf("row %s/%s field %q = %s, want %s", want.Table, want.RowKey, field, got.Fields[field].Value, state.Value)
+			}
+		}
+	}
+
+	// Running again without new operations is a no-op
+	again, err := service.Compact(ctx, "", resp.LatestServerVersion)
+	if err != nil {
+		t.Fatalf("second compact failed: %v", err)
+	}
+	if again.OperationsDeleted != 0 || again.RowsScanned != 0 {
+		t.Errorf("expected no-op compaction, got %+v", again)
+	}
+}
+
+func TestCompactRespectsWatermark(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	client := "11111111-1111-1111-1111-111111111111"
+	if _, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID: client,
+		Operations: []CRDTOperation{
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Alice"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 1}},
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Bob"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 2}},
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Carol"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 3}},
+		},
+		LastSeenServerVersion: -1,
+	})); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	// Only the first operation has been acknowledged by everyone
+	result, err := service.Compact(ctx, "", 1)
+	if err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	if result.OperationsDeleted != 1 {
+		t.Errorf("expected 1 operation deleted, got %d", result.OperationsDeleted)
+	}
+}
+
+func TestRemoveDominates(t *testing.T) {
+	older := CRDTOperation{Type: "remove", Context: map[string]int64{"a": 1}, Dot: Dot{ClientID: "b", Version: 2}}
+	newer := CRDTOperation{Type: "remove", Context: map[string]int64{"a": 1, "c": 4}, Dot: Dot{ClientID: "b", Version: 5}}
+	narrower := CRDTOperation{Type: "remove", Context: map[string]int64{"c": 4}, Dot: Dot{ClientID: "b", Version: 6}}
+
+	if !removeDominates(newer, older) {
+		t.Errorf("expected newer remove to dominate older")
+	}
+	if removeDominates(older, newer) {
+		t.Errorf("expected older remove not to dominate newer")
+	}
+	if removeDominates(narrower, older) {
+		t.Errorf("expected remove with narrower context not to dominate")
+	}
+}
@@ -0,0 +1,50 @@
+package sync_engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// End-to-end encrypted operations are opt-in per operation. The client
+// encrypts every value it writes and sends each ciphertext as a JSON string:
+//
+//   - set has a ciphertext value, its field may be encrypted too.
+//   - setRow has an object that maps field names to ciphertexts.
+//   - remove carries no data and can't be encrypted.
+//
+// Table, row key, dot and context stay plaintext, so the server still orders,
+// deduplicates, materializes and compacts the operations, treating ciphertexts
+// like any other value. Clients that encrypt field names need a deterministic
+// scheme, the same field must always encrypt to the same name for
+// last-writer-wins to pick a single value. Schemas can only check the table of
+// an encrypted operation.
+
+// validateEncryptedOperation returns the first encryption rule an operation
+// that already passed validateOperation breaks.
+func validateEncryptedOperation(op CRDTOperation, protocolVersion int) error {
+	if effectiveProtocolVersion(protocolVersion) < ProtocolV4 {
+		return fmt.Errorf("encrypted operations need protocol version %d or later", ProtocolV4)
+	}
+
+	switch op.Type {
+	case "set":
+		if jsonTypeOf(op.Value) != "string" {
+			return errors.New("encrypted set value must be a ciphertext string")
+		}
+	case "setRow":
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &fields); err != nil {
+			return errors.New("setRow value must be a JSON object")
+		}
+		for field, value := range fields {
+			if jsonTypeOf(value) != "string" {
+				return fmt.Errorf("encrypted setRow field %q must be a ciphertext string", field)
+			}
+		}
+	case "remove":
+		return errors.New("remove has nothing to encrypt")
+	}
+
+	return nil
+}
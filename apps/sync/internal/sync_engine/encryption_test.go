@@ -0,0 +1,94 @@
+package sync_engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// -------------------- Encrypted operation tests --------------------
+
+func TestValidateEncryptedOperation(t *testing.T) {
+	const client = "11111111-1111-1111-1111-111111111111"
+	dot := Dot{ClientID: client, Version: 1}
+
+	tests := []struct {
+		name     string
+		op       CRDTOperation
+		protocol int
+		wantErr  bool
+	}{
+		{name: "encrypted set", op: CRDTOperation{Type: "set", Table: "notes", RowKey: "1", Field: stringPtr("body"), Value: json.RawMessage(`"c2VjcmV0"`), Dot: dot}, protocol: ProtocolV4},
+		{name: "encrypted setRow", op: CRDTOperation{Type: "setRow", Table: "notes", RowKey: "1", Value: json.RawMessage(`{"body":"c2VjcmV0","title":"dGl0bGU="}`), Dot: dot}, protocol: ProtocolV4},
+		{name: "older protocol", op: CRDTOperation{Type: "set", Table: "notes", RowKey: "1", Field: stringPtr("body"), Value: json.RawMessage(`"c2VjcmV0"`), Dot: dot}, protocol: ProtocolV3, wantErr: true},
+		{name: "plaintext set value", op: CRDTOperation{Type: "set", Table: "notes", RowKey: "1", Field: stringPtr("body"), Value: json.RawMessage(`42`), Dot: dot}, protocol: ProtocolV4, wantErr: true},
+		{name: "plaintext setRow field", op: CRDTOperation{Type: "setRow", Table: "notes", RowKey: "1", Value: json.RawMessage(`{"body":"c2VjcmV0","pinned":true}`), Dot: dot}, protocol: ProtocolV4, wantErr: true},
+		{name: "encrypted remove", op: CRDTOperation{Type: "remove", Table: "notes", RowKey: "1", Context: map[string]int64{}, Dot: dot}, protocol: ProtocolV4, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateEncryptedOperation(tt.op, tt.protocol)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateEncryptedOperation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSyncEncryptedOperations(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	// Schemas only check the table of encrypted operations, the field
+	// names could be encrypted too
+	if err := service.Schemas().Register(TableSchema{Name: "notes", Fields: map[string]FieldSchema{"title": {Type: FieldTypeString}}}); err != nil {
+		t.Fatalf("failed to register schema: %v", err)
+	}
+
+	writer := "11111111-1111-1111-1111-111111111111"
+	reader := "22222222-2222-2222-2222-222222222222"
+	req := SyncRequest{
+		ProtocolVersion: ProtocolV4,
+		ClientID:        writer,
+		Operations: []CRDTOperation{
+			{Type: "set", Table: "notes", RowKey: "1", Field: stringPtr("body"), Value: json.RawMessage(`"c2VjcmV0"`), Context: map[string]int64{}, Dot: Dot{ClientID: writer, Version: 1}, Encrypted: true},
+		},
+		LastSeenServerVersion: -1,
+	}
+	if _, err := service.Sync(ctx, signedRequest(t, req)); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	// Retries are deduplicated on the ciphertext
+	if _, err := service.Sync(ctx, signedRequest(t, req)); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	req.Operations[0].Table = "journal"
+	var syncErr *SyncError
+	if _, err := service.Sync(ctx, signedRequest(t, req)); !errors.As(err, &syncErr) || syncErr.Code != ErrSchemaViolation {
+		t.Errorf("expected %s for an unregistered table, got %v", ErrSchemaViolation, err)
+	}
+	req.Operations[0].Table = "notes"
+	req.Operations[0].Field = stringPtr("title")
+	if _, err := service.Sync(ctx, signedRequest(t, req)); !errors.As(err, &syncErr) || syncErr.Code != ErrInvalidOperation {
+		t.Errorf("expected %s for a reused dot, got %v", ErrInvalidOperation, err)
+	}
+
+	resp, err := service.Sync(ctx, signedRequest(t, SyncRequest{ProtocolVersion: ProtocolV4, ClientID: reader, Operations: []CRDTOperation{}, LastSeenServerVersion: -1}))
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if len(resp.Operations) != 1 || !resp.Operations[0].Encrypted || string(resp.Operations[0].Value) != `"c2VjcmV0"` {
+		t.Errorf("expected the ciphertext to be relayed as is, got %+v", resp.Operations)
+	}
+
+	snapshot, err := service.Snapshot(ctx, "", "notes")
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if len(snapshot.Rows) != 1 || !snapshot.Rows[0].Fields["body"].Encrypted {
+		t.Errorf("expected an encrypted body field, got %+v", snapshot.Rows)
+	}
+}
@@ -24,12 +24,74 @@ const (
 
 	// ErrInvalidClientID indicates the client ID is invalid or missing
 	ErrInvalidClientID SyncErrorCode = "INVALID_CLIENT_ID"
+
+	// ErrSchemaViolation indicates one or more operations don't match the
+	// registered schema of their table
+	ErrSchemaViolation SyncErrorCode = "SCHEMA_VIOLATION"
+
+	// ErrUnauthorized indicates the request credentials are missing or invalid
+	ErrUnauthorized SyncErrorCode = "UNAUTHORIZED"
+
+	// ErrBadRequest indicates the request body is malformed or a field is out of range
+	ErrBadRequest SyncErrorCode = "BAD_REQUEST"
+
+	// ErrServerBusy indicates the server is at capacity and the request was not processed
+	ErrServerBusy SyncErrorCode = "SERVER_BUSY"
+
+	// ErrRateLimited indicates the client or its address sent too many
+	// requests, the Retry-After header says when to try again
+	ErrRateLimited SyncErrorCode = "RATE_LIMITED"
+
+	// ErrRequestTooLarge indicates the request body exceeds the server's size limit
+	ErrRequestTooLarge SyncErrorCode = "REQUEST_TOO_LARGE"
+
+	// ErrTooManyOperations indicates the request carries more operations than
+	// the server accepts at once, the client should send them in smaller batches
+	ErrTooManyOperations SyncErrorCode = "TOO_MANY_OPERATIONS"
+
+	// ErrValueTooLarge indicates an operation's value exceeds the server's size limit
+	ErrValueTooLarge SyncErrorCode = "VALUE_TOO_LARGE"
+
+	// ErrUnsupportedEncoding indicates the request body uses a Content-Encoding
+	// the server can't decode
+	ErrUnsupportedEncoding SyncErrorCode = "UNSUPPORTED_ENCODING"
+
+	// ErrUnknownClient indicates the client ID wasn't issued to the caller,
+	// the client has to register to get its own
+	ErrUnknownClient SyncErrorCode = "UNKNOWN_CLIENT"
+
+	// ErrUnsupportedProtocol indicates the request's protocol version is one
+	// the server doesn't speak, the client has to be updated
+	ErrUnsupportedProtocol SyncErrorCode = "UNSUPPORTED_PROTOCOL"
+
+	// ErrInternal indicates an unexpected server failure
+	ErrInternal SyncErrorCode = "INTERNAL_ERROR"
 )
 
+// Retryable reports whether sending the same request again can succeed.
+// Everything else needs the client to change the request or reset its state.
+func (code SyncErrorCode) Retryable() bool {
+	switch code {
+	case ErrDatabaseError, ErrServerBusy, ErrRateLimited, ErrRequestIntegrity, ErrResponseIntegrity:
+		// Integrity failures are usually corruption in transit
+		return true
+	default:
+		return false
+	}
+}
+
 // SyncError represents a structured error returned by the sync API
 type SyncError struct {
-	Code    SyncErrorCode `json:"code"`
-	Message string        `json:"message"`
+	Code      SyncErrorCode `json:"code"`
+	Message   string        `json:"message"`
+	Retryable bool          `json:"retryable"`
+
+	// Details lists the rejected operations for ErrInvalidOperation,
+	// ErrSchemaViolation and ErrValueTooLarge
+	Details []OperationError `json:"details,omitempty"`
+
+	// SupportedProtocolVersions is set for ErrUnsupportedProtocol
+	SupportedProtocolVersions []int `json:"supportedProtocolVersions,omitempty"`
 }
 
 // Error implements the error interface
@@ -40,15 +102,17 @@ func (e *SyncError) Error() string {
 // NewSyncError creates a new SyncError with the given code and message
 func NewSyncError(code SyncErrorCode, message string) *SyncError {
 	return &SyncError{
-		Code:    code,
-		Message: message,
+		Code:      code,
+		Message:   message,
+		Retryable: code.Retryable(),
 	}
 }
 
 // NewSyncErrorf creates a new SyncError with formatted message
 func NewSyncErrorf(code SyncErrorCode, format string, args ...interface{}) *SyncError {
 	return &SyncError{
-		Code:    code,
-		Message: fmt.Sprintf(format, args...),
+		Code:      code,
+		Message:   fmt.Sprintf(format, args...),
+		Retryable: code.Retryable(),
 	}
 }
@@ -1,37 +1,128 @@
 package sync_engine
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
+	"maps"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/internal/canonicaljson"
 )
 
 // ValidateSyncRequestIntegrity checks if the request hash matches the computed hash
 func ValidateSyncRequestIntegrity(req SyncRequest) error {
-	computedHash, err := HashSyncRequest(req)
+	return validateSyncRequestSignature(req, nil)
+}
+
+// validateSyncRequestSignature checks the request hash against the one
+// computed with key, in constant time since keyed hashes are secrets
+func validateSyncRequestSignature(req SyncRequest, key []byte) error {
+	computedHash, err := SignSyncRequest(req, key)
 	if err != nil {
-		log.Printf("Failed to compute request hash for client %s: %v", req.ClientID, err)
-		return fmt.Errorf("failed to compute request hash")
+		return fmt.Errorf("failed to compute request hash: %w", err)
 	}
 
-	if computedHash != req.RequestHash {
-		log.Printf("Request integrity check failed for client %s: hash mismatch", req.ClientID)
-		return fmt.Errorf("request integrity check failed")
+	if !hmac.Equal([]byte(computedHash), []byte(req.RequestHash)) {
+		return fmt.Errorf("request hash mismatch")
 	}
 
 	return nil
 }
 
-// HashSyncRequest computes a SHA-256 hash of the sync request for integrity verification
+// HashSyncRequest computes a SHA-256 hash of the sync request for integrity
+// verification, laid out as req's protocol version defines
 func HashSyncRequest(req SyncRequest) (string, error) {
+	return SignSyncRequest(req, nil)
+}
+
+// HashSyncResponse computes a SHA-256 hash of the sync response for integrity
+// verification, laid out as resp's protocol version defines
+func HashSyncResponse(resp SyncResponse) (string, error) {
+	return SignSyncResponse(resp, nil)
+}
+
+// SignSyncRequest is HashSyncRequest keyed with the client's HMAC key, which
+// proves the request came from the client. A nil key hashes without one.
+// Keys need ProtocolV3 or later.
+func SignSyncRequest(req SyncRequest, key []byte) (string, error) {
+	protocol, err := lookupKeyedProtocol(req.ProtocolVersion, key)
+	if err != nil {
+		return "", err
+	}
+	return protocol.hashRequest(req, key)
+}
+
+// SignSyncResponse is HashSyncResponse keyed with the client's HMAC key, so the
+// client can tell the response came from the server.
+func SignSyncResponse(resp SyncResponse, key []byte) (string, error) {
+	protocol, err := lookupKeyedProtocol(resp.ProtocolVersion, key)
+	if err != nil {
+		return "", err
+	}
+	return protocol.hashResponse(resp, key)
+}
+
+// ------------------------------------------------------------------------
+// ProtocolV1 and ProtocolV2: SHA-256 over fields joined with |
+// ------------------------------------------------------------------------
+
+func hashSyncRequestV1(req SyncRequest, _ []byte) (string, error) {
+	parts, err := syncRequestHashParts(req, false)
+	if err != nil {
+		return "", err
+	}
+	return hashParts(parts), nil
+}
+
+func hashSyncRequestV2(req SyncRequest, _ []byte) (string, error) {
+	parts, err := syncRequestHashParts(req, true)
+	if err != nil {
+		return "", err
+	}
+	return hashParts(append([]string{strconv.Itoa(ProtocolV2)}, parts...)), nil
+}
+
+func hashSyncResponseV1(resp SyncResponse, _ []byte) (string, error) {
+	parts, err := syncResponseHashParts(resp)
+	if err != nil {
+		return "", err
+	}
+	return hashParts(parts), nil
+}
+
+func hashSyncResponseV2(resp SyncResponse, _ []byte) (string, error) {
+	parts, err := syncResponseHashParts(resp)
+	if err != nil {
+		return "", err
+	}
+	return hashParts(append([]string{strconv.Itoa(ProtocolV2)}, parts...)), nil
+}
+
+// hashParts joins the parts with | and returns their hex encoded SHA-256
+func hashParts(parts []string) string {
+	hash := sha256.Sum256([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(hash[:])
+}
+
+// syncRequestHashParts lists the request fields covered by the hash. With
+// removeContext the context of remove operations is covered too.
+func syncRequestHashParts(req SyncRequest, removeContext bool) ([]string, error) {
 	parts := []string{
 		req.ClientID,
 		fmt.Sprintf("%d", req.LastSeenServerVersion),
 	}
 
+	// Page size is optional, only hash it when set so clients
+	// that don't negotiate a page size keep their hash layout.
+	if req.PageSize != 0 {
+		parts = append(parts, fmt.Sprintf("%d", req.PageSize))
+	}
+
 	for _, op := range req.Operations {
 		value := "null"
 		valueKey := "null"
@@ -40,7 +131,7 @@ func HashSyncRequest(req SyncRequest) (string, error) {
 			if op.Value != nil {
 				b, err := json.Marshal(op.Value)
 				if err != nil {
-					return "", err
+					return nil, err
 				}
 				value = string(b)
 			}
@@ -59,20 +150,27 @@ func HashSyncRequest(req SyncRequest) (string, error) {
 			fmt.Sprintf("%d", op.Dot.Version),
 			op.Dot.ClientID,
 		)
+		if removeContext && op.Type == "remove" {
+			parts = append(parts, contextHashParts(op.Context)...)
+		}
 	}
 
-	combined := strings.Join(parts, "|")
-	hash := sha256.Sum256([]byte(combined))
-	return hex.EncodeToString(hash[:]), nil
+	return parts, nil
 }
 
-// HashSyncResponse computes a SHA-256 hash of the sync response for integrity verification
-func HashSyncResponse(resp SyncResponse) (string, error) {
+// syncResponseHashParts lists the response fields covered by the hash
+func syncResponseHashParts(resp SyncResponse) ([]string, error) {
 	parts := []string{
 		fmt.Sprintf("%d", resp.BaseServerVersion),
 		fmt.Sprintf("%d", resp.LatestServerVersion),
 	}
 
+	// Paging fields are only reported to clients that asked for a page
+	// size, so clients that don't page keep their hash layout.
+	if resp.PageSize != 0 {
+		parts = append(parts, fmt.Sprintf("%t", resp.HasMore), fmt.Sprintf("%d", resp.PageSize))
+	}
+
 	// Operations - include value, field, and context for integrity
 	for _, op := range resp.Operations {
 		parts = append(parts,
@@ -96,7 +194,7 @@ func HashSyncResponse(resp SyncResponse) (string, error) {
 			if op.Value != nil {
 				b, err := json.Marshal(op.Value)
 				if err != nil {
-					return "", err
+					return nil, err
 				}
 				parts = append(parts, string(b))
 			} else {
@@ -109,7 +207,7 @@ func HashSyncResponse(resp SyncResponse) (string, error) {
 			if op.Value != nil {
 				b, err := json.Marshal(op.Value)
 				if err != nil {
-					return "", err
+					return nil, err
 				}
 				parts = append(parts, string(b))
 			} else {
@@ -119,26 +217,7 @@ func HashSyncResponse(resp SyncResponse) (string, error) {
 			parts = append(parts, "null") // field placeholder
 			parts = append(parts, "null") // value placeholder
 
-			// Add context (sorted keys for deterministic hash)
-			if op.Context != nil {
-				// Sort context keys for deterministic ordering
-				keys := make([]string, 0, len(op.Context))
-				for k := range op.Context {
-					keys = append(keys, k)
-				}
-				// Sort keys alphabetically
-				for i := 0; i < len(keys); i++ {
-					for j := i + 1; j < len(keys); j++ {
-						if keys[i] > keys[j] {
-							keys[i], keys[j] = keys[j], keys[i]
-						}
-					}
-				}
-				for _, key := range keys {
-					parts = append(parts, key)
-					parts = append(parts, fmt.Sprintf("%d", op.Context[key]))
-				}
-			}
+			parts = append(parts, contextHashParts(op.Context)...)
 		}
 	}
 
@@ -150,10 +229,163 @@ func HashSyncResponse(resp SyncResponse) (string, error) {
 		)
 	}
 
-	// Join with |
-	combined := strings.Join(parts, "|")
+	return parts, nil
+}
+
+// contextHashParts lists a context's entries, sorted by client ID so the
+// hash doesn't depend on map order
+func contextHashParts(context map[string]int64) []string {
+	var parts []string
+	for _, clientID := range slices.Sorted(maps.Keys(context)) {
+		parts = append(parts, clientID, fmt.Sprintf("%d", context[clientID]))
+	}
+	return parts
+}
+
+// ------------------------------------------------------------------------
+// ProtocolV3 and ProtocolV4: length-prefixed canonical encoding, optionally keyed
+// ------------------------------------------------------------------------
+//
+// Every field is written as its length, a big-endian uint32, followed by its
+// bytes, so no value can be mistaken for a field boundary the way a | inside
+// a row key can with the older layouts. Integers are written in decimal,
+// optional fields are preceded by a presence field and values are their
+// canonical JSON (RFC 8785), so key order and formatting don't matter. The
+// encoding starts with a label that keeps request and response hashes apart.
+// ProtocolV4 adds whether each operation is encrypted after its dot.
+
+const (
+	canonicalRequestLabel  = "sync-request"
+	canonicalResponseLabel = "sync-response"
+)
 
-	// SHA256
-	hash := sha256.Sum256([]byte(combined))
-	return hex.EncodeToString(hash[:]), nil
+// canonicalEncoder builds the canonical encoding of a protocol version and hashes it.
+type canonicalEncoder struct {
+	version int
+	buf     []byte
+}
+
+func newCanonicalEncoder(label string, version int) *canonicalEncoder {
+	encoder := &canonicalEncoder{version: version}
+	encoder.string(label)
+	encoder.int(int64(version))
+	return encoder
+}
+
+func (encoder *canonicalEncoder) field(value []byte) {
+	encoder.buf = binary.BigEndian.AppendUint32(encoder.buf, uint32(len(value)))
+	encoder.buf = append(encoder.buf, value...)
+}
+
+func (encoder *canonicalEncoder) string(value string) {
+	encoder.field([]byte(value))
+}
+
+func (encoder *canonicalEncoder) int(value int64) {
+	encoder.string(strconv.FormatInt(value, 10))
+}
+
+func (encoder *canonicalEncoder) bool(value bool) {
+	encoder.string(strconv.FormatBool(value))
+}
+
+func (encoder *canonicalEncoder) operation(op CRDTOperation) error {
+	encoder.string(op.Type)
+	encoder.string(op.Table)
+	encoder.string(op.RowKey)
+
+	encoder.bool(op.Field != nil)
+	if op.Field != nil {
+		encoder.string(*op.Field)
+	}
+
+	encoder.bool(op.Value != nil)
+	if op.Value != nil {
+		value, err := canonicaljson.Canonicalize(op.Value)
+		if err != nil {
+			return err
+		}
+		encoder.field(value)
+	}
+
+	encoder.int(int64(len(op.Context)))
+	for _, clientID := range slices.Sorted(maps.Keys(op.Context)) {
+		encoder.string(clientID)
+		encoder.int(op.Context[clientID])
+	}
+
+	encoder.dot(op.Dot)
+	if encoder.version >= ProtocolV4 {
+		encoder.bool(op.Encrypted)
+	}
+	return nil
+}
+
+func (encoder *canonicalEncoder) dot(dot Dot) {
+	encoder.string(dot.ClientID)
+	encoder.int(dot.Version)
+}
+
+// sum returns the hex encoded HMAC-SHA256 of the encoding, or its plain
+// SHA-256 without a key.
+func (encoder *canonicalEncoder) sum(key []byte) string {
+	if key == nil {
+		hash := sha256.Sum256(encoder.buf)
+		return hex.EncodeToString(hash[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(encoder.buf)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hashSyncRequestV3(req SyncRequest, key []byte) (string, error) {
+	return hashCanonicalRequest(ProtocolV3, req, key)
+}
+
+func hashSyncRequestV4(req SyncRequest, key []byte) (string, error) {
+	return hashCanonicalRequest(ProtocolV4, req, key)
+}
+
+func hashSyncResponseV3(resp SyncResponse, key []byte) (string, error) {
+	return hashCanonicalResponse(ProtocolV3, resp, key)
+}
+
+func hashSyncResponseV4(resp SyncResponse, key []byte) (string, error) {
+	return hashCanonicalResponse(ProtocolV4, resp, key)
+}
+
+func hashCanonicalRequest(version int, req SyncRequest, key []byte) (string, error) {
+	encoder := newCanonicalEncoder(canonicalRequestLabel, version)
+	encoder.string(req.ClientID)
+	encoder.int(req.LastSeenServerVersion)
+	encoder.int(int64(req.PageSize))
+
+	encoder.int(int64(len(req.Operations)))
+	for _, op := range req.Operations {
+		if err := encoder.operation(op); err != nil {
+			return "", err
+		}
+	}
+	return encoder.sum(key), nil
+}
+
+func hashCanonicalResponse(version int, resp SyncResponse, key []byte) (string, error) {
+	encoder := newCanonicalEncoder(canonicalResponseLabel, version)
+	encoder.int(resp.BaseServerVersion)
+	encoder.int(resp.LatestServerVersion)
+	encoder.bool(resp.HasMore)
+	encoder.int(int64(resp.PageSize))
+
+	encoder.int(int64(len(resp.Operations)))
+	for _, op := range resp.Operations {
+		if err := encoder.operation(op); err != nil {
+			return "", err
+		}
+	}
+
+	encoder.int(int64(len(resp.SyncedOperations)))
+	for _, dot := range resp.SyncedOperations {
+		encoder.dot(dot)
+	}
+	return encoder.sum(key), nil
 }
@@ -1,7 +1,10 @@
 package sync_engine
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"sync/internal/repository"
 	"testing"
 )
 
@@ -183,5 +186,239 @@ func TestValidateSyncRequestIntegrity(t *testing.T) {
 	})
 }
 
+// -------------------- Protocol version tests --------------------
+
+func TestHashProtocolVersions(t *testing.T) {
+	remove := func(context map[string]int64) SyncRequest {
+		return SyncRequest{ClientID: "test-client", LastSeenServerVersion: -1, Operations: []CRDTOperation{
+			{Type: "remove", Table: "users", RowKey: "1", Context: context, Dot: Dot{ClientID: "test-client", Version: 2}},
+		}}
+	}
+	withVersion := func(req SyncRequest, version int) SyncRequest {
+		req.ProtocolVersion = version
+		return req
+	}
+	hash := func(req SyncRequest) string {
+		t.Helper()
+		hash, err := HashSyncRequest(req)
+		if err != nil {
+			t.Fatalf("failed to hash: %v", err)
+		}
+		return hash
+	}
+
+	req := remove(map[string]int64{"test-client": 1})
+	otherContext := remove(map[string]int64{"test-client": 5})
+
+	if hash(req) != hash(withVersion(req, ProtocolV1)) {
+		t.Error("a request without a version should hash as ProtocolV1")
+	}
+	if hash(withVersion(req, ProtocolV1)) == hash(withVersion(req, ProtocolV2)) {
+		t.Error("ProtocolV2 hash should differ from ProtocolV1")
+	}
+	if hash(withVersion(req, ProtocolV1)) != hash(withVersion(otherContext, ProtocolV1)) {
+		t.Error("ProtocolV1 request hash should leave out remove contexts")
+	}
+	if hash(withVersion(req, ProtocolV2)) == hash(withVersion(otherContext, ProtocolV2)) {
+		t.Error("ProtocolV2 request hash should cover remove contexts")
+	}
+
+	encrypted := SyncRequest{ClientID: "test-client", LastSeenServerVersion: -1, Operations: []CRDTOperation{
+		{Type: "set", Table: "notes", RowKey: "1", Field: stringPtr("body"), Value: json.RawMessage(`"c2VjcmV0"`), Dot: Dot{ClientID: "test-client", Version: 1}, Encrypted: true},
+	}}
+	plaintext := encrypted
+	plaintext.Operations = []CRDTOperation{encrypted.Operations[0]}
+	plaintext.Operations[0].Encrypted = false
+	if hash(withVersion(encrypted, ProtocolV3)) != hash(withVersion(plaintext, ProtocolV3)) {
+		t.Error("ProtocolV3 request hash should leave out the encrypted flag")
+	}
+	if hash(withVersion(encrypted, ProtocolV4)) == hash(withVersion(plaintext, ProtocolV4)) {
+		t.Error("ProtocolV4 request hash should cover the encrypted flag")
+	}
+
+	resp := SyncResponse{BaseServerVersion: -1, LatestServerVersion: 0, SyncedOperations: []Dot{}, PageSize: 100}
+	v1, _ := HashSyncResponse(resp)
+	resp.ProtocolVersion = ProtocolV2
+	v2, _ := HashSyncResponse(resp)
+	if v1 == v2 {
+		t.Error("ProtocolV2 response hash should differ from ProtocolV1")
+	}
+}
+
+func TestResponseHashPagingFields(t *testing.T) {
+	resp := SyncResponse{BaseServerVersion: -1, LatestServerVersion: 4, Operations: []CRDTOperation{}, SyncedOperations: []Dot{}}
+
+	// Clients that didn't ask for a page size get the original layout
+	resp.HasMore = true
+	got, _ := HashSyncResponse(resp)
+	if want := hashParts([]string{"-1", "4"}); got != want {
+		t.Errorf("unpaged response hash = %s, want %s", got, want)
+	}
+
+	resp.PageSize = 10
+	got, _ = HashSyncResponse(resp)
+	if want := hashParts([]string{"-1", "4", "true", "10"}); got != want {
+		t.Errorf("paged response hash = %s, want %s", got, want)
+	}
+}
+
+func TestUnsupportedProtocolVersion(t *testing.T) {
+	req := SyncRequest{ProtocolVersion: 99, ClientID: "test-client", LastSeenServerVersion: -1}
+
+	_, err := HashSyncRequest(req)
+	syncErr, ok := err.(*SyncError)
+	if !ok || syncErr.Code != ErrUnsupportedProtocol {
+		t.Fatalf("got %v, want %s", err, ErrUnsupportedProtocol)
+	}
+	if len(syncErr.SupportedProtocolVersions) != len(protocols) || syncErr.Retryable {
+		t.Errorf("got %+v, want the supported versions and not retryable", syncErr)
+	}
+
+	service := NewSyncService(repository.NewMemoryStore(), legacyConfig())
+	if _, err := service.Sync(context.Background(), req); err == nil {
+		t.Error("Sync accepted an unsupported protocol version")
+	}
+}
+
+// -------------------- Signed request tests --------------------
+
+func TestCanonicalHashIsUnambiguous(t *testing.T) {
+	// Joined with | both requests hash "1|users|users"
+	first := SyncRequest{ClientID: "client", LastSeenServerVersion: -1, Operations: []CRDTOperation{
+		{Type: "remove", Table: "users", RowKey: "1|users", Context: map[string]int64{}, Dot: Dot{ClientID: "client", Version: 1}},
+	}}
+	second := SyncRequest{ClientID: "client", LastSeenServerVersion: -1, Operations: []CRDTOperation{
+		{Type: "remove", Table: "users|users", RowKey: "1", Context: map[string]int64{}, Dot: Dot{ClientID: "client", Version: 1}},
+	}}
+
+	for _, version := range []int{ProtocolV2, ProtocolV3} {
+		first.ProtocolVersion, second.ProtocolVersion = version, version
+		firstHash, firstErr := HashSyncRequest(first)
+		secondHash, secondErr := HashSyncRequest(second)
+		if firstErr != nil || secondErr != nil {
+			t.Fatalf("failed to hash: %v, %v", firstErr, secondErr)
+		}
+		if collides := firstHash == secondHash; collides != (version == ProtocolV2) {
+			t.Errorf("protocol %d: hashes collide = %v", version, collides)
+		}
+	}
+}
+
+func TestCanonicalHashIgnoresJSONFormatting(t *testing.T) {
+	request := func(value string) SyncRequest {
+		return SyncRequest{ProtocolVersion: ProtocolV3, ClientID: "client", LastSeenServerVersion: -1, Operations: []CRDTOperation{
+			{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(value), Dot: Dot{ClientID: "client", Version: 1}},
+		}}
+	}
+
+	compact, err := HashSyncRequest(request(`{"age":30,"name":"Alice"}`))
+	if err != nil {
+		t.Fatalf("failed to hash: %v", err)
+	}
+	reformatted, err := HashSyncRequest(request(`{ "name": "Alice", "age": 3.0e1 }`))
+	if err != nil {
+		t.Fatalf("failed to hash: %v", err)
+	}
+	if compact != reformatted {
+		t.Error("the hash should not depend on key order or formatting")
+	}
+}
+
+func TestSignSyncRequest(t *testing.T) {
+	req := SyncRequest{ProtocolVersion: ProtocolV3, ClientID: "test-client", LastSeenServerVersion: -1, Operations: []CRDTOperation{}}
+
+	unkeyed, _ := HashSyncRequest(req)
+	signed, _ := SignSyncRequest(req, []byte("key"))
+	otherKey, _ := SignSyncRequest(req, []byte("other key"))
+	if unkeyed == signed || signed == otherKey {
+		t.Error("the signature should depend on the key")
+	}
+
+	req.ProtocolVersion = ProtocolV2
+	_, err := SignSyncRequest(req, []byte("key"))
+	if syncErr, ok := err.(*SyncError); !ok || syncErr.Code != ErrUnsupportedProtocol {
+		t.Errorf("got %v, want %s for a key with an unkeyed protocol", err, ErrUnsupportedProtocol)
+	}
+}
+
+func TestSyncWithClientKeys(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	service := NewSyncService(repository.NewMemoryStore(), legacyConfig())
+	service.SetClientKeys(ClientKeysFunc(func(ctx context.Context, namespace string, clientID string) ([]byte, error) {
+		if clientID == "keyed-client" {
+			return key, nil
+		}
+		return nil, nil
+	}))
+
+	request := func(clientID string, version int, key []byte) SyncRequest {
+		req := SyncRequest{ProtocolVersion: version, ClientID: clientID, LastSeenServerVersion: -1, Operations: []CRDTOperation{}}
+		req.RequestHash, _ = SignSyncRequest(req, key)
+		return req
+	}
+
+	tests := []struct {
+		name     string
+		req      SyncRequest
+		wantCode SyncErrorCode
+	}{
+		{name: "signed", req: request("keyed-client", ProtocolV3, key)},
+		{name: "unsigned", req: request("keyed-client", ProtocolV3, nil), wantCode: ErrRequestIntegrity},
+		{name: "wrong key", req: request("keyed-client", ProtocolV3, []byte("guessed")), wantCode: ErrRequestIntegrity},
+		{name: "downgraded", req: request("keyed-client", ProtocolV2, nil), wantCode: ErrUnsupportedProtocol},
+		{name: "client without key", req: request("other-client", ProtocolV3, nil)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := service.Sync(context.Background(), tt.req)
+			if tt.wantCode != "" {
+				if syncErr, ok := err.(*SyncError); !ok || syncErr.Code != tt.wantCode {
+					t.Fatalf("got %v, want %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sync failed: %v", err)
+			}
+
+			clientKey, _ := service.clientKey(context.Background(), tt.req)
+			if want, _ := SignSyncResponse(*resp, clientKey); resp.ResponseHash != want {
+				t.Errorf("response hash = %q, want %q", resp.ResponseHash, want)
+			}
+		})
+	}
+}
+
+func TestParseClientKeys(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+	keys, err := ParseClientKeys([]byte(`{"clients": [
+		{"clientId": "a", "key": "` + key + `"},
+		{"namespace": "team-1", "clientId": "b", "key": "` + key + `"}
+	]}`))
+	if err != nil {
+		t.Fatalf("ParseClientKeys() error = %v", err)
+	}
+	if found, _ := keys.ClientKey(context.Background(), "team-1", "b"); len(found) != 32 {
+		t.Errorf("expected b's key in team-1, got %q", found)
+	}
+	if found, _ := keys.ClientKey(context.Background(), "team-1", "a"); found != nil {
+		t.Errorf("expected a to have no key in team-1, got %q", found)
+	}
+
+	invalid := []string{
+		`{"clients": [{"clientId": "a", "key": "c2hvcnQ="}]}`,
+		`{"clients": [{"key": "` + key + `"}]}`,
+		`{"clients": [{"clientId": "a", "key": "` + key + `"}, {"clientId": "a", "key": "` + key + `"}]}`,
+		`{"clients": [{"clientId": "a", "secret": "` + key + `"}]}`,
+	}
+	for _, data := range invalid {
+		if _, err := ParseClientKeys([]byte(data)); err == nil {
+			t.Errorf("expected an error for %s", data)
+		}
+	}
+}
+
 // -------------------- helper --------------------
 func stringPtr(s string) *string { return &s }
@@ -0,0 +1,309 @@
+package sync_engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/internal/logging"
+	"sync/internal/repository"
+)
+
+// The merge rules here mirror applyOperationToRow in the client
+// (packages/idb-distribute/src/crdt.ts). Both sides must fold operations
+// the same way or the server snapshot will diverge from client state.
+
+type LWWField struct {
+	Value     json.RawMessage `json:"value"`
+	Dot       Dot             `json:"dot"`
+	Encrypted bool            `json:"encrypted,omitempty"` // Value is ciphertext
+}
+
+type Tombstone struct {
+	Dot     Dot              `json:"dot"`
+	Context map[string]int64 `json:"context"` // Highest version seen per client at delete time
+}
+
+type MaterializedRow struct {
+	Namespace string              `json:"-"`
+	Table     string              `json:"table"`
+	RowKey    string              `json:"rowKey"`
+	Fields    map[string]LWWField `json:"fields"`
+	Tombstone *Tombstone          `json:"tombstone,omitempty"`
+
+	// Highest server version folded into this row
+	ServerVersion int64 `json:"serverVersion"`
+}
+
+// materializeBatchSize is the number of operations folded per round trip
+// when catching up the materialized rows with the operation log.
+const materializeBatchSize = 1000
+
+// newMaterializedRow returns an empty row that no operation has touched.
+func newMaterializedRow(table string, rowKey string) *MaterializedRow {
+	return &MaterializedRow{
+		Table:         table,
+		RowKey:        rowKey,
+		Fields:        make(map[string]LWWField),
+		ServerVersion: -1,
+	}
+}
+
+// applyOperation folds a single operation into a row.
+// Operations are idempotent and commutative, applying the same one twice
+// or in a different order results in the same row.
+func (row *MaterializedRow) applyOperation(op CRDTOperation) error {
+	switch op.Type {
+	case "set":
+		if op.Field == nil || *op.Field == "" {
+			return fmt.Errorf("set operation is missing field")
+		}
+		if row.dominatedByTombstone(op.Dot) {
+			return nil
+		}
+		row.setField(*op.Field, LWWField{Value: op.Value, Dot: op.Dot, Encrypted: op.Encrypted})
+
+	case "setRow":
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &fields); err != nil || fields == nil {
+			return fmt.Errorf("setRow operation value must be a JSON object")
+		}
+		if row.dominatedByTombstone(op.Dot) {
+			return nil
+		}
+		for field, value := range fields {
+			row.setField(field, LWWField{Value: value, Dot: op.Dot, Encrypted: op.Encrypted})
+		}
+
+	case "remove":
+		tombstone := Tombstone{Dot: op.Dot, Context: make(map[string]int64, len(op.Context))}
+		for clientID, version := range op.Context {
+			tombstone.Context[clientID] = version
+		}
+
+		// Concurrent removes: LWW on the dot and merge the contexts so the
+		// resulting tombstone dominates every write either remove observed
+		if row.Tombstone != nil {
+			if compareDots(row.Tombstone.Dot, tombstone.Dot) >= 0 {
+				tombstone.Dot = row.Tombstone.Dot
+			}
+			for clientID, version := range row.Tombstone.Context {
+				if existing, ok := tombstone.Context[clientID]; !ok || version > existing {
+					tombstone.Context[clientID] = version
+				}
+			}
+		}
+
+		// Keep only fields not dominated by the merged tombstone
+		for field, state := range row.Fields {
+			seen, ok := tombstone.Context[state.Dot.ClientID]
+			if ok && state.Dot.Version <= seen {
+				delete(row.Fields, field)
+			}
+		}
+		row.Tombstone = &tombstone
+
+	default:
+		return fmt.Errorf("unknown operation type %q", op.Type)
+	}
+
+	return nil
+}
+
+// dominatedByTombstone reports whether the row's tombstone has already
+// observed the given dot, in which case the delete wins over the write.
+func (row *MaterializedRow) dominatedByTombstone(dot Dot) bool {
+	if row.Tombstone == nil {
+		return false
+	}
+	seen, ok := row.Tombstone.Context[dot.ClientID]
+	return ok && dot.Version <= seen
+}
+
+// setField applies last-writer-wins to a single field.
+func (row *MaterializedRow) setField(field string, state LWWField) {
+	existing, ok := row.Fields[field]
+	if !ok {
+		row.Fields[field] = state
+		return
+	}
+
+	cmp := compareDots(state.Dot, existing.Dot)
+	// Equal dots use the value as tiebreaker for deterministic convergence
+	if cmp > 0 || (cmp == 0 && compareValues(state.Value, existing.Value) > 0) {
+		row.Fields[field] = state
+	}
+}
+
+// compareDots orders dots by version and then by client ID.
+func compareDots(a Dot, b Dot) int {
+	if a.Version != b.Version {
+		if a.Version < b.Version {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.ClientID, b.ClientID)
+}
+
+// compareValues orders JSON values by their compact serialization,
+// matching JSON.stringify on the client.
+func compareValues(a json.RawMessage, b json.RawMessage) int {
+	return strings.Compare(compactJSON(a), compactJSON(b))
+}
+
+func compactJSON(raw json.RawMessage) string {
+	var buffer bytes.Buffer
+	if err := json.Compact(&buffer, raw); err != nil {
+		return string(raw)
+	}
+	return buffer.String()
+}
+
+// errInapplicableOperation marks operations that can't be folded into their
+// row, any other materialization error comes from the store.
+var errInapplicableOperation = errors.New("operation can't be applied to its row")
+
+// materializeOperations folds operations in a namespace into their materialized rows.
+// serverVersions holds the server version assigned to each operation.
+func materializeOperations(ctx context.Context, tx repository.StoreTx, namespace string, ops []CRDTOperation, serverVersions []int64) error {
+	rows := make(map[[2]string]*MaterializedRow)
+	var order [][2]string
+
+	for i, op := range ops {
+		key := [2]string{op.Table, op.RowKey}
+		row, ok := rows[key]
+		if !ok {
+			dbRow, err := tx.GetMaterializedRow(ctx, namespace, op.Table, op.RowKey)
+			if err != nil {
+				return err
+			}
+			if dbRow == nil {
+				row = newMaterializedRow(op.Table, op.RowKey)
+				row.Namespace = namespace
+			} else if row, err = fromDatabaseRow(dbRow); err != nil {
+				return err
+			}
+			rows[key] = row
+			order = append(order, key)
+		}
+
+		if err := row.applyOperation(op); err != nil {
+			return fmt.Errorf("%w (clientID=%s, version=%d, table=%s, rowKey=%s): %w",
+				errInapplicableOperation, op.Dot.ClientID, op.Dot.Version, op.Table, op.RowKey, err)
+		}
+		row.ServerVersion = max(row.ServerVersion, serverVersions[i])
+	}
+
+	for _, key := range order {
+		dbRow, err := rows[key].toDatabaseRow()
+		if err != nil {
+			return err
+		}
+		if err := tx.UpsertMaterializedRow(ctx, dbRow); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CatchUpMaterializedRows folds every operation in the log that isn't
+// reflected in the materialized rows yet. This covers databases created
+// before materialization existed. Operations that can't be applied are
+// logged and skipped so a single bad operation can't block startup.
+func (sync_service *SyncService) CatchUpMaterializedRows(ctx context.Context) error {
+	var since int64
+	err := sync_service.withTx(ctx, true, func(tx repository.StoreTx) (err error) {
+		since, err = tx.GetMaxMaterializedServerVersion(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		tx, err := sync_service.store.Begin(ctx, false)
+		if err != nil {
+			return err
+		}
+
+		dbOperations, err := tx.GetAllCRDTOperationsSince(ctx, since, materializeBatchSize)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to get operations to materialize: %w", err)
+		}
+		if len(dbOperations) == 0 {
+			return tx.Rollback()
+		}
+
+		for _, dbOperation := range dbOperations {
+			op, err := fromDatabaseOperation(dbOperation)
+			if err == nil {
+				err = materializeOperations(ctx, tx, dbOperation.Namespace, []CRDTOperation{op}, []int64{dbOperation.ServerVersion})
+			}
+			if err != nil {
+				logging.FromContext(ctx).Warn("Skipping operation while materializing",
+					"server_version", dbOperation.ServerVersion, "error", err)
+			}
+			since = dbOperation.ServerVersion
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit materialized rows: %w", err)
+		}
+	}
+}
+
+func (row *MaterializedRow) toDatabaseRow() (*repository.DBMaterializedRow, error) {
+	fields, err := json.Marshal(row.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal fields for row (table=%s, rowKey=%s): %w", row.Table, row.RowKey, err)
+	}
+
+	var tombstone *string
+	if row.Tombstone != nil {
+		encoded, err := json.Marshal(row.Tombstone)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal tombstone for row (table=%s, rowKey=%s): %w", row.Table, row.RowKey, err)
+		}
+		str := string(encoded)
+		tombstone = &str
+	}
+
+	return &repository.DBMaterializedRow{
+		Namespace:     row.Namespace,
+		TableName:     row.Table,
+		RowKey:        row.RowKey,
+		Fields:        string(fields),
+		Tombstone:     tombstone,
+		ServerVersion: row.ServerVersion,
+	}, nil
+}
+
+func fromDatabaseRow(dbRow *repository.DBMaterializedRow) (*MaterializedRow, error) {
+	row := &MaterializedRow{
+		Namespace:     dbRow.Namespace,
+		Table:         dbRow.TableName,
+		RowKey:        dbRow.RowKey,
+		ServerVersion: dbRow.ServerVersion,
+	}
+
+	if err := json.Unmarshal([]byte(dbRow.Fields), &row.Fields); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal fields for row (table=%s, rowKey=%s): %w", dbRow.TableName, dbRow.RowKey, err)
+	}
+	if row.Fields == nil {
+		row.Fields = make(map[string]LWWField)
+	}
+
+	if dbRow.Tombstone != nil {
+		row.Tombstone = &Tombstone{}
+		if err := json.Unmarshal([]byte(*dbRow.Tombstone), row.Tombstone); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal tombstone for row (table=%s, rowKey=%s): %w", dbRow.TableName, dbRow.RowKey, err)
+		}
+	}
+
+	return row, nil
+}
@@ -0,0 +1,225 @@
+package sync_engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/internal/repository"
+	"testing"
+)
+
+// -------------------- Merge tests --------------------
+
+func TestApplyOperation(t *testing.T) {
+	tests := []struct {
+		name       string
+		operations []CRDTOperation
+		wantFields map[string]string
+	}{
+		{
+			name: "higher dot wins",
+			operations: []CRDTOperation{
+				{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Bob"`), Dot: Dot{ClientID: "a", Version: 2}},
+				{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Alice"`), Dot: Dot{ClientID: "b", Version: 1}},
+			},
+			wantFields: map[string]string{"name": `"Bob"`},
+		},
+		{
+			name: "setRow merges with existing fields",
+			operations: []CRDTOperation{
+				{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("age"), Value: json.RawMessage(`30`), Dot: Dot{ClientID: "a", Version: 1}},
+				{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`{"name":"Alice"}`), Dot: Dot{ClientID: "b", Version: 2}},
+			},
+			wantFields: map[string]string{"age": `30`, "name": `"Alice"`},
+		},
+		{
+			name: "remove drops observed fields",
+			operations: []CRDTOperation{
+				{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`{"name":"Alice"}`), Dot: Dot{ClientID: "a", Version: 1}},
+				{Type: "remove", Table: "users", RowKey: "1", Context: map[string]int64{"a": 1}, Dot: Dot{ClientID: "b", Version: 2}},
+			},
+			wantFields: map[string]string{},
+		},
+		{
+			name: "late write observed by remove does not resurrect",
+			operations: []CRDTOperation{
+				{Type: "remove", Table: "users", RowKey: "1", Context: map[string]int64{"a": 3}, Dot: Dot{ClientID: "b", Version: 4}},
+				{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Alice"`), Dot: Dot{ClientID: "a", Version: 3}},
+			},
+			wantFields: map[string]string{},
+		},
+		{
+			name: "concurrent write survives remove",
+			operations: []CRDTOperation{
+				{Type: "remove", Table: "users", RowKey: "1", Context: map[string]int64{"a": 1}, Dot: Dot{ClientID: "b", Version: 2}},
+				{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Alice"`), Dot: Dot{ClientID: "a", Version: 2}},
+			},
+			wantFields: map[string]string{"name": `"Alice"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Apply in both orders, the result must converge
+			forward := newMaterializedRow("users", "1")
+			backward := newMaterializedRow("users", "1")
+			for i := range tt.operations {
+				if err := forward.applyOperation(tt.operations[i]); err != nil {
+					t.Fatalf("applyOperation() error = %v", err)
+				}
+				if err := backward.applyOperation(tt.operations[len(tt.operations)-1-i]); err != nil {
+					t.Fatalf("applyOperation() error = %v", err)
+				}
+			}
+
+			for _, row := range []*MaterializedRow{forward, backward} {
+				if len(row.Fields) != len(tt.wantFields) {
+					t.Fatalf("expected fields %v, got %v", tt.wantFields, row.Fields)
+				}
+				for field, want := range tt.wantFields {
+					if got := string(row.Fields[field].Value); got != want {
+						t.Errorf("field %q = %s, want %s", field, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestApplyOperationRejectsInvalid(t *testing.T) {
+	row := newMaterializedRow("users", "1")
+
+	invalid := []CRDTOperation{
+		{Type: "set", Table: "users", RowKey: "1", Value: json.RawMessage(`"Alice"`), Dot: Dot{ClientID: "a", Version: 1}},
+		{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`"Alice"`), Dot: Dot{ClientID: "a", Version: 1}},
+		{Type: "unknown", Table: "users", RowKey: "1", Dot: Dot{ClientID: "a", Version: 1}},
+	}
+	for _, op := range invalid {
+		if err := row.applyOperation(op); err == nil {
+			t.Errorf("expected error for %s operation", op.Type)
+		}
+	}
+}
+
+// -------------------- Snapshot tests --------------------
+
+func TestSnapshotReflectsSyncedOperations(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	client := "11111111-1111-1111-1111-111111111111"
+	if _, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID: client,
+		Operations: []CRDTOperation{
+			{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`{"name":"Alice"}`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 1}},
+			{Type: "set", Table: "posts", RowKey: "p1", Field: stringPtr("title"), Value: json.RawMessage(`"Hello"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 2}},
+			{Type: "remove", Table: "posts", RowKey: "p1", Context: map[string]int64{client: 2}, Dot: Dot{ClientID: client, Version: 3}},
+		},
+		LastSeenServerVersion: -1,
+	})); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	snapshot, err := service.Snapshot(ctx, "", "")
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if snapshot.ServerVersion != 3 {
+		t.Errorf("expected server version 3, got %d", snapshot.ServerVersion)
+	}
+	if len(snapshot.Rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(snapshot.Rows))
+	}
+
+	// Ordered by table name, posts before users
+	posts, users := snapshot.Rows[0], snapshot.Rows[1]
+	if len(posts.Fields) != 0 || posts.Tombstone == nil {
+		t.Errorf("expected removed post with tombstone, got %+v", posts)
+	}
+	if string(users.Fields["name"].Value) != `"Alice"` {
+		t.Errorf("expected user name Alice, got %s", users.Fields["name"].Value)
+	}
+
+	filtered, err := service.Snapshot(ctx, "", "users")
+	if err != nil {
+		t.Fatalf("filtered snapshot failed: %v", err)
+	}
+	if len(filtered.Rows) != 1 || filtered.Rows[0].Table != "users" {
+		t.Fatalf("expected only the users row, got %+v", filtered.Rows)
+	}
+
+	// Filtered snapshots resume from the end of the whole log, the row
+	// reports the version of the last operation folded into it
+	if filtered.ServerVersion != 3 {
+		t.Errorf("expected filtered server version 3, got %d", filtered.ServerVersion)
+	}
+	if filtered.Rows[0].ServerVersion != 1 {
+		t.Errorf("expected users row server version 1, got %d", filtered.Rows[0].ServerVersion)
+	}
+}
+
+func TestSnapshotHoldsStoredValues(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	client := "11111111-1111-1111-1111-111111111111"
+	if _, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID: client,
+		Operations: []CRDTOperation{
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("profile"), Value: json.RawMessage(`{ "b": 1, "a": 2.0 }`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 1}},
+		},
+		LastSeenServerVersion: -1,
+	})); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	// The row is folded from the canonical form stored in the log, the
+	// same value a rebuild from the log would produce
+	snapshot, err := service.Snapshot(ctx, "", "users")
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if len(snapshot.Rows) != 1 {
+		t.Fatalf("expected 1 row, got %d", len(snapshot.Rows))
+	}
+	if got := string(snapshot.Rows[0].Fields["profile"].Value); got != `{"a":2,"b":1}` {
+		t.Errorf("profile = %s, want the canonical form", got)
+	}
+}
+
+// failingRowStore fails every write of a materialized row.
+type failingRowStore struct {
+	repository.OperationStore
+}
+
+type failingRowTx struct {
+	repository.StoreTx
+}
+
+func (store failingRowStore) Begin(ctx context.Context, readOnly bool) (repository.StoreTx, error) {
+	tx, err := store.OperationStore.Begin(ctx, readOnly)
+	return failingRowTx{tx}, err
+}
+
+func (failingRowTx) UpsertMaterializedRow(context.Context, *repository.DBMaterializedRow) error {
+	return errors.New("disk I/O error")
+}
+
+func TestMaterializeStoreErrors(t *testing.T) {
+	service := NewSyncService(failingRowStore{repository.NewMemoryStore()}, legacyConfig())
+
+	client := "11111111-1111-1111-1111-111111111111"
+	_, err := service.Sync(context.Background(), signedRequest(t, SyncRequest{
+		ClientID: client,
+		Operations: []CRDTOperation{
+			{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`{"name":"Alice"}`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 1}},
+		},
+		LastSeenServerVersion: -1,
+	}))
+
+	// A failing store isn't the client's fault
+	var syncErr *SyncError
+	if !errors.As(err, &syncErr) || syncErr.Code != ErrDatabaseError {
+		t.Errorf("expected %s, got %v", ErrDatabaseError, err)
+	}
+}
@@ -0,0 +1,51 @@
+package sync_engine
+
+import (
+	"errors"
+	"sync/internal/metrics"
+	"time"
+)
+
+var (
+	syncRequests = metrics.NewCounterVec(
+		"sync_requests_total",
+		"Sync requests by outcome (success or error) and error code.",
+		"outcome", "code",
+	)
+	syncDuration = metrics.NewHistogram(
+		"sync_duration_seconds",
+		"Time spent processing a sync request.",
+		metrics.DefaultBuckets,
+	)
+	operationsInserted = metrics.NewCounter(
+		"sync_operations_inserted_total",
+		"Operations persisted for the first time.",
+	)
+	duplicateOperations = metrics.NewCounter(
+		"sync_duplicate_operations_total",
+		"Retried operations that were already persisted with identical data.",
+	)
+	operationsReturned = metrics.NewHistogram(
+		"sync_operations_returned",
+		"Unseen operations returned per sync response.",
+		[]float64{0, 1, 10, 50, 100, 250, 500, 1000, 2500, 5000},
+	)
+)
+
+// recordSync updates the sync metrics once a request has finished.
+func recordSync(resp *SyncResponse, err error, duration time.Duration) {
+	syncDuration.Observe(duration.Seconds())
+
+	if err != nil {
+		code := ErrInternal
+		var syncErr *SyncError
+		if errors.As(err, &syncErr) {
+			code = syncErr.Code
+		}
+		syncRequests.WithLabelValues("error", string(code)).Inc()
+		return
+	}
+
+	syncRequests.WithLabelValues("success", "").Inc()
+	operationsReturned.Observe(float64(len(resp.Operations)))
+}
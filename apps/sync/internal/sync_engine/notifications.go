@@ -0,0 +1,106 @@
+package sync_engine
+
+import "sync"
+
+// notificationBuffer is how many notifications a subscriber can fall behind
+// before new ones are dropped. Notifications only tell clients to sync, so a
+// dropped one is covered by any later one.
+const notificationBuffer = 16
+
+// SyncNotification tells subscribers that new operations were committed.
+// Clients react by syncing, the operations themselves still travel over /sync
+// so they keep their ordering and integrity guarantees.
+type SyncNotification struct {
+	LatestServerVersion int64  `json:"latestServerVersion"`
+	ClientID            string `json:"clientId"` // Client that sent the operations
+	OperationCount      int    `json:"operationCount"`
+}
+
+// NotificationHub fans out notifications to subscribers of a namespace.
+type NotificationHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan SyncNotification]struct{}
+	closed      bool
+}
+
+func NewNotificationHub() *NotificationHub {
+	return &NotificationHub{
+		subscribers: make(map[string]map[chan SyncNotification]struct{}),
+	}
+}
+
+// Subscribe registers for notifications in a namespace.
+// The returned function unsubscribes and closes the channel, it must be called.
+// Once the hub is closed the channel is closed right away.
+func (hub *NotificationHub) Subscribe(namespace string) (<-chan SyncNotification, func()) {
+	channel := make(chan SyncNotification, notificationBuffer)
+
+	hub.mu.Lock()
+	if hub.closed {
+		hub.mu.Unlock()
+		close(channel)
+		return channel, func() {}
+	}
+	if hub.subscribers[namespace] == nil {
+		hub.subscribers[namespace] = make(map[chan SyncNotification]struct{})
+	}
+	hub.subscribers[namespace][channel] = struct{}{}
+	hub.mu.Unlock()
+
+	// Close may have closed the channel already
+	unsubscribe := func() {
+		hub.mu.Lock()
+		defer hub.mu.Unlock()
+
+		if _, ok := hub.subscribers[namespace][channel]; !ok {
+			return
+		}
+		delete(hub.subscribers[namespace], channel)
+		if len(hub.subscribers[namespace]) == 0 {
+			delete(hub.subscribers, namespace)
+		}
+		close(channel)
+	}
+
+	return channel, unsubscribe
+}
+
+// Close ends every subscription by closing its channel.
+func (hub *NotificationHub) Close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.closed = true
+	for _, channels := range hub.subscribers {
+		for channel := range channels {
+			close(channel)
+		}
+	}
+	hub.subscribers = make(map[string]map[chan SyncNotification]struct{})
+}
+
+// Publish sends a notification to every subscriber of a namespace without blocking.
+// Subscribers whose buffer is full miss the notification.
+func (hub *NotificationHub) Publish(namespace string, notification SyncNotification) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for channel := range hub.subscribers[namespace] {
+		select {
+		case channel <- notification:
+		default:
+		}
+	}
+}
+
+// SubscriberCount returns the number of subscribers across all namespaces.
+func (hub *NotificationHub) SubscriberCount() int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	count := 0
+	for _, channels := range hub.subscribers {
+		count += len(channels)
+	}
+	return count
+}
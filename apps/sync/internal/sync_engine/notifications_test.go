@@ -0,0 +1,130 @@
+package sync_engine
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// -------------------- Notification tests --------------------
+
+func TestNotificationHub(t *testing.T) {
+	hub := NewNotificationHub()
+
+	tenantA, unsubscribeA := hub.Subscribe("tenant-a")
+	tenantB, unsubscribeB := hub.Subscribe("tenant-b")
+	defer unsubscribeB()
+
+	hub.Publish("tenant-a", SyncNotification{LatestServerVersion: 1})
+
+	select {
+	case notification := <-tenantA:
+		if notification.LatestServerVersion != 1 {
+			t.Errorf("expected server version 1, got %d", notification.LatestServerVersion)
+		}
+	default:
+		t.Fatalf("expected notification in tenant-a")
+	}
+	select {
+	case notification := <-tenantB:
+		t.Fatalf("unexpected notification in tenant-b: %+v", notification)
+	default:
+	}
+
+	// A slow subscriber must never block publishing
+	for i := 0; i < notificationBuffer*2; i++ {
+		hub.Publish("tenant-a", SyncNotification{LatestServerVersion: int64(i)})
+	}
+	if len(tenantA) != notificationBuffer {
+		t.Errorf("expected %d buffered notifications, got %d", notificationBuffer, len(tenantA))
+	}
+
+	unsubscribeA()
+	unsubscribeA() // Safe to call twice
+	if hub.SubscriberCount() != 1 {
+		t.Errorf("expected 1 subscriber left, got %d", hub.SubscriberCount())
+	}
+}
+
+func TestNotificationHubClose(t *testing.T) {
+	hub := NewNotificationHub()
+
+	notifications, unsubscribe := hub.Subscribe("")
+	hub.Close()
+	if _, ok := <-notifications; ok {
+		t.Errorf("expected the channel to be closed")
+	}
+	// Unsubscribing after Close must not close the channel again
+	unsubscribe()
+
+	late, unsubscribeLate := hub.Subscribe("")
+	defer unsubscribeLate()
+	if _, ok := <-late; ok {
+		t.Errorf("expected subscriptions after Close to be closed")
+	}
+	if count := hub.SubscriberCount(); count != 0 {
+		t.Errorf("expected no subscribers, got %d", count)
+	}
+}
+
+func TestSyncPublishesNotification(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	notifications, unsubscribe := service.Subscribe("")
+	defer unsubscribe()
+
+	client := "11111111-1111-1111-1111-111111111111"
+	if _, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID:              client,
+		Operations:            []CRDTOperation{},
+		LastSeenServerVersion: -1,
+	})); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if len(notifications) != 0 {
+		t.Fatalf("expected no notification for a sync without operations")
+	}
+
+	req := SyncRequest{
+		ClientID: client,
+		Operations: []CRDTOperation{
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Alice"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 1}},
+		},
+		LastSeenServerVersion: -1,
+	}
+	if _, err := service.Sync(ctx, signedRequest(t, req)); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	select {
+	case notification := <-notifications:
+		if notification.ClientID != client || notification.OperationCount != 1 || notification.LatestServerVersion != 1 {
+			t.Errorf("unexpected notification %+v", notification)
+		}
+	default:
+		t.Fatalf("expected notification after committing operations")
+	}
+
+	// A retry stores nothing new, the other clients have nothing to fetch
+	if _, err := service.Sync(ctx, signedRequest(t, req)); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if len(notifications) != 0 {
+		t.Errorf("expected no notification for a retry, got %+v", <-notifications)
+	}
+
+	// Only the new operations of a partial retry are counted
+	req.Operations = append(req.Operations, CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Bob"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 2}})
+	if _, err := service.Sync(ctx, signedRequest(t, req)); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	select {
+	case notification := <-notifications:
+		if notification.OperationCount != 1 || notification.LatestServerVersion != 2 {
+			t.Errorf("unexpected notification %+v", notification)
+		}
+	default:
+		t.Fatalf("expected notification for the new operation")
+	}
+}
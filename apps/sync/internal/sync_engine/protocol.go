@@ -0,0 +1,101 @@
+package sync_engine
+
+import (
+	"maps"
+	"slices"
+)
+
+// Protocol versions the server speaks. Old clients keep running from PWA
+// caches long after a release, so a version is only removed once no client
+// uses it anymore.
+const (
+	// ProtocolV1 is the original protocol. Its request hash leaves out the
+	// context of remove operations and neither hash covers the version.
+	ProtocolV1 = 1
+
+	// ProtocolV2 prefixes both hashes with the protocol version, so a
+	// request can't be replayed as another version, and covers the context
+	// of remove operations in the request hash.
+	ProtocolV2 = 2
+
+	// ProtocolV3 hashes a length-prefixed canonical encoding instead of
+	// fields joined with |. Clients with a signing key use HMAC-SHA256 with
+	// it, which proves who sent a request, see ClientKeys.
+	ProtocolV3 = 3
+
+	// ProtocolV4 covers whether an operation is encrypted in both hashes,
+	// so the flag can't be flipped in transit. Encrypted operations need it.
+	ProtocolV4 = 4
+
+	// CurrentProtocolVersion is the version new clients should speak.
+	CurrentProtocolVersion = ProtocolV4
+)
+
+// protocol holds what differs between protocol versions.
+type protocol struct {
+	hashRequest  func(req SyncRequest, key []byte) (string, error)
+	hashResponse func(resp SyncResponse, key []byte) (string, error)
+
+	// keyed protocols hash with the client's key when it has one
+	keyed bool
+}
+
+var protocols = map[int]protocol{
+	ProtocolV1: {hashRequest: hashSyncRequestV1, hashResponse: hashSyncResponseV1},
+	ProtocolV2: {hashRequest: hashSyncRequestV2, hashResponse: hashSyncResponseV2},
+	ProtocolV3: {hashRequest: hashSyncRequestV3, hashResponse: hashSyncResponseV3, keyed: true},
+	ProtocolV4: {hashRequest: hashSyncRequestV4, hashResponse: hashSyncResponseV4, keyed: true},
+}
+
+// SupportedProtocolVersions lists the protocol versions the server accepts, oldest first.
+func SupportedProtocolVersions() []int {
+	return slices.Sorted(maps.Keys(protocols))
+}
+
+// effectiveProtocolVersion treats a missing version as ProtocolV1, the
+// version clients spoke before they sent one.
+func effectiveProtocolVersion(version int) int {
+	if version == 0 {
+		return ProtocolV1
+	}
+	return version
+}
+
+// CheckProtocolVersion returns an ErrUnsupportedProtocol error listing the
+// supported versions when version isn't one of them.
+func CheckProtocolVersion(version int) error {
+	_, err := lookupProtocol(version)
+	return err
+}
+
+func lookupProtocol(version int) (protocol, error) {
+	protocol, ok := protocols[effectiveProtocolVersion(version)]
+	if !ok {
+		syncErr := NewSyncErrorf(ErrUnsupportedProtocol, "protocol version %d is not supported, the server speaks versions %v",
+			version, SupportedProtocolVersions())
+		syncErr.SupportedProtocolVersions = SupportedProtocolVersions()
+		return protocol, syncErr
+	}
+	return protocol, nil
+}
+
+// lookupKeyedProtocol is lookupProtocol for a client with key. Clients that
+// have a key must use it, falling back to an unkeyed protocol would let
+// anyone sign requests in their name.
+func lookupKeyedProtocol(version int, key []byte) (protocol, error) {
+	protocol, err := lookupProtocol(version)
+	if err != nil || key == nil || protocol.keyed {
+		return protocol, err
+	}
+
+	var keyedVersions []int
+	for _, supported := range SupportedProtocolVersions() {
+		if protocols[supported].keyed {
+			keyedVersions = append(keyedVersions, supported)
+		}
+	}
+	syncErr := NewSyncErrorf(ErrUnsupportedProtocol, "clients with a signing key must speak one of the protocol versions %v, got %d",
+		keyedVersions, effectiveProtocolVersion(version))
+	syncErr.SupportedProtocolVersions = keyedVersions
+	return protocol, syncErr
+}
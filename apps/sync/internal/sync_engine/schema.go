@@ -0,0 +1,237 @@
+package sync_engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// FieldType is the JSON type a field value must have.
+type FieldType string
+
+const (
+	FieldTypeString  FieldType = "string"
+	FieldTypeNumber  FieldType = "number"
+	FieldTypeInteger FieldType = "integer" // A number with an integral value within ±2^53, 1.0 and 1e3 included
+	FieldTypeBoolean FieldType = "boolean"
+	FieldTypeObject  FieldType = "object"
+	FieldTypeArray   FieldType = "array"
+	FieldTypeAny     FieldType = "any"
+)
+
+// maxSafeInteger is 2^53, clients decode numbers as doubles and can't hold
+// every integer above it.
+const maxSafeInteger = 1 << 53
+
+// FieldSchema describes a single field of a table.
+type FieldSchema struct {
+	Type FieldType `json:"type"`
+
+	// Required fields must be part of every setRow on the table.
+	// Fields are merged one by one, so a set can't drop a field, but it
+	// can't write null to a required field either.
+	Required bool `json:"required,omitempty"`
+
+	// Nullable allows null in addition to Type.
+	Nullable bool `json:"nullable,omitempty"`
+}
+
+// TableSchema lists the fields a table allows.
+type TableSchema struct {
+	Name   string                 `json:"name"`
+	Fields map[string]FieldSchema `json:"fields"`
+}
+
+// SchemaRegistry holds the schemas operations are checked against.
+// An empty registry accepts every operation. As soon as a table is
+// registered, operations on tables without a schema are rejected.
+type SchemaRegistry struct {
+	mu     sync.RWMutex
+	tables map[string]TableSchema
+}
+
+// NewSchemaRegistry creates an empty registry.
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{tables: make(map[string]TableSchema)}
+}
+
+// ParseTableSchemas reads table schemas from JSON of the form
+//
+//	{"tables": [{"name": "users", "fields": {"name": {"type": "string", "required": true}}}]}
+func ParseTableSchemas(data []byte) ([]TableSchema, error) {
+	var document struct {
+		Tables []TableSchema `json:"tables"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("failed to parse table schemas: %w", err)
+	}
+	return document.Tables, nil
+}
+
+// Register adds or replaces the schema of a table.
+func (registry *SchemaRegistry) Register(schema TableSchema) error {
+	if schema.Name == "" {
+		return fmt.Errorf("table schema needs a name")
+	}
+	for field, fieldSchema := range schema.Fields {
+		switch fieldSchema.Type {
+		case FieldTypeString, FieldTypeNumber, FieldTypeInteger, FieldTypeBoolean, FieldTypeObject, FieldTypeArray, FieldTypeAny:
+		default:
+			return fmt.Errorf("table %s field %q has unknown type %q", schema.Name, field, fieldSchema.Type)
+		}
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.tables[schema.Name] = schema
+	return nil
+}
+
+// Tables returns every registered schema ordered by table name.
+func (registry *SchemaRegistry) Tables() []TableSchema {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	tables := make([]TableSchema, 0, len(registry.tables))
+	for _, schema := range registry.tables {
+		tables = append(tables, schema)
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Name < tables[j].Name })
+	return tables
+}
+
+// validateOperations checks every operation against the schema of its table
+// and returns one error per operation that doesn't conform.
+// Operations must already have passed validateOperation.
+func (registry *SchemaRegistry) validateOperations(ops []CRDTOperation) []OperationError {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	if len(registry.tables) == 0 {
+		return nil
+	}
+
+	var invalid []OperationError
+	for i, op := range ops {
+		if field, reason := registry.validateOperation(op); reason != "" {
+			invalid = append(invalid, OperationError{Index: i, Dot: op.Dot, Field: field, Reason: reason})
+		}
+	}
+	return invalid
+}
+
+// validateOperation returns the offending field, if any, and why the operation
+// doesn't conform. An empty reason means the operation is valid.
+func (registry *SchemaRegistry) validateOperation(op CRDTOperation) (string, string) {
+	schema, ok := registry.tables[op.Table]
+	if !ok {
+		return "", fmt.Sprintf("table %q is not registered", op.Table)
+	}
+	if op.Encrypted {
+		// Neither field names nor values can be read
+		return "", ""
+	}
+
+	switch op.Type {
+	case "set":
+		if reason := schema.validateField(*op.Field, op.Value); reason != "" {
+			return *op.Field, reason
+		}
+	case "setRow":
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &fields); err != nil {
+			return "", "setRow value must be a JSON object"
+		}
+
+		// Sorted so the same operation always reports the same field
+		names := make([]string, 0, len(schema.Fields))
+		for name := range schema.Fields {
+			names = append(names, name)
+		}
+		for name := range fields {
+			if _, ok := schema.Fields[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			value, present := fields[name]
+			if !present {
+				if schema.Fields[name].Required {
+					return name, "required field is missing"
+				}
+				continue
+			}
+			if reason := schema.validateField(name, value); reason != "" {
+				return name, reason
+			}
+		}
+	}
+
+	return "", ""
+}
+
+// validateField returns why a value can't be written to a field, or an empty string.
+func (schema TableSchema) validateField(name string, value json.RawMessage) string {
+	fieldSchema, ok := schema.Fields[name]
+	if !ok {
+		return fmt.Sprintf("field is not part of table %q", schema.Name)
+	}
+
+	actual := jsonTypeOf(value)
+	if actual == "null" {
+		if fieldSchema.Nullable && !fieldSchema.Required {
+			return ""
+		}
+		return "field is not nullable"
+	}
+	if !fieldSchema.accepts(actual, value) {
+		return fmt.Sprintf("expected %s, got %s", fieldSchema.Type, actual)
+	}
+	return ""
+}
+
+func (fieldSchema FieldSchema) accepts(actual string, value json.RawMessage) bool {
+	switch fieldSchema.Type {
+	case FieldTypeAny:
+		return true
+	case FieldTypeInteger:
+		var number float64
+		if actual != "number" || json.Unmarshal(value, &number) != nil {
+			return false
+		}
+		return number == math.Trunc(number) && math.Abs(number) <= maxSafeInteger
+	default:
+		return actual == string(fieldSchema.Type)
+	}
+}
+
+// jsonTypeOf returns the JSON type of a valid JSON value:
+// string, number, boolean, object, array or null.
+func jsonTypeOf(value json.RawMessage) string {
+	trimmed := bytes.TrimSpace(value)
+	if len(trimmed) == 0 {
+		return "null"
+	}
+
+	switch trimmed[0] {
+	case '"':
+		return "string"
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	default:
+		return "number"
+	}
+}
@@ -0,0 +1,141 @@
+package sync_engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// -------------------- Schema tests --------------------
+
+const testTableSchemas = `{
+	"tables": [
+		{
+			"name": "users",
+			"fields": {
+				"id": {"type": "integer", "required": true},
+				"name": {"type": "string", "required": true},
+				"email": {"type": "string"},
+				"bio": {"type": "string", "nullable": true},
+				"joinDate": {"type": "number"},
+				"metadata": {"type": "object"}
+			}
+		},
+		{
+			"name": "posts",
+			"fields": {
+				"id": {"type": "string", "required": true},
+				"content": {"type": "string", "required": true},
+				"tags": {"type": "array"},
+				"extra": {"type": "any"}
+			}
+		}
+	]
+}`
+
+func newTestSchemaRegistry(t *testing.T) *SchemaRegistry {
+	t.Helper()
+
+	schemas, err := ParseTableSchemas([]byte(testTableSchemas))
+	if err != nil {
+		t.Fatalf("ParseTableSchemas() error = %v", err)
+	}
+	registry := NewSchemaRegistry()
+	for _, schema := range schemas {
+		if err := registry.Register(schema); err != nil {
+			t.Fatalf("Register() error = %v", err)
+		}
+	}
+	return registry
+}
+
+func TestSchemaRegistryValidateOperation(t *testing.T) {
+	registry := newTestSchemaRegistry(t)
+	dot := Dot{ClientID: "a", Version: 1}
+
+	tests := []struct {
+		name      string
+		op        CRDTOperation
+		wantField string
+		wantErr   bool
+	}{
+		{name: "valid set", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("email"), Value: json.RawMessage(`"a@example.com"`), Dot: dot}},
+		{name: "valid setRow", op: CRDTOperation{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`{"id":1,"name":"Alice","metadata":{"a":1}}`), Dot: dot}},
+		{name: "nullable field", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("bio"), Value: json.RawMessage(`null`), Dot: dot}},
+		{name: "any field", op: CRDTOperation{Type: "set", Table: "posts", RowKey: "p1", Field: stringPtr("extra"), Value: json.RawMessage(`[1,"a"]`), Dot: dot}},
+		{name: "remove on known table", op: CRDTOperation{Type: "remove", Table: "posts", RowKey: "p1", Context: map[string]int64{}, Dot: dot}},
+		{name: "unknown table", op: CRDTOperation{Type: "remove", Table: "comments", RowKey: "c1", Context: map[string]int64{}, Dot: dot}, wantErr: true},
+		{name: "unknown field", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("age"), Value: json.RawMessage(`30`), Dot: dot}, wantField: "age", wantErr: true},
+		{name: "wrong type", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`42`), Dot: dot}, wantField: "name", wantErr: true},
+		{name: "integer with a zero fraction", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("id"), Value: json.RawMessage(`1.0`), Dot: dot}},
+		{name: "integer with an exponent", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("id"), Value: json.RawMessage(`1e3`), Dot: dot}},
+		{name: "largest safe integer", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("id"), Value: json.RawMessage(`9007199254740992`), Dot: dot}},
+		{name: "integer beyond 2^53", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("id"), Value: json.RawMessage(`1e16`), Dot: dot}, wantField: "id", wantErr: true},
+		{name: "fractional integer", op: CRDTOperation{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`{"id":1.5,"name":"Alice"}`), Dot: dot}, wantField: "id", wantErr: true},
+		{name: "null in required field", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`null`), Dot: dot}, wantField: "name", wantErr: true},
+		{name: "null in non-nullable field", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("email"), Value: json.RawMessage(`null`), Dot: dot}, wantField: "email", wantErr: true},
+		{name: "setRow missing required field", op: CRDTOperation{Type: "setRow", Table: "posts", RowKey: "p1", Value: json.RawMessage(`{"id":"p1"}`), Dot: dot}, wantField: "content", wantErr: true},
+		{name: "setRow wrong nested type", op: CRDTOperation{Type: "setRow", Table: "posts", RowKey: "p1", Value: json.RawMessage(`{"id":"p1","content":"x","tags":"a,b"}`), Dot: dot}, wantField: "tags", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field, reason := registry.validateOperation(tt.op)
+			if (reason != "") != tt.wantErr {
+				t.Errorf("validateOperation() reason = %q, wantErr %v", reason, tt.wantErr)
+			}
+			if field != tt.wantField {
+				t.Errorf("validateOperation() field = %q, want %q", field, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestSchemaRegistryRegister(t *testing.T) {
+	registry := NewSchemaRegistry()
+
+	if err := registry.Register(TableSchema{Fields: map[string]FieldSchema{}}); err == nil {
+		t.Errorf("expected error for schema without a name")
+	}
+	if err := registry.Register(TableSchema{Name: "users", Fields: map[string]FieldSchema{"name": {Type: "text"}}}); err == nil {
+		t.Errorf("expected error for unknown field type")
+	}
+	if _, err := ParseTableSchemas([]byte(`{"tables": [], "unknown": true}`)); err == nil {
+		t.Errorf("expected error for unknown keys")
+	}
+
+	// An empty registry accepts anything
+	op := CRDTOperation{Type: "set", Table: "anything", RowKey: "1", Field: stringPtr("x"), Value: json.RawMessage(`1`)}
+	if invalid := registry.validateOperations([]CRDTOperation{op}); len(invalid) != 0 {
+		t.Errorf("expected empty registry to accept every operation, got %+v", invalid)
+	}
+}
+
+func TestSyncRejectsSchemaViolations(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+	for _, schema := range newTestSchemaRegistry(t).Tables() {
+		if err := service.Schemas().Register(schema); err != nil {
+			t.Fatalf("Register() error = %v", err)
+		}
+	}
+
+	client := "11111111-1111-1111-1111-111111111111"
+	_, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID: client,
+		Operations: []CRDTOperation{
+			{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`{"id":1,"name":"Alice"}`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 1}},
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("joinDate"), Value: json.RawMessage(`"yesterday"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 2}},
+		},
+		LastSeenServerVersion: -1,
+	}))
+
+	var syncErr *SyncError
+	if !errors.As(err, &syncErr) || syncErr.Code != ErrSchemaViolation {
+		t.Fatalf("expected %s error, got %v", ErrSchemaViolation, err)
+	}
+	if len(syncErr.Details) != 1 || syncErr.Details[0].Index != 1 || syncErr.Details[0].Field != "joinDate" {
+		t.Errorf("expected details for joinDate of operation 1, got %+v", syncErr.Details)
+	}
+}
@@ -0,0 +1,45 @@
+package sync_engine
+
+import (
+	"context"
+)
+
+// Snapshot returns the materialized state of every row in a table of a
+// namespace, or of all its tables when table is empty, together with the
+// server version it reflects. Rows include tombstones so late concurrent writes still lose
+// against removes the snapshot has already observed.
+func (sync_service *SyncService) Snapshot(ctx context.Context, namespace string, table string) (*SnapshotResponse, error) {
+	// Read rows and version in one transaction so they describe the same point in the log
+	tx, err := sync_service.store.Begin(ctx, true)
+	if err != nil {
+		return nil, NewSyncErrorf(ErrDatabaseError, "failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// The log's global maximum, also for filtered snapshots. Syncs aren't
+	// filtered by table, so this is the only version a client can resume
+	// from without skipping operations. Each row reports its own version.
+	serverVersion, err := tx.GetMaxServerVersion(ctx)
+	if err != nil {
+		return nil, NewSyncErrorf(ErrDatabaseError, "failed to get max server version: %v", err)
+	}
+
+	dbRows, err := tx.GetMaterializedRows(ctx, namespace, table)
+	if err != nil {
+		return nil, NewSyncErrorf(ErrDatabaseError, "failed to get materialized rows: %v", err)
+	}
+
+	rows := make([]MaterializedRow, len(dbRows))
+	for i, dbRow := range dbRows {
+		row, err := fromDatabaseRow(dbRow)
+		if err != nil {
+			return nil, NewSyncErrorf(ErrDatabaseError, "failed to convert materialized row %d: %v", i, err)
+		}
+		rows[i] = *row
+	}
+
+	return &SnapshotResponse{
+		ServerVersion: serverVersion,
+		Rows:          rows,
+	}, nil
+}
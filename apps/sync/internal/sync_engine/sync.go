@@ -2,51 +2,252 @@ package sync_engine
 
 import (
 	"context"
-	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"sync/internal/logging"
 	"sync/internal/repository"
+	"time"
 )
 
+const (
+	// DefaultPageSize is the default of Config.DefaultPageSize, the number of
+	// unseen operations returned per sync when the client doesn't ask for one.
+	DefaultPageSize = 1000
+
+	// MaxPageSize is the default of Config.MaxPageSize.
+	MaxPageSize = 5000
+)
+
+// Config tunes a SyncService. Start from DefaultConfig and override what
+// needs to change, the zero value is not valid.
+type Config struct {
+	// DefaultPageSize is used when a client doesn't ask for a page size.
+	DefaultPageSize int
+
+	// MaxPageSize caps the page size a client can negotiate.
+	MaxPageSize int
+
+	// AllowUnregisteredClients accepts syncs from client IDs that weren't
+	// issued by RegisterClient and have no key, so their requests can't
+	// prove who sent them. Only for clients that predate registration.
+	AllowUnregisteredClients bool
+}
+
+// DefaultConfig returns the settings the server runs with out of the box.
+func DefaultConfig() Config {
+	return Config{
+		DefaultPageSize: DefaultPageSize,
+		MaxPageSize:     MaxPageSize,
+	}
+}
+
+// Validate reports the first setting that can't be used.
+func (config Config) Validate() error {
+	if config.MaxPageSize <= 0 {
+		return fmt.Errorf("max page size must be positive, got %d", config.MaxPageSize)
+	}
+	if config.DefaultPageSize <= 0 || config.DefaultPageSize > config.MaxPageSize {
+		return fmt.Errorf("default page size must be between 1 and the max page size %d, got %d", config.MaxPageSize, config.DefaultPageSize)
+	}
+	return nil
+}
+
 type SyncService struct {
-	db *sql.DB
+	store   repository.OperationStore
+	hub     *NotificationHub
+	schemas *SchemaRegistry
+	config  Config
+
+	clientKeys ClientKeys
+
+	shuttingDown atomic.Bool
 }
 
-func NewSyncService(db *sql.DB) *SyncService {
+// NewSyncService creates a service on top of store.
+// The config must be valid, see Config.Validate.
+func NewSyncService(store repository.OperationStore, config Config) *SyncService {
 	return &SyncService{
-		db: db,
+		store:   store,
+		hub:     NewNotificationHub(),
+		schemas: NewSchemaRegistry(),
+		config:  config,
+	}
+}
+
+// Schemas returns the registry operations are checked against.
+// It starts out empty, which accepts operations on any table.
+func (sync_service *SyncService) Schemas() *SchemaRegistry {
+	return sync_service.schemas
+}
+
+// Ping checks that the store can be read and returns the latest server version.
+func (sync_service *SyncService) Ping(ctx context.Context) (int64, error) {
+	var maxServerVersion int64
+	err := sync_service.withTx(ctx, true, func(tx repository.StoreTx) error {
+		var err error
+		maxServerVersion, err = tx.GetMaxServerVersion(ctx)
+		return err
+	})
+	if err != nil {
+		return 0, NewSyncErrorf(ErrDatabaseError, "failed to read max server version: %v", err)
 	}
+	return maxServerVersion, nil
+}
+
+// Shutdown ends every event subscription and makes ShuttingDown report true,
+// so the server can stop taking traffic and drain. Syncs keep working, the
+// requests that are still running should be able to finish.
+func (sync_service *SyncService) Shutdown() {
+	sync_service.shuttingDown.Store(true)
+	sync_service.hub.Close()
 }
 
+// ShuttingDown reports whether Shutdown was called.
+func (sync_service *SyncService) ShuttingDown() bool {
+	return sync_service.shuttingDown.Load()
+}
+
+// withTx runs fn in a store transaction, committing it if fn succeeds and
+// rolling it back otherwise.
+func (sync_service *SyncService) withTx(ctx context.Context, readOnly bool, fn func(tx repository.StoreTx) error) error {
+	tx, err := sync_service.store.Begin(ctx, readOnly)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Subscribe registers for notifications about operations committed in a namespace.
+// The returned function must be called to unsubscribe.
+func (sync_service *SyncService) Subscribe(namespace string) (<-chan SyncNotification, func()) {
+	return sync_service.hub.Subscribe(namespace)
+}
+
+// Sync stores the client's operations and returns the operations it hasn't
+// seen yet. The client ID is added to the context's logger, so everything
+// logged while handling the request, down to the repository, carries it.
 func (sync_service *SyncService) Sync(ctx context.Context, req SyncRequest) (*SyncResponse, error) {
+	ctx = logging.With(ctx, "client_id", req.ClientID)
+
+	start := time.Now()
+	resp, err := sync_service.sync(ctx, req)
+	duration := time.Since(start)
+	recordSync(resp, err, duration)
+
+	if err == nil {
+		logging.FromContext(ctx).Debug("Sync completed",
+			"operations_received", len(req.Operations),
+			"operations_returned", len(resp.Operations),
+			"duration", duration,
+		)
+	}
+	return resp, err
+}
+
+// VerifySyncRequest checks that the request is intact and, for clients with
+// a key, signed by the client it names. Sync runs the same checks, callers
+// use it to tell a request really comes from its client before they
+// account it to that client.
+func (sync_service *SyncService) VerifySyncRequest(ctx context.Context, req SyncRequest) error {
+	_, err := sync_service.verifySyncRequest(ctx, req)
+	return err
+}
+
+// verifySyncRequest is VerifySyncRequest returning the client's key, nil if
+// the client has none.
+func (sync_service *SyncService) verifySyncRequest(ctx context.Context, req SyncRequest) ([]byte, error) {
+	if err := CheckProtocolVersion(req.ProtocolVersion); err != nil {
+		return nil, err
+	}
+
+	// Clients with a key sign their requests, the response is signed back
+	key, err := sync_service.clientKey(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := lookupKeyedProtocol(req.ProtocolVersion, key); err != nil {
+		return nil, err
+	}
+
 	// Hash and validate the request
-	err := ValidateSyncRequestIntegrity(req)
+	err = validateSyncRequestSignature(req, key)
 	if err != nil {
 		return nil, NewSyncErrorf(ErrRequestIntegrity, "request integrity check failed for client %s: %v", req.ClientID, err)
 	}
+	return key, nil
+}
 
-	tx, err := sync_service.db.Begin()
+func (sync_service *SyncService) sync(ctx context.Context, req SyncRequest) (*SyncResponse, error) {
+	key, err := sync_service.verifySyncRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reject the whole request if any operation is malformed, nothing is persisted
+	if invalid := validateOperations(req); len(invalid) > 0 {
+		syncErr := NewSyncErrorf(ErrInvalidOperation, "%d of %d operations are invalid", len(invalid), len(req.Operations))
+		syncErr.Details = invalid
+		return nil, syncErr
+	}
+	if invalid := sync_service.schemas.validateOperations(req.Operations); len(invalid) > 0 {
+		syncErr := NewSyncErrorf(ErrSchemaViolation, "%d of %d operations don't match their table schema", len(invalid), len(req.Operations))
+		syncErr.Details = invalid
+		return nil, syncErr
+	}
+
+	tx, err := sync_service.store.Begin(ctx, false)
 	if err != nil {
 		return nil, NewSyncErrorf(ErrDatabaseError, "failed to begin transaction: %v", err)
 	}
 	defer tx.Rollback()
 
-	// Convert incoming operations to database format and insert them
+	// Convert incoming operations to database format and insert them. The
+	// rows are folded from the stored form, like when they're rebuilt from
+	// the log, so snapshots see the same values either way.
 	dbOperations := make([]*repository.DBCRDTOperation, len(req.Operations))
+	storedOperations := make([]CRDTOperation, len(req.Operations))
 	for i, operation := range req.Operations {
 		dbOperation, err := operation.toDatabaseOperation()
 		if err != nil {
 			return nil, NewSyncErrorf(ErrInvalidOperation, "failed to convert operation %d to database format: %v", i, err)
 		}
+		dbOperation.Namespace = req.Namespace
 		dbOperations[i] = dbOperation
+
+		if storedOperations[i], err = fromDatabaseOperation(dbOperation); err != nil {
+			return nil, NewSyncErrorf(ErrInvalidOperation, "failed to convert operation %d from database format: %v", i, err)
+		}
 	}
 
-	serverVersions, err := repository.InsertCRDTOperations(ctx, tx, dbOperations)
+	// Retried operations keep their existing server version and don't count as inserted
+	serverVersions, inserted, err := tx.InsertCRDTOperations(ctx, dbOperations)
+	if errors.Is(err, repository.ErrConsistencyViolation) {
+		return nil, NewSyncErrorf(ErrInvalidOperation, "failed to insert the operations: %v", err)
+	}
 	if err != nil {
 		return nil, NewSyncErrorf(ErrDatabaseError, "failed to insert the operations: %v", err)
 	}
 
+	// Fold the operations into the current row state in the same transaction
+	// so the materialized rows never drift from the log
+	err = materializeOperations(ctx, tx, req.Namespace, storedOperations, serverVersions)
+	if errors.Is(err, errInapplicableOperation) {
+		return nil, NewSyncErrorf(ErrInvalidOperation, "failed to materialize operations: %v", err)
+	}
+	if err != nil {
+		return nil, NewSyncErrorf(ErrDatabaseError, "failed to materialize operations: %v", err)
+	}
+
 	// Check if client's lastSeenServerVersion is out of sync with the server
 	// This can happen if the server database was reset but clients still have old state
-	actualMaxServerVersion, err := repository.GetMaxServerVersion(ctx, tx)
+	actualMaxServerVersion, err := tx.GetMaxServerVersion(ctx)
 	if err != nil {
 		return nil, NewSyncErrorf(ErrDatabaseError, "failed to get max server version: %v", err)
 	}
@@ -60,18 +261,31 @@ func (sync_service *SyncService) Sync(ctx context.Context, req SyncRequest) (*Sy
 			req.LastSeenServerVersion, actualMaxServerVersion)
 	}
 
+	// Remember how far the client has caught up, this drives the
+	// compaction watermark
+	if err := recordClientState(ctx, tx, req, time.Now()); err != nil {
+		return nil, NewSyncErrorf(ErrDatabaseError, "failed to record client state: %v", err)
+	}
+
 	// Build list of dots that were synced
 	var syncedDots = make([]Dot, len(req.Operations))
 	for i, operation := range req.Operations {
 		syncedDots[i] = operation.Dot
 	}
 
-	// Get operations the client hasn't seen yet
-	unseenDBOperations, err := repository.GetCRDTOperationsSince(ctx, tx, req.LastSeenServerVersion, 1000, req.ClientID)
+	// Get operations the client hasn't seen yet. We ask for one extra
+	// operation so we can tell the client if there are more waiting.
+	pageSize := sync_service.config.negotiatePageSize(req.PageSize)
+	unseenDBOperations, err := tx.GetCRDTOperationsSince(ctx, req.Namespace, req.LastSeenServerVersion, pageSize+1, req.ClientID)
 	if err != nil {
 		return nil, NewSyncErrorf(ErrDatabaseError, "failed to get unseen operations: %v", err)
 	}
 
+	hasMore := len(unseenDBOperations) > pageSize
+	if hasMore {
+		unseenDBOperations = unseenDBOperations[:pageSize]
+	}
+
 	// Convert database operations to API format
 	unseenOperations := make([]CRDTOperation, len(unseenDBOperations))
 	for i, dbOperation := range unseenDBOperations {
@@ -86,9 +300,15 @@ func (sync_service *SyncService) Sync(ctx context.Context, req SyncRequest) (*Sy
 	// Start with the client's last seen version
 	maxServerVersion := req.LastSeenServerVersion
 
-	// Include newly inserted operations
-	for _, serverVersion := range serverVersions {
-		maxServerVersion = max(maxServerVersion, serverVersion)
+	// Include newly inserted operations, unless there are more pages to fetch.
+	// Those operations can have a higher server version than the unseen
+	// operations still waiting, and jumping past them would skip the rest
+	// of the backlog. The client's own operations are never returned to it,
+	// so it's safe to leave them out of the cursor.
+	if !hasMore {
+		for _, serverVersion := range serverVersions {
+			maxServerVersion = max(maxServerVersion, serverVersion)
+		}
 	}
 
 	// Include operations being returned to the client
@@ -96,16 +316,26 @@ func (sync_service *SyncService) Sync(ctx context.Context, req SyncRequest) (*Sy
 		maxServerVersion = max(maxServerVersion, dbOperation.ServerVersion)
 	}
 
+	// Only report the page size back to clients that asked for one
+	appliedPageSize := 0
+	if req.PageSize > 0 {
+		appliedPageSize = pageSize
+	}
+
 	response := SyncResponse{
+		ProtocolVersion: effectiveProtocolVersion(req.ProtocolVersion),
+
 		BaseServerVersion:   req.LastSeenServerVersion,
 		LatestServerVersion: maxServerVersion,
 
 		Operations:       unseenOperations,
 		SyncedOperations: syncedDots,
+		HasMore:          hasMore,
+		PageSize:         appliedPageSize,
 		ResponseHash:     "",
 	}
 
-	responseHash, err := HashSyncResponse(response)
+	responseHash, err := SignSyncResponse(response, key)
 	if err != nil {
 		return nil, NewSyncErrorf(ErrResponseIntegrity, "failed to hash response: %v", err)
 	}
@@ -116,5 +346,28 @@ func (sync_service *SyncService) Sync(ctx context.Context, req SyncRequest) (*Sy
 		return nil, NewSyncErrorf(ErrDatabaseError, "failed to commit transaction: %v", err)
 	}
 
+	duplicateOperations.Add(len(serverVersions) - inserted)
+	operationsInserted.Add(inserted)
+
+	// Only notify once the operations are visible to other syncs, and only
+	// about new ones. A retry made of operations that were already stored
+	// changes nothing for the other clients.
+	if inserted > 0 {
+		sync_service.hub.Publish(req.Namespace, SyncNotification{
+			LatestServerVersion: slices.Max(serverVersions),
+			ClientID:            req.ClientID,
+			OperationCount:      inserted,
+		})
+	}
+
 	return &response, nil
 }
+
+// negotiatePageSize returns the page size to use for a request.
+// Zero means the client has no preference, anything above the max page size is capped.
+func (config Config) negotiatePageSize(requested int) int {
+	if requested <= 0 {
+		return config.DefaultPageSize
+	}
+	return min(requested, config.MaxPageSize)
+}
@@ -0,0 +1,319 @@
+package sync_engine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/internal/repository"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// -------------------- Pagination tests --------------------
+
+func TestSyncPagination(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	// Writer pushes 25 operations in one sync
+	writer := "11111111-1111-1111-1111-111111111111"
+	operations := make([]CRDTOperation, 25)
+	for i := range operations {
+		operations[i] = CRDTOperation{
+			Type:    "set",
+			Table:   "users",
+			RowKey:  fmt.Sprintf("u%d", i),
+			Field:   stringPtr("name"),
+			Value:   json.RawMessage(`"Alice"`),
+			Context: map[string]int64{},
+			Dot:     Dot{ClientID: writer, Version: int64(i + 1)},
+		}
+	}
+	if _, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID:              writer,
+		Operations:            operations,
+		LastSeenServerVersion: -1,
+	})); err != nil {
+		t.Fatalf("writer sync failed: %v", err)
+	}
+
+	// Reader drains the backlog 10 operations at a time
+	reader := "22222222-2222-2222-2222-222222222222"
+	lastSeen := int64(-1)
+	received := 0
+	pages := 0
+	for {
+		resp, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+			ClientID:              reader,
+			Operations:            []CRDTOperation{},
+			LastSeenServerVersion: lastSeen,
+			PageSize:              10,
+		}))
+		if err != nil {
+			t.Fatalf("reader sync failed: %v", err)
+		}
+		if resp.PageSize != 10 {
+			t.Errorf("expected page size 10, got %d", resp.PageSize)
+		}
+
+		pages++
+		received += len(resp.Operations)
+		lastSeen = resp.LatestServerVersion
+		if !resp.HasMore {
+			break
+		}
+		if pages > 10 {
+			t.Fatalf("backlog never drained")
+		}
+	}
+
+	if pages != 3 {
+		t.Errorf("expected 3 pages, got %d", pages)
+	}
+	if received != len(operations) {
+		t.Errorf("expected %d operations, got %d", len(operations), received)
+	}
+}
+
+func TestSyncPaginationDoesNotSkipPastOwnOperations(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	other := "11111111-1111-1111-1111-111111111111"
+	if _, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID: other,
+		Operations: []CRDTOperation{
+			{Type: "set", Table: "users", RowKey: "a", Field: stringPtr("name"), Value: json.RawMessage(`"A"`), Context: map[string]int64{}, Dot: Dot{ClientID: other, Version: 1}},
+			{Type: "set", Table: "users", RowKey: "b", Field: stringPtr("name"), Value: json.RawMessage(`"B"`), Context: map[string]int64{}, Dot: Dot{ClientID: other, Version: 2}},
+		},
+		LastSeenServerVersion: -1,
+	})); err != nil {
+		t.Fatalf("other sync failed: %v", err)
+	}
+
+	// Client pushes its own operation while only reading one unseen operation
+	self := "22222222-2222-2222-2222-222222222222"
+	resp, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID: self,
+		Operations: []CRDTOperation{
+			{Type: "set", Table: "users", RowKey: "c", Field: stringPtr("name"), Value: json.RawMessage(`"C"`), Context: map[string]int64{}, Dot: Dot{ClientID: self, Version: 1}},
+		},
+		LastSeenServerVersion: -1,
+		PageSize:              1,
+	}))
+	if err != nil {
+		t.Fatalf("self sync failed: %v", err)
+	}
+
+	if !resp.HasMore {
+		t.Fatalf("expected more operations to be waiting")
+	}
+	if resp.LatestServerVersion != 1 {
+		t.Errorf("expected cursor to stop at last returned operation (1), got %d", resp.LatestServerVersion)
+	}
+}
+
+func TestSyncWithoutPageSize(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	resp, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID:              "11111111-1111-1111-1111-111111111111",
+		Operations:            []CRDTOperation{},
+		LastSeenServerVersion: -1,
+	}))
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+
+	// The page size is only echoed to clients that asked for one
+	if resp.PageSize != 0 {
+		t.Errorf("expected no page size, got %d", resp.PageSize)
+	}
+}
+
+// -------------------- Namespace tests --------------------
+
+func TestSyncIsolatesNamespaces(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	writer := "11111111-1111-1111-1111-111111111111"
+	request := signedRequest(t, SyncRequest{
+		ClientID: writer,
+		Operations: []CRDTOperation{
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Alice"`), Context: map[string]int64{}, Dot: Dot{ClientID: writer, Version: 1}},
+		},
+		LastSeenServerVersion: -1,
+	})
+	request.Namespace = "tenant-a"
+	if _, err := service.Sync(ctx, request); err != nil {
+		t.Fatalf("writer sync failed: %v", err)
+	}
+
+	reader := "22222222-2222-2222-2222-222222222222"
+	for namespace, want := range map[string]int{"tenant-a": 1, "tenant-b": 0} {
+		request := signedRequest(t, SyncRequest{
+			ClientID:              reader,
+			Operations:            []CRDTOperation{},
+			LastSeenServerVersion: -1,
+		})
+		request.Namespace = namespace
+
+		resp, err := service.Sync(ctx, request)
+		if err != nil {
+			t.Fatalf("reader sync in %s failed: %v", namespace, err)
+		}
+		if len(resp.Operations) != want {
+			t.Errorf("expected %d operations in %s, got %d", want, namespace, len(resp.Operations))
+		}
+
+		snapshot, err := service.Snapshot(ctx, namespace, "")
+		if err != nil {
+			t.Fatalf("snapshot of %s failed: %v", namespace, err)
+		}
+		if len(snapshot.Rows) != want {
+			t.Errorf("expected %d rows in %s snapshot, got %d", want, namespace, len(snapshot.Rows))
+		}
+	}
+}
+
+// Concurrent syncs against a WAL database, configured like the server's,
+// must wait for each other instead of failing with "database is locked".
+func TestConcurrentSyncs(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "sync.db") + "?_journal_mode=WAL&_busy_timeout=5000"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := repository.InitSchema(context.Background(), db); err != nil {
+		t.Fatalf("failed to init schema: %v", err)
+	}
+	service := NewSyncService(repository.NewSQLiteStore(db), legacyConfig())
+
+	const clients, syncsPerClient = 20, 20
+	errs := make(chan error, clients*syncsPerClient)
+	var wg sync.WaitGroup
+	for c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clientID := fmt.Sprintf("%08d-1111-1111-1111-111111111111", c)
+			lastSeen := int64(-1)
+			for i := range syncsPerClient {
+				req := SyncRequest{ClientID: clientID, LastSeenServerVersion: lastSeen, Operations: []CRDTOperation{{
+					Type: "set", Table: "users", RowKey: clientID, Field: stringPtr("n"), Value: json.RawMessage(fmt.Sprint(i)),
+					Context: map[string]int64{}, Dot: Dot{ClientID: clientID, Version: int64(i + 1)},
+				}}}
+				req.RequestHash, _ = HashSyncRequest(req)
+				resp, err := service.Sync(context.Background(), req)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				lastSeen = resp.LatestServerVersion
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	for err := range errs {
+		if failed == 0 {
+			t.Errorf("sync failed: %v", err)
+		}
+		failed++
+	}
+	if failed > 0 {
+		t.Errorf("%d of %d syncs failed", failed, clients*syncsPerClient)
+	}
+}
+
+func TestNegotiatePageSize(t *testing.T) {
+	custom := Config{DefaultPageSize: 50, MaxPageSize: 100}
+
+	tests := []struct {
+		config    Config
+		requested int
+		want      int
+	}{
+		{config: DefaultConfig(), requested: 0, want: DefaultPageSize},
+		{config: DefaultConfig(), requested: -5, want: DefaultPageSize},
+		{config: DefaultConfig(), requested: 10, want: 10},
+		{config: DefaultConfig(), requested: MaxPageSize + 1, want: MaxPageSize},
+		{config: custom, requested: 0, want: 50},
+		{config: custom, requested: 500, want: 100},
+	}
+
+	for _, tt := range tests {
+		if got := tt.config.negotiatePageSize(tt.requested); got != tt.want {
+			t.Errorf("%+v.negotiatePageSize(%d) = %d, want %d", tt.config, tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "default", config: DefaultConfig()},
+		{name: "zero value", config: Config{}, wantErr: true},
+		{name: "default above max", config: Config{DefaultPageSize: 200, MaxPageSize: 100}, wantErr: true},
+		{name: "default equals max", config: Config{DefaultPageSize: 100, MaxPageSize: 100}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// -------------------- helper --------------------
+
+func newTestSyncService(t *testing.T) *SyncService {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	// Every connection to :memory: gets its own database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if err := repository.InitSchema(context.Background(), db); err != nil {
+		t.Fatalf("failed to init schema: %v", err)
+	}
+
+	return NewSyncService(repository.NewSQLiteStore(db), legacyConfig())
+}
+
+// legacyConfig is DefaultConfig accepting unregistered clients, most tests
+// sync with made up client IDs.
+func legacyConfig() Config {
+	config := DefaultConfig()
+	config.AllowUnregisteredClients = true
+	return config
+}
+
+func signedRequest(t *testing.T, req SyncRequest) SyncRequest {
+	t.Helper()
+
+	hash, err := HashSyncRequest(req)
+	if err != nil {
+		t.Fatalf("failed to hash request: %v", err)
+	}
+	req.RequestHash = hash
+	return req
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync/internal/canonicaljson"
 	"sync/internal/repository"
 )
 
@@ -20,25 +21,55 @@ type CRDTOperation struct {
 	Value   json.RawMessage  `json:"value,omitempty"` // Only for set and setRow operations
 	Context map[string]int64 `json:"context"`         // Always present, empty map for non-remove operations
 	Dot     Dot              `json:"dot"`
+
+	// Encrypted operations carry ciphertext instead of plaintext values,
+	// see validateEncryptedOperation
+	Encrypted bool `json:"encrypted,omitempty"`
 }
 
 type SyncRequest struct {
+	// ProtocolVersion selects the request and response layout and hashing,
+	// requests without one are ProtocolV1.
+	ProtocolVersion int `json:"protocolVersion,omitempty"`
+
 	ClientID              string          `json:"clientId"`
 	Operations            []CRDTOperation `json:"operations"`
 	LastSeenServerVersion int64           `json:"lastSeenServerVersion"` // Last ServerVersion client saw
+	PageSize              int             `json:"pageSize,omitempty"`    // Max operations to return, 0 uses DefaultPageSize
 	RequestHash           string          `json:"requestHash"`
+
+	// Namespace partitions the data the client syncs. It is never sent by
+	// the client, the server sets it from the authenticated identity.
+	Namespace string `json:"-"`
 }
 
 type SyncResponse struct {
+	ProtocolVersion int `json:"protocolVersion,omitempty"` // Version of the request it answers
+
 	BaseServerVersion   int64 `json:"baseServerVersion"`
 	LatestServerVersion int64 `json:"latestServerVersion"`
 
 	Operations       []CRDTOperation `json:"operations"`
 	SyncedOperations []Dot           `json:"syncedOperations"`
 
+	// HasMore is true when more unseen operations are waiting after this page.
+	// The client should sync again from LatestServerVersion until it is false.
+	HasMore  bool `json:"hasMore"`
+	PageSize int  `json:"pageSize"` // Page size the server applied, 0 if the client didn't ask for one
+
 	ResponseHash string `json:"responseHash"`
 }
 
+// SnapshotResponse is the current state of every row, used to bootstrap new
+// clients without replaying the whole operation log. Clients continue
+// syncing from ServerVersion, the highest server version in the log even when
+// the snapshot is filtered by table. The highest version folded into each
+// row is in MaterializedRow.ServerVersion.
+type SnapshotResponse struct {
+	ServerVersion int64             `json:"serverVersion"`
+	Rows          []MaterializedRow `json:"rows"`
+}
+
 func (op *CRDTOperation) toDatabaseOperation() (*repository.DBCRDTOperation, error) {
 	valueStr, err := jsonRawMessageToString(op.Value)
 	if err != nil {
@@ -62,6 +93,7 @@ func (op *CRDTOperation) toDatabaseOperation() (*repository.DBCRDTOperation, err
 		Field:         op.Field,
 		Value:         valueStr,
 		Context:       contextStr,
+		Encrypted:     op.Encrypted,
 	}, nil
 }
 
@@ -89,11 +121,18 @@ func fromDatabaseOperation(dbOperation *repository.DBCRDTOperation) (CRDTOperati
 			ClientID: dbOperation.ClientID,
 			Version:  dbOperation.Version,
 		},
+		Encrypted: dbOperation.Encrypted,
 	}, nil
 }
 
 type SyncServiceInterface interface {
 	Sync(ctx context.Context, req SyncRequest) (*SyncResponse, error)
+	VerifySyncRequest(ctx context.Context, req SyncRequest) error
+	RegisterClient(ctx context.Context, namespace string) (*ClientRegistration, error)
+	Snapshot(ctx context.Context, namespace string, table string) (*SnapshotResponse, error)
+	Subscribe(namespace string) (<-chan SyncNotification, func())
+	Ping(ctx context.Context) (int64, error)
+	ShuttingDown() bool
 }
 
 // jsonRawMessageToString converts json.RawMessage to *string for database storage.
@@ -103,12 +142,14 @@ func jsonRawMessageToString(raw json.RawMessage) (*string, error) {
 		return nil, nil
 	}
 
-	// Validate it's valid JSON
-	if !json.Valid(raw) {
-		return nil, fmt.Errorf("invalid JSON in RawMessage: %s", string(raw))
+	// Stored canonical, so equal values from differently formatting clients
+	// are stored, hashed and returned the same
+	canonical, err := canonicaljson.Canonicalize(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON in RawMessage: %w", err)
 	}
 
-	str := string(raw)
+	str := string(canonical)
 	return &str, nil
 }
 
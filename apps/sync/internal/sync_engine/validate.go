@@ -0,0 +1,100 @@
+package sync_engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/internal/canonicaljson"
+)
+
+// OperationError describes why a single operation in a sync request was rejected.
+type OperationError struct {
+	Index  int    `json:"index"` // Position of the operation in SyncRequest.Operations
+	Dot    Dot    `json:"dot"`
+	Field  string `json:"field,omitempty"` // Offending field for schema violations
+	Reason string `json:"reason"`
+}
+
+// validateOperations checks every operation of a request against the rules of
+// its type and returns one error per invalid operation. The request hash only
+// proves the operations arrived as the client sent them, a buggy client can
+// still send operations that would break every client that receives them.
+func validateOperations(req SyncRequest) []OperationError {
+	var invalid []OperationError
+	for i, op := range req.Operations {
+		err := validateOperation(op, req.ClientID)
+		if err == nil && op.Encrypted {
+			err = validateEncryptedOperation(op, req.ProtocolVersion)
+		}
+		if err != nil {
+			invalid = append(invalid, OperationError{Index: i, Dot: op.Dot, Reason: err.Error()})
+		}
+	}
+	return invalid
+}
+
+// validateOperation returns the first rule the operation breaks.
+//
+//   - Every operation needs a table, a row key and a dot created by the syncing client.
+//   - Values are stored as canonical JSON, so their numbers must fit a double.
+//     Integers beyond ±2^53 are rejected for every protocol version, they
+//     would change on the way through and V3 hashes can't cover them.
+//   - set writes a single field, so it needs a field name and a value.
+//   - setRow writes several fields at once, its value must be an object of field values.
+//   - remove needs the context of dots it observed and carries no value.
+func validateOperation(op CRDTOperation, clientID string) error {
+	if op.Table == "" {
+		return errors.New("table is required")
+	}
+	if op.RowKey == "" {
+		return errors.New("rowKey is required")
+	}
+	if op.Dot.ClientID != clientID {
+		return fmt.Errorf("dot clientId %q does not match the syncing client", op.Dot.ClientID)
+	}
+	if op.Dot.Version < 0 {
+		return fmt.Errorf("dot version %d is negative", op.Dot.Version)
+	}
+	if len(op.Value) > 0 {
+		if !json.Valid(op.Value) {
+			return errors.New("value is not valid JSON")
+		}
+		if _, err := canonicaljson.Canonicalize(op.Value); err != nil {
+			return fmt.Errorf("value can't be stored exactly: %w", err)
+		}
+	}
+
+	switch op.Type {
+	case "set":
+		if op.Field == nil || *op.Field == "" {
+			return errors.New("set requires a field")
+		}
+		if len(op.Value) == 0 {
+			return errors.New("set requires a value")
+		}
+	case "setRow":
+		if op.Field != nil {
+			return errors.New("setRow must not have a field")
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(op.Value, &fields); err != nil || fields == nil {
+			return errors.New("setRow value must be a JSON object")
+		}
+	case "remove":
+		if op.Context == nil {
+			return errors.New("remove requires a context")
+		}
+		if op.Field != nil || len(op.Value) > 0 {
+			return errors.New("remove must not have a field or value")
+		}
+		for observedClientID, version := range op.Context {
+			if observedClientID == "" || version < 0 {
+				return fmt.Errorf("context entry %q: %d is invalid", observedClientID, version)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown operation type %q", op.Type)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package sync_engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// -------------------- Validation tests --------------------
+
+func TestValidateOperation(t *testing.T) {
+	const client = "11111111-1111-1111-1111-111111111111"
+	dot := Dot{ClientID: client, Version: 1}
+
+	tests := []struct {
+		name    string
+		op      CRDTOperation
+		wantErr bool
+	}{
+		{name: "valid set", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Alice"`), Context: map[string]int64{}, Dot: dot}},
+		{name: "valid setRow", op: CRDTOperation{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`{"name":"Alice"}`), Context: map[string]int64{}, Dot: dot}},
+		{name: "valid remove", op: CRDTOperation{Type: "remove", Table: "users", RowKey: "1", Context: map[string]int64{client: 1}, Dot: dot}},
+		{name: "version zero", op: CRDTOperation{Type: "remove", Table: "users", RowKey: "1", Context: map[string]int64{}, Dot: Dot{ClientID: client}}},
+		{name: "unknown type", op: CRDTOperation{Type: "delete", Table: "users", RowKey: "1", Context: map[string]int64{}, Dot: dot}, wantErr: true},
+		{name: "empty table", op: CRDTOperation{Type: "remove", RowKey: "1", Context: map[string]int64{}, Dot: dot}, wantErr: true},
+		{name: "empty row key", op: CRDTOperation{Type: "remove", Table: "users", Context: map[string]int64{}, Dot: dot}, wantErr: true},
+		{name: "negative version", op: CRDTOperation{Type: "remove", Table: "users", RowKey: "1", Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: -1}}, wantErr: true},
+		{name: "foreign dot", op: CRDTOperation{Type: "remove", Table: "users", RowKey: "1", Context: map[string]int64{}, Dot: Dot{ClientID: "someone-else", Version: 1}}, wantErr: true},
+		{name: "set without field", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Value: json.RawMessage(`"Alice"`), Dot: dot}, wantErr: true},
+		{name: "set without value", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Dot: dot}, wantErr: true},
+		{name: "setRow with scalar value", op: CRDTOperation{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`"Alice"`), Dot: dot}, wantErr: true},
+		{name: "setRow with null value", op: CRDTOperation{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`null`), Dot: dot}, wantErr: true},
+		{name: "remove without context", op: CRDTOperation{Type: "remove", Table: "users", RowKey: "1", Dot: dot}, wantErr: true},
+		{name: "remove with value", op: CRDTOperation{Type: "remove", Table: "users", RowKey: "1", Value: json.RawMessage(`1`), Context: map[string]int64{}, Dot: dot}, wantErr: true},
+		{name: "integer at 2^53", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("id"), Value: json.RawMessage(`9007199254740992`), Dot: dot}},
+		{name: "integer beyond 2^53", op: CRDTOperation{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("id"), Value: json.RawMessage(`9007199254740993`), Dot: dot}, wantErr: true},
+		{name: "nested integer beyond 2^53", op: CRDTOperation{Type: "setRow", Table: "users", RowKey: "1", Value: json.RawMessage(`{"ids":[-9007199254740993]}`), Dot: dot}, wantErr: true},
+		{name: "remove with negative context", op: CRDTOperation{Type: "remove", Table: "users", RowKey: "1", Context: map[string]int64{client: -1}, Dot: dot}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateOperation(tt.op, client)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateOperation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSyncRejectsInvalidOperations(t *testing.T) {
+	service := newTestSyncService(t)
+	ctx := context.Background()
+
+	client := "11111111-1111-1111-1111-111111111111"
+	_, err := service.Sync(ctx, signedRequest(t, SyncRequest{
+		ClientID: client,
+		Operations: []CRDTOperation{
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("name"), Value: json.RawMessage(`"Alice"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 1}},
+			{Type: "set", Table: "users", RowKey: "1", Value: json.RawMessage(`"Bob"`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 2}},
+		},
+		LastSeenServerVersion: -1,
+	}))
+
+	var syncErr *SyncError
+	if !errors.As(err, &syncErr) || syncErr.Code != ErrInvalidOperation {
+		t.Fatalf("expected %s error, got %v", ErrInvalidOperation, err)
+	}
+	if len(syncErr.Details) != 1 || syncErr.Details[0].Index != 1 || syncErr.Details[0].Dot.Version != 2 {
+		t.Errorf("expected details for operation 1, got %+v", syncErr.Details)
+	}
+
+	// The valid operation must not have been persisted either
+	snapshot, err := service.Snapshot(ctx, "", "")
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if len(snapshot.Rows) != 0 {
+		t.Errorf("expected no rows after rejected sync, got %d", len(snapshot.Rows))
+	}
+}
+
+func TestSyncRejectsInexactIntegers(t *testing.T) {
+	service := newTestSyncService(t)
+	client := "11111111-1111-1111-1111-111111111111"
+
+	// Rejected for V1 clients too, the value would change once stored
+	_, err := service.Sync(context.Background(), signedRequest(t, SyncRequest{
+		ProtocolVersion: ProtocolV1,
+		ClientID:        client,
+		Operations: []CRDTOperation{
+			{Type: "set", Table: "users", RowKey: "1", Field: stringPtr("id"), Value: json.RawMessage(`12345678901234567890`), Context: map[string]int64{}, Dot: Dot{ClientID: client, Version: 1}},
+		},
+		LastSeenServerVersion: -1,
+	}))
+
+	var syncErr *SyncError
+	if !errors.As(err, &syncErr) || syncErr.Code != ErrInvalidOperation {
+		t.Fatalf("expected %s error, got %v", ErrInvalidOperation, err)
+	}
+	if len(syncErr.Details) != 1 || syncErr.Details[0].Index != 0 {
+		t.Errorf("expected details for operation 0, got %+v", syncErr.Details)
+	}
+}
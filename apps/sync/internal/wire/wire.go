@@ -0,0 +1,548 @@
+// Package wire implements the compact binary encoding of sync requests and
+// responses, an alternative to JSON for bandwidth and CPU constrained clients.
+//
+// Every message starts with a format version byte. Integers are varints,
+// signed ones zig-zag encoded, and byte strings are prefixed with their
+// length. Strings are interned: each string is written as a uvarint
+// reference, 0 introduces a new string that follows inline, n refers to the
+// n-th string introduced earlier in the message. Table names, client IDs and
+// fields repeat across operations and are sent once.
+//
+// Operation values are carried as their JSON text, so the integrity hashes
+// computed by sync_engine are the same whichever encoding was used.
+//
+//	request   = header string(clientId) varint(lastSeenServerVersion)
+//	            uvarint(pageSize) string(requestHash) operations
+//	response  = header varint(baseServerVersion) varint(latestServerVersion)
+//	            operations uvarint(len) dot* bool(hasMore) uvarint(pageSize)
+//	            string(responseHash)
+//	header    = byte(2) uvarint(protocolVersion) | byte(1)
+//	operations = byte(0) | byte(1) uvarint(len) operation*
+//	operation = dot string(type) string(table) string(rowKey) byte(flags)
+//	            [string(field)] [bytes(value)] [uvarint(len) (string varint)*]
+//	dot       = string(clientId) varint(version)
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"sync/internal/sync_engine"
+)
+
+// ContentType selects the binary encoding for a sync request, responses to
+// it are sent with the same content type.
+const ContentType = "application/vnd.sync+binary"
+
+// Format versions, the first byte of every message. Version 1 has no
+// protocol version, it's decoded as sync_engine.ProtocolV1.
+const (
+	formatV1      = 1
+	formatV2      = 2
+	formatVersion = formatV2
+)
+
+// MaxStringBytes is the longest string, such as a table name or row key, the
+// format carries. Values are limited separately.
+const MaxStringBytes = 64 << 10
+
+// Operation flags, they record which optional parts follow and whether
+// the operation is encrypted.
+const (
+	flagField     = 1 << 0
+	flagValue     = 1 << 1
+	flagContext   = 1 << 2
+	flagEncrypted = 1 << 3
+)
+
+// ErrMalformed is wrapped by every error caused by invalid input, as opposed
+// to the limits or a failing reader.
+var ErrMalformed = errors.New("wire: malformed message")
+
+// Limits bound what a decoder accepts, zero means unlimited.
+type Limits struct {
+	MaxOperations int
+	MaxValueBytes int
+}
+
+// ------------------------------------------------------------------------
+// Encoding
+// ------------------------------------------------------------------------
+
+// MarshalSyncRequest encodes req in the binary format.
+func MarshalSyncRequest(req sync_engine.SyncRequest) []byte {
+	encoder := newEncoder(req.ProtocolVersion)
+	encoder.string(req.ClientID)
+	encoder.varint(req.LastSeenServerVersion)
+	encoder.uvarint(uint64(max(req.PageSize, 0)))
+	encoder.string(req.RequestHash)
+	encoder.operations(req.Operations)
+	return encoder.buf
+}
+
+// MarshalSyncResponse encodes resp in the binary format.
+func MarshalSyncResponse(resp sync_engine.SyncResponse) []byte {
+	encoder := newEncoder(resp.ProtocolVersion)
+	encoder.varint(resp.BaseServerVersion)
+	encoder.varint(resp.LatestServerVersion)
+	encoder.operations(resp.Operations)
+	encoder.uvarint(uint64(len(resp.SyncedOperations)))
+	for _, dot := range resp.SyncedOperations {
+		encoder.dot(dot)
+	}
+	encoder.bool(resp.HasMore)
+	encoder.uvarint(uint64(max(resp.PageSize, 0)))
+	encoder.string(resp.ResponseHash)
+	return encoder.buf
+}
+
+type encoder struct {
+	buf     []byte
+	strings map[string]uint64
+}
+
+func newEncoder(protocolVersion int) *encoder {
+	encoder := &encoder{buf: []byte{formatVersion}, strings: make(map[string]uint64)}
+	encoder.uvarint(uint64(max(protocolVersion, 0)))
+	return encoder
+}
+
+func (encoder *encoder) uvarint(value uint64) {
+	encoder.buf = binary.AppendUvarint(encoder.buf, value)
+}
+
+func (encoder *encoder) varint(value int64) {
+	encoder.buf = binary.AppendVarint(encoder.buf, value)
+}
+
+func (encoder *encoder) bool(value bool) {
+	if value {
+		encoder.buf = append(encoder.buf, 1)
+	} else {
+		encoder.buf = append(encoder.buf, 0)
+	}
+}
+
+func (encoder *encoder) bytes(value []byte) {
+	encoder.uvarint(uint64(len(value)))
+	encoder.buf = append(encoder.buf, value...)
+}
+
+func (encoder *encoder) string(value string) {
+	if reference, ok := encoder.strings[value]; ok {
+		encoder.uvarint(reference)
+		return
+	}
+	encoder.strings[value] = uint64(len(encoder.strings) + 1)
+	encoder.uvarint(0)
+	encoder.bytes([]byte(value))
+}
+
+func (encoder *encoder) dot(dot sync_engine.Dot) {
+	encoder.string(dot.ClientID)
+	encoder.varint(dot.Version)
+}
+
+// operations keeps nil apart from empty, the handler rejects omitted operations.
+func (encoder *encoder) operations(operations []sync_engine.CRDTOperation) {
+	encoder.bool(operations != nil)
+	if operations == nil {
+		return
+	}
+	encoder.uvarint(uint64(len(operations)))
+	for _, operation := range operations {
+		encoder.operation(operation)
+	}
+}
+
+func (encoder *encoder) operation(operation sync_engine.CRDTOperation) {
+	encoder.dot(operation.Dot)
+	encoder.string(operation.Type)
+	encoder.string(operation.Table)
+	encoder.string(operation.RowKey)
+
+	var flags byte
+	if operation.Field != nil {
+		flags |= flagField
+	}
+	if operation.Value != nil {
+		flags |= flagValue
+	}
+	if operation.Context != nil {
+		flags |= flagContext
+	}
+	if operation.Encrypted {
+		flags |= flagEncrypted
+	}
+	encoder.buf = append(encoder.buf, flags)
+
+	if operation.Field != nil {
+		encoder.string(*operation.Field)
+	}
+	if operation.Value != nil {
+		encoder.bytes(operation.Value)
+	}
+	if operation.Context != nil {
+		encoder.uvarint(uint64(len(operation.Context)))
+		// Sorted so equal operations encode to equal bytes
+		for _, clientID := range slices.Sorted(maps.Keys(operation.Context)) {
+			encoder.string(clientID)
+			encoder.varint(operation.Context[clientID])
+		}
+	}
+}
+
+// ------------------------------------------------------------------------
+// Decoding
+// ------------------------------------------------------------------------
+
+// DecodeSyncRequest reads a binary sync request. Crossing a limit returns a
+// *sync_engine.SyncError as soon as it happens, invalid input an error
+// wrapping ErrMalformed, and read errors are returned wrapped.
+func DecodeSyncRequest(reader io.Reader, limits Limits) (sync_engine.SyncRequest, error) {
+	var req sync_engine.SyncRequest
+
+	decoder, err := newDecoder(reader, limits)
+	if err != nil {
+		return req, err
+	}
+	req.ProtocolVersion = decoder.protocolVersion
+	if req.ClientID, err = decoder.string(); err != nil {
+		return req, err
+	}
+	if req.LastSeenServerVersion, err = decoder.varint(); err != nil {
+		return req, err
+	}
+	if req.PageSize, err = decoder.int(); err != nil {
+		return req, err
+	}
+	if req.RequestHash, err = decoder.string(); err != nil {
+		return req, err
+	}
+	if req.Operations, err = decoder.operations(); err != nil {
+		return req, err
+	}
+	return req, decoder.end()
+}
+
+// DecodeSyncResponse reads a binary sync response.
+func DecodeSyncResponse(reader io.Reader) (sync_engine.SyncResponse, error) {
+	var resp sync_engine.SyncResponse
+
+	decoder, err := newDecoder(reader, Limits{})
+	if err != nil {
+		return resp, err
+	}
+	resp.ProtocolVersion = decoder.protocolVersion
+	if resp.BaseServerVersion, err = decoder.varint(); err != nil {
+		return resp, err
+	}
+	if resp.LatestServerVersion, err = decoder.varint(); err != nil {
+		return resp, err
+	}
+	if resp.Operations, err = decoder.operations(); err != nil {
+		return resp, err
+	}
+
+	count, err := decoder.uvarint()
+	if err != nil {
+		return resp, err
+	}
+	resp.SyncedOperations = []sync_engine.Dot{}
+	for range count {
+		dot, err := decoder.dot()
+		if err != nil {
+			return resp, err
+		}
+		resp.SyncedOperations = append(resp.SyncedOperations, dot)
+	}
+
+	if resp.HasMore, err = decoder.bool(); err != nil {
+		return resp, err
+	}
+	if resp.PageSize, err = decoder.int(); err != nil {
+		return resp, err
+	}
+	if resp.ResponseHash, err = decoder.string(); err != nil {
+		return resp, err
+	}
+	return resp, decoder.end()
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type decoder struct {
+	reader          byteReader
+	limits          Limits
+	strings         []string
+	protocolVersion int
+}
+
+func newDecoder(reader io.Reader, limits Limits) (*decoder, error) {
+	buffered, ok := reader.(byteReader)
+	if !ok {
+		buffered = bufio.NewReader(reader)
+	}
+	decoder := &decoder{reader: buffered, limits: limits}
+
+	version, err := decoder.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch version {
+	case formatV1:
+		decoder.protocolVersion = sync_engine.ProtocolV1
+	case formatV2:
+		if decoder.protocolVersion, err = decoder.int(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown format version %d", ErrMalformed, version)
+	}
+	return decoder, nil
+}
+
+// readError wraps a failed read, running out of input is malformed input.
+func readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: unexpected end of message", ErrMalformed)
+	}
+	return fmt.Errorf("wire: %w", err)
+}
+
+func (decoder *decoder) byte() (byte, error) {
+	value, err := decoder.reader.ReadByte()
+	if err != nil {
+		return 0, readError(err)
+	}
+	return value, nil
+}
+
+func (decoder *decoder) bool() (bool, error) {
+	value, err := decoder.byte()
+	if err != nil {
+		return false, err
+	}
+	if value > 1 {
+		return false, fmt.Errorf("%w: invalid boolean %d", ErrMalformed, value)
+	}
+	return value == 1, nil
+}
+
+// uvarint reads an unsigned varint, see binary.AppendUvarint.
+func (decoder *decoder) uvarint() (uint64, error) {
+	var value uint64
+	for shift := 0; shift < 64; shift += 7 {
+		next, err := decoder.byte()
+		if err != nil {
+			return 0, err
+		}
+		if shift == 63 && next > 1 {
+			break
+		}
+		value |= uint64(next&0x7f) << shift
+		if next < 0x80 {
+			return value, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: varint overflows 64 bits", ErrMalformed)
+}
+
+// varint reads a zig-zag encoded signed varint, see binary.AppendVarint.
+func (decoder *decoder) varint() (int64, error) {
+	unsigned, err := decoder.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	value := int64(unsigned >> 1)
+	if unsigned&1 != 0 {
+		value = ^value
+	}
+	return value, nil
+}
+
+// int reads a uvarint that has to fit an int.
+func (decoder *decoder) int() (int, error) {
+	value, err := decoder.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if value > uint64(^uint32(0)>>1) {
+		return 0, fmt.Errorf("%w: integer %d is out of range", ErrMalformed, value)
+	}
+	return int(value), nil
+}
+
+// bytes reads length bytes, callers check the length against their limit
+// first. Without a limit the length is untrusted, so the buffer only grows
+// with the bytes actually read instead of being allocated up front.
+func (decoder *decoder) bytes(length uint64) ([]byte, error) {
+	value, err := io.ReadAll(io.LimitReader(decoder.reader, int64(min(length, math.MaxInt64))))
+	if err != nil {
+		return nil, readError(err)
+	}
+	if uint64(len(value)) < length {
+		return nil, readError(io.ErrUnexpectedEOF)
+	}
+	return value, nil
+}
+
+func (decoder *decoder) string() (string, error) {
+	reference, err := decoder.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if reference > 0 {
+		if reference > uint64(len(decoder.strings)) {
+			return "", fmt.Errorf("%w: string reference %d is undefined", ErrMalformed, reference)
+		}
+		return decoder.strings[reference-1], nil
+	}
+
+	length, err := decoder.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if length > MaxStringBytes {
+		return "", fmt.Errorf("%w: strings can be at most %d bytes", ErrMalformed, MaxStringBytes)
+	}
+	value, err := decoder.bytes(length)
+	if err != nil {
+		return "", err
+	}
+	decoder.strings = append(decoder.strings, string(value))
+	return string(value), nil
+}
+
+func (decoder *decoder) dot() (sync_engine.Dot, error) {
+	var dot sync_engine.Dot
+	var err error
+	if dot.ClientID, err = decoder.string(); err != nil {
+		return dot, err
+	}
+	dot.Version, err = decoder.varint()
+	return dot, err
+}
+
+func (decoder *decoder) operations() ([]sync_engine.CRDTOperation, error) {
+	present, err := decoder.bool()
+	if err != nil || !present {
+		return nil, err
+	}
+	count, err := decoder.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if decoder.limits.MaxOperations > 0 && count > uint64(decoder.limits.MaxOperations) {
+		return nil, sync_engine.NewSyncErrorf(sync_engine.ErrTooManyOperations,
+			"a sync request can carry at most %d operations, send the rest in another sync", decoder.limits.MaxOperations)
+	}
+
+	// The count isn't trusted for the allocation, the operations have to be there
+	operations := []sync_engine.CRDTOperation{}
+	for index := range count {
+		operation, err := decoder.operation(int(index))
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, operation)
+	}
+	return operations, nil
+}
+
+func (decoder *decoder) operation(index int) (sync_engine.CRDTOperation, error) {
+	var operation sync_engine.CRDTOperation
+	var err error
+
+	if operation.Dot, err = decoder.dot(); err != nil {
+		return operation, err
+	}
+	if operation.Type, err = decoder.string(); err != nil {
+		return operation, err
+	}
+	if operation.Table, err = decoder.string(); err != nil {
+		return operation, err
+	}
+	if operation.RowKey, err = decoder.string(); err != nil {
+		return operation, err
+	}
+	flags, err := decoder.byte()
+	if err != nil {
+		return operation, err
+	}
+	if flags&^(flagField|flagValue|flagContext|flagEncrypted) != 0 {
+		return operation, fmt.Errorf("%w: unknown operation flags %#x", ErrMalformed, flags)
+	}
+	operation.Encrypted = flags&flagEncrypted != 0
+
+	if flags&flagField != 0 {
+		field, err := decoder.string()
+		if err != nil {
+			return operation, err
+		}
+		operation.Field = &field
+	}
+
+	if flags&flagValue != 0 {
+		length, err := decoder.uvarint()
+		if err != nil {
+			return operation, err
+		}
+		if decoder.limits.MaxValueBytes > 0 && length > uint64(decoder.limits.MaxValueBytes) {
+			syncErr := sync_engine.NewSyncErrorf(sync_engine.ErrValueTooLarge, "operation values can be at most %d bytes", decoder.limits.MaxValueBytes)
+			syncErr.Details = []sync_engine.OperationError{{
+				Index:  index,
+				Dot:    operation.Dot,
+				Reason: fmt.Sprintf("value is %d bytes", length),
+			}}
+			return operation, syncErr
+		}
+		value, err := decoder.bytes(length)
+		if err != nil {
+			return operation, err
+		}
+		if !json.Valid(value) {
+			return operation, fmt.Errorf("%w: value of operation %d is not valid JSON", ErrMalformed, index)
+		}
+		operation.Value = value
+	}
+
+	if flags&flagContext != 0 {
+		count, err := decoder.uvarint()
+		if err != nil {
+			return operation, err
+		}
+		operation.Context = make(map[string]int64)
+		for range count {
+			clientID, err := decoder.string()
+			if err != nil {
+				return operation, err
+			}
+			if operation.Context[clientID], err = decoder.varint(); err != nil {
+				return operation, err
+			}
+		}
+	}
+
+	return operation, nil
+}
+
+// end checks that the message has no trailing data.
+func (decoder *decoder) end() error {
+	if _, err := decoder.reader.ReadByte(); err != io.EOF {
+		if err != nil {
+			return readError(err)
+		}
+		return fmt.Errorf("%w: unexpected data after the message", ErrMalformed)
+	}
+	return nil
+}
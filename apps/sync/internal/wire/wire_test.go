@@ -0,0 +1,187 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync/internal/sync_engine"
+	"testing"
+)
+
+func sampleOperations() []sync_engine.CRDTOperation {
+	const client = "11111111-1111-1111-1111-111111111111"
+	field := "name"
+	return []sync_engine.CRDTOperation{
+		{Type: "set", Table: "users", RowKey: "1", Field: &field, Value: json.RawMessage(`"Ada"`), Context: map[string]int64{}, Dot: sync_engine.Dot{ClientID: client, Version: 1}},
+		{Type: "setRow", Table: "users", RowKey: "2", Value: json.RawMessage(`{"name":"Grace","age":45}`), Context: map[string]int64{}, Dot: sync_engine.Dot{ClientID: client, Version: 2}},
+		{Type: "remove", Table: "users", RowKey: "1", Context: map[string]int64{client: 1, "other": 7}, Dot: sync_engine.Dot{ClientID: client, Version: 3}},
+		{Type: "set", Table: "users", RowKey: "3", Field: &field, Value: json.RawMessage(`null`), Dot: sync_engine.Dot{ClientID: client, Version: 4}},
+		{Type: "set", Table: "notes", RowKey: "1", Field: &field, Value: json.RawMessage(`"q83vEjRWeJA="`), Context: map[string]int64{}, Dot: sync_engine.Dot{ClientID: client, Version: 5}, Encrypted: true},
+	}
+}
+
+// -------------------- Round trip tests --------------------
+
+func TestSyncRequestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		req  sync_engine.SyncRequest
+	}{
+		{name: "empty operations", req: sync_engine.SyncRequest{ClientID: "client", Operations: []sync_engine.CRDTOperation{}, LastSeenServerVersion: -1, RequestHash: "hash"}},
+		{name: "omitted operations", req: sync_engine.SyncRequest{ClientID: "client", LastSeenServerVersion: 12}},
+		{name: "operations", req: sync_engine.SyncRequest{ClientID: "client", Operations: sampleOperations(), LastSeenServerVersion: 1 << 40, PageSize: 500, RequestHash: "hash"}},
+		{name: "protocol version", req: sync_engine.SyncRequest{ProtocolVersion: sync_engine.CurrentProtocolVersion, ClientID: "client", Operations: []sync_engine.CRDTOperation{}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeSyncRequest(bytes.NewReader(MarshalSyncRequest(tt.req)), Limits{})
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.req) {
+				t.Errorf("got %+v, want %+v", got, tt.req)
+			}
+		})
+	}
+}
+
+func TestSyncResponseRoundTrip(t *testing.T) {
+	resp := sync_engine.SyncResponse{
+		BaseServerVersion:   -1,
+		LatestServerVersion: 4,
+		Operations:          sampleOperations(),
+		SyncedOperations:    []sync_engine.Dot{{ClientID: "client", Version: 1}, {ClientID: "client", Version: 2}},
+		HasMore:             true,
+		PageSize:            1000,
+		ResponseHash:        "hash",
+	}
+
+	got, err := DecodeSyncResponse(bytes.NewReader(MarshalSyncResponse(resp)))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if !reflect.DeepEqual(got, resp) {
+		t.Errorf("got %+v, want %+v", got, resp)
+	}
+}
+
+func TestDecodeSyncResponseOversizedValue(t *testing.T) {
+	value := json.RawMessage(`"` + strings.Repeat("x", 100) + `"`)
+	resp := sync_engine.SyncResponse{
+		Operations: []sync_engine.CRDTOperation{
+			{Type: "setRow", Table: "users", RowKey: "1", Value: value, Dot: sync_engine.Dot{ClientID: "client", Version: 1}},
+		},
+		SyncedOperations: []sync_engine.Dot{},
+	}
+	encoded := MarshalSyncResponse(resp)
+
+	// Replace the value's length prefix with one far beyond the message
+	at := bytes.Index(encoded, value)
+	if at < 1 || encoded[at-1] != byte(len(value)) {
+		t.Fatalf("value length prefix not found")
+	}
+	crafted := binary.AppendUvarint(bytes.Clone(encoded[:at-1]), 1<<62)
+	crafted = append(crafted, encoded[at:]...)
+
+	if _, err := DecodeSyncResponse(bytes.NewReader(crafted)); !errors.Is(err, ErrMalformed) {
+		t.Errorf("got %v, want ErrMalformed", err)
+	}
+}
+
+func TestDecodeFormatV1(t *testing.T) {
+	// Format version 1 has no protocol version after the format byte
+	body := MarshalSyncRequest(sync_engine.SyncRequest{ClientID: "client", Operations: []sync_engine.CRDTOperation{}})
+	body = append([]byte{formatV1}, body[2:]...)
+
+	got, err := DecodeSyncRequest(bytes.NewReader(body), Limits{})
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if got.ProtocolVersion != sync_engine.ProtocolV1 || got.ClientID != "client" {
+		t.Errorf("got %+v, want a ProtocolV1 request from client", got)
+	}
+}
+
+// The hash is defined on the decoded request, so it must not depend on the encoding
+func TestHashIndependentOfEncoding(t *testing.T) {
+	req := sync_engine.SyncRequest{ClientID: "client", Operations: sampleOperations(), LastSeenServerVersion: -1}
+	hash, err := sync_engine.HashSyncRequest(req)
+	if err != nil {
+		t.Fatalf("failed to hash: %v", err)
+	}
+	req.RequestHash = hash
+
+	jsonBody, _ := json.Marshal(req)
+	var fromJSON sync_engine.SyncRequest
+	if err := json.Unmarshal(jsonBody, &fromJSON); err != nil {
+		t.Fatalf("failed to unmarshal JSON: %v", err)
+	}
+	fromBinary, err := DecodeSyncRequest(bytes.NewReader(MarshalSyncRequest(req)), Limits{})
+	if err != nil {
+		t.Fatalf("failed to decode binary: %v", err)
+	}
+
+	for name, decoded := range map[string]sync_engine.SyncRequest{"json": fromJSON, "binary": fromBinary} {
+		if err := sync_engine.ValidateSyncRequestIntegrity(decoded); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestStringsAreInterned(t *testing.T) {
+	operations := sampleOperations()
+	for range 5 {
+		operations = append(operations, operations...)
+	}
+	req := sync_engine.SyncRequest{ClientID: "client", Operations: operations, RequestHash: "hash"}
+
+	binaryBody := MarshalSyncRequest(req)
+	jsonBody, _ := json.Marshal(req)
+	if len(binaryBody)*2 > len(jsonBody) {
+		t.Errorf("binary request is %d bytes, expected less than half of the %d JSON bytes", len(binaryBody), len(jsonBody))
+	}
+}
+
+// -------------------- Decoding error tests --------------------
+
+func TestDecodeSyncRequestErrors(t *testing.T) {
+	valid := MarshalSyncRequest(sync_engine.SyncRequest{ClientID: "client", Operations: sampleOperations(), RequestHash: "hash"})
+
+	tests := []struct {
+		name          string
+		body          []byte
+		limits        Limits
+		wantMalformed bool
+		wantCode      sync_engine.SyncErrorCode
+	}{
+		{name: "empty", body: nil, wantMalformed: true},
+		{name: "unknown version", body: append([]byte{formatVersion + 1}, valid[1:]...), wantMalformed: true},
+		{name: "truncated", body: valid[:len(valid)-3], wantMalformed: true},
+		{name: "trailing data", body: append(bytes.Clone(valid), 0), wantMalformed: true},
+		{name: "undefined string reference", body: []byte{formatVersion, 0, 5}, wantMalformed: true},
+		{name: "varint overflow", body: []byte{formatVersion, 0, 0, 1, 'c', 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, wantMalformed: true},
+		{name: "too many operations", body: valid, limits: Limits{MaxOperations: 2}, wantCode: sync_engine.ErrTooManyOperations},
+		{name: "value too large", body: valid, limits: Limits{MaxValueBytes: 10}, wantCode: sync_engine.ErrValueTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeSyncRequest(bytes.NewReader(tt.body), tt.limits)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if tt.wantMalformed && !errors.Is(err, ErrMalformed) {
+				t.Errorf("got %v, want ErrMalformed", err)
+			}
+
+			var syncErr *sync_engine.SyncError
+			if tt.wantCode != "" && (!errors.As(err, &syncErr) || syncErr.Code != tt.wantCode) {
+				t.Errorf("got %v, want code %s", err, tt.wantCode)
+			}
+		})
+	}
+}
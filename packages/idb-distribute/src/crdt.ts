@@ -17,6 +17,7 @@ export type CRDTOperation =
     field?: string;
     value: any;
     dot: Dot;
+    encrypted?: boolean; // value is a ciphertext, see sync/encryption.ts
   }
   | {
     type: "setRow";
@@ -24,6 +25,7 @@ export type CRDTOperation =
     rowKey: ValidKey;
     value: Record<string, any>;
     dot: Dot;
+    encrypted?: boolean; // field values are ciphertexts, see sync/encryption.ts
   }
   | {
     type: "remove";
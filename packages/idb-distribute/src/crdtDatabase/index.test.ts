@@ -4,6 +4,9 @@ import { below } from "../indexes.ts";
 import "fake-indexeddb/auto";
 import { newDatabase } from "./builder.ts";
 import { IDBRepository } from "../IDBRepository.ts";
+import { CRDTOperation } from "../crdt.ts";
+import { canonicalResponseHash } from "../sync/canonicalHash.ts";
+import { PROTOCOL_VERSION, SYNC_PAGE_SIZE, SyncRequest, SyncResponse } from "../sync/index.ts";
 
 describe("CRDTDatabase", () => {
   const dbName = "test-crdt-query";
@@ -158,4 +161,100 @@ describe("CRDTDatabase", () => {
       expect(handler).toHaveBeenCalledTimes(1); // Not called again
     });
   });
+
+  describe("sync", () => {
+    const syncDbName = "test-crdt-sync";
+    let syncDb: CRDTDatabase<{ users: {} }>;
+
+    beforeEach(async () => {
+      syncDb = await newDatabase(syncDbName).addTable("users", {})
+        .withSyncRemote("http://localhost/sync")
+        .build()
+        .open();
+    });
+
+    afterEach(async () => {
+      vi.unstubAllGlobals();
+      await syncDb.close();
+      await new Promise<void>((resolve, reject) => {
+        const deleteRequest = indexedDB.deleteDatabase(syncDbName);
+        deleteRequest.onsuccess = () => resolve();
+        deleteRequest.onerror = () => reject(deleteRequest.error);
+      });
+    });
+
+    const userOperation = (rowKey: string, version: number): CRDTOperation => ({
+      type: "setRow",
+      table: "users",
+      rowKey,
+      value: { name: rowKey },
+      dot: { clientId: "other-client", version },
+    });
+
+    async function syncResponse(
+      response: Omit<SyncResponse, "responseHash" | "protocolVersion">,
+    ): Promise<SyncResponse> {
+      const unsigned = { protocolVersion: PROTOCOL_VERSION, ...response };
+      return { ...unsigned, responseHash: await canonicalResponseHash(unsigned) };
+    }
+
+    // Serves the responses in order and records the requests
+    function stubServer(responses: SyncResponse[]): SyncRequest[] {
+      const requests: SyncRequest[] = [];
+      vi.stubGlobal("fetch", vi.fn(async (_url: string, init: RequestInit) => {
+        requests.push(JSON.parse(init.body as string));
+        const body = responses[Math.min(requests.length, responses.length) - 1];
+        return { ok: true, status: 200, json: async () => body };
+      }));
+      return requests;
+    }
+
+    it("should keep syncing while the server has more pages", async () => {
+      const requests = stubServer([
+        await syncResponse({
+          baseServerVersion: -1,
+          latestServerVersion: 0,
+          operations: [userOperation("u1", 1)],
+          syncedOperations: [],
+          hasMore: true,
+          pageSize: SYNC_PAGE_SIZE,
+        }),
+        await syncResponse({
+          baseServerVersion: 0,
+          latestServerVersion: 1,
+          operations: [userOperation("u2", 2)],
+          syncedOperations: [],
+          hasMore: false,
+          pageSize: SYNC_PAGE_SIZE,
+        }),
+      ]);
+
+      await syncDb.sync();
+
+      expect(requests).toHaveLength(2);
+      expect(requests.map((request) => request.lastSeenServerVersion)).toEqual([-1, 0]);
+      expect(requests.every((request) => request.pageSize === SYNC_PAGE_SIZE)).toBe(true);
+      expect(await syncDb.table("users").get("u1")).toEqual({ _key: "u1", name: "u1" });
+      expect(await syncDb.table("users").get("u2")).toEqual({ _key: "u2", name: "u2" });
+    });
+
+    it("should stop when a page can't be applied", async () => {
+      // A stale response is dropped, syncing again would fetch the same page
+      const requests = stubServer([
+        await syncResponse({
+          baseServerVersion: 5,
+          latestServerVersion: 6,
+          operations: [userOperation("u1", 1)],
+          syncedOperations: [],
+          hasMore: true,
+          pageSize: SYNC_PAGE_SIZE,
+        }),
+      ]);
+
+      await syncDb.sync();
+
+      expect(requests).toHaveLength(1);
+      expect(await syncDb.table("users").get("u1")).toBeUndefined();
+    });
+  });
 });
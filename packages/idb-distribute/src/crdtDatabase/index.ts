@@ -109,24 +109,11 @@ export class CRDTDatabase<TSchema extends DatabaseSchema = EmptySchema> {
 
   async sync(): Promise<void> {
     try {
-      const tx = this.idbRepository.transaction([CLIENT_STATE_STORE, OPERATIONS_STORE]);
-      const syncRequest = await this.syncManager.createSyncRequest(tx);
-
-      const response = await this.syncManager.sendSyncRequest(this.syncRemote, syncRequest);
-
-      const writeTx = this.idbRepository.transaction([
-        CLIENT_STATE_STORE,
-        OPERATIONS_STORE,
-        ROWS_STORE,
-      ], "readwrite");
-      await this.syncManager.handleSyncResponse(writeTx, this.logicalClock, response);
-      await this.idbRepository.commit(writeTx);
-
-      const changedTables = new Set(
-        response.operations.map((operation) => operation.table),
-      );
-      for (const table of changedTables) {
-        this.tableSubscriptions.notify(table);
+      // Keep syncing while the server has more pages waiting, unless a page
+      // couldn't be applied, the next request would fetch it again
+      let hasMore = true;
+      while (hasMore) {
+        hasMore = await this.syncPage();
       }
     } catch (error: any) {
       // Check if this is a "client state out of sync" error using the error name
@@ -155,6 +142,35 @@ export class CRDTDatabase<TSchema extends DatabaseSchema = EmptySchema> {
     }
   }
 
+  /**
+   * Runs one sync round trip.
+   *
+   * @returns true if the response was applied and more pages are waiting
+   */
+  private async syncPage(): Promise<boolean> {
+    const tx = this.idbRepository.transaction([CLIENT_STATE_STORE, OPERATIONS_STORE]);
+    const syncRequest = await this.syncManager.createSyncRequest(tx);
+
+    const response = await this.syncManager.sendSyncRequest(this.syncRemote, syncRequest);
+
+    const writeTx = this.idbRepository.transaction([
+      CLIENT_STATE_STORE,
+      OPERATIONS_STORE,
+      ROWS_STORE,
+    ], "readwrite");
+    const applied = await this.syncManager.handleSyncResponse(writeTx, this.logicalClock, response);
+    await this.idbRepository.commit(writeTx);
+
+    const changedTables = new Set(
+      response.operations.map((operation) => operation.table),
+    );
+    for (const table of changedTables) {
+      this.tableSubscriptions.notify(table);
+    }
+
+    return applied && response.hasMore;
+  }
+
   async close(): Promise<void> {
     this.idbRepository.close();
   }
@@ -0,0 +1,161 @@
+/**
+ * Integrity hashes of protocol version 3, mirrors the server's canonical
+ * encoding in sync_engine/integrity.go. Every field is its byte length as a
+ * big-endian uint32 followed by its UTF-8 bytes, so no value can be mistaken
+ * for a field boundary. Values are their canonical JSON (RFC 8785) and version
+ * 4 adds whether an operation is encrypted after its dot. With a signing key the encoding is HMAC-SHA256 signed,
+ * without one it is hashed with SHA-256.
+ */
+import type { CRDTOperation, Dot } from "../crdt.ts";
+import type { SyncRequest, SyncResponse } from "./index.ts";
+
+const textEncoder = new TextEncoder();
+
+/**
+ * Serializes value as canonical JSON (RFC 8785), JSON.stringify with object
+ * keys sorted by their UTF-16 code units, mirroring the server's
+ * canonicaljson package so key order doesn't change the hash.
+ */
+export function canonicalJSON(value: unknown): string {
+  return canonicalValue(value) ?? "null";
+}
+
+/** Like JSON.stringify, undefined for values JSON can't hold. */
+function canonicalValue(value: unknown): string | undefined {
+  if (value !== null && typeof value === "object" && "toJSON" in value && typeof value.toJSON === "function") {
+    value = value.toJSON();
+  }
+  if (Array.isArray(value)) {
+    return `[${value.map((element) => canonicalValue(element) ?? "null").join(",")}]`;
+  }
+  if (value === null || typeof value !== "object") {
+    return JSON.stringify(value);
+  }
+
+  // Built by hand, objects would move integer-like keys to the front
+  const record = value as Record<string, unknown>;
+  const members: string[] = [];
+  for (const key of Object.keys(record).sort()) {
+    const member = canonicalValue(record[key]);
+    if (member !== undefined) members.push(`${JSON.stringify(key)}:${member}`);
+  }
+  return `{${members.join(",")}}`;
+}
+
+class CanonicalEncoder {
+  private version: number;
+  private chunks: Uint8Array[] = [];
+  private length = 0;
+
+  constructor(label: string, version: number) {
+    this.version = version;
+    this.string(label);
+    this.int(version);
+  }
+
+  field(value: Uint8Array) {
+    const prefix = new Uint8Array(4);
+    new DataView(prefix.buffer).setUint32(0, value.length);
+    this.chunks.push(prefix, value);
+    this.length += prefix.length + value.length;
+  }
+
+  string(value: string) {
+    this.field(textEncoder.encode(value));
+  }
+
+  int(value: number) {
+    this.string(String(value));
+  }
+
+  bool(value: boolean) {
+    this.string(String(value));
+  }
+
+  dot(dot: Dot) {
+    this.string(dot.clientId);
+    this.int(dot.version);
+  }
+
+  operation(op: CRDTOperation) {
+    this.string(op.type);
+    this.string(op.table);
+    this.string(String(op.rowKey));
+
+    const field = "field" in op ? op.field : undefined;
+    this.bool(field !== undefined);
+    if (field !== undefined) this.string(field);
+
+    const value = "value" in op ? op.value : undefined;
+    this.bool(value !== undefined);
+    if (value !== undefined) this.string(canonicalJSON(value));
+
+    const context = ("context" in op ? op.context : undefined) ?? {};
+    const clientIds = Object.keys(context).sort();
+    this.int(clientIds.length);
+    for (const clientId of clientIds) {
+      this.string(clientId);
+      this.int(context[clientId]);
+    }
+
+    this.dot(op.dot);
+    if (this.version >= 4) this.bool("encrypted" in op && op.encrypted === true);
+  }
+
+  async sum(key?: CryptoKey): Promise<string> {
+    const bytes = new Uint8Array(this.length);
+    let offset = 0;
+    for (const chunk of this.chunks) {
+      bytes.set(chunk, offset);
+      offset += chunk.length;
+    }
+
+    const digest = key
+      ? await crypto.subtle.sign("HMAC", key, bytes)
+      : await crypto.subtle.digest("SHA-256", bytes);
+    return Array.from(new Uint8Array(digest)).map((b) => b.toString(16).padStart(2, "0")).join("");
+  }
+}
+
+/** Imports a signing key issued by the server for HMAC-SHA256. */
+export function importSigningKey(secret: Uint8Array): Promise<CryptoKey> {
+  return crypto.subtle.importKey("raw", secret, { name: "HMAC", hash: "SHA-256" }, false, ["sign"]);
+}
+
+export function canonicalRequestHash(
+  req: Omit<SyncRequest, "requestHash">,
+  key?: CryptoKey,
+): Promise<string> {
+  const encoder = new CanonicalEncoder("sync-request", req.protocolVersion ?? 3);
+  encoder.string(req.clientId);
+  encoder.int(req.lastSeenServerVersion);
+  encoder.int(req.pageSize ?? 0);
+
+  encoder.int(req.operations.length);
+  for (const op of req.operations) {
+    encoder.operation(op);
+  }
+  return encoder.sum(key);
+}
+
+export function canonicalResponseHash(
+  resp: Omit<SyncResponse, "responseHash">,
+  key?: CryptoKey,
+): Promise<string> {
+  const encoder = new CanonicalEncoder("sync-response", resp.protocolVersion ?? 3);
+  encoder.int(resp.baseServerVersion);
+  encoder.int(resp.latestServerVersion);
+  encoder.bool(resp.hasMore);
+  encoder.int(resp.pageSize);
+
+  encoder.int(resp.operations.length);
+  for (const op of resp.operations) {
+    encoder.operation(op);
+  }
+
+  encoder.int(resp.syncedOperations.length);
+  for (const dot of resp.syncedOperations) {
+    encoder.dot(dot);
+  }
+  return encoder.sum(key);
+}
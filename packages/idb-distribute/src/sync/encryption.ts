@@ -0,0 +1,103 @@
+/**
+ * End-to-end encryption of operation values, mirrors the rules in the
+ * server's sync_engine/encryption.go. Every value is encrypted on its own and
+ * sent as a ciphertext string: a set carries one, a setRow an object of them.
+ * Field names, tables, row keys and dots stay readable so the server can still
+ * order, deduplicate and merge the operations without the key.
+ *
+ * Operations are stored in plaintext locally and only encrypted on their way
+ * to the server, encrypted operations from other clients are decrypted before
+ * they are applied.
+ */
+import type { CRDTOperation } from "../crdt.ts";
+
+/** Encrypts and decrypts single JSON values. */
+export interface PayloadCipher {
+  encrypt(plaintext: string): Promise<string>;
+  decrypt(ciphertext: string): Promise<string>;
+}
+
+const textEncoder = new TextEncoder();
+const textDecoder = new TextDecoder();
+
+const IV_LENGTH = 12;
+
+/**
+ * AES-GCM with a random IV per value. Ciphertexts are base64 of the IV
+ * followed by the encrypted bytes.
+ */
+export class AesGcmCipher implements PayloadCipher {
+  private key: CryptoKey;
+
+  constructor(key: CryptoKey) {
+    this.key = key;
+  }
+
+  /** Imports a raw 128 or 256 bit AES key. */
+  static async fromRawKey(secret: Uint8Array): Promise<AesGcmCipher> {
+    const key = await crypto.subtle.importKey("raw", secret, "AES-GCM", false, ["encrypt", "decrypt"]);
+    return new AesGcmCipher(key);
+  }
+
+  async encrypt(plaintext: string): Promise<string> {
+    const iv = crypto.getRandomValues(new Uint8Array(IV_LENGTH));
+    const encrypted = await crypto.subtle.encrypt({ name: "AES-GCM", iv }, this.key, textEncoder.encode(plaintext));
+
+    const bytes = new Uint8Array(IV_LENGTH + encrypted.byteLength);
+    bytes.set(iv);
+    bytes.set(new Uint8Array(encrypted), IV_LENGTH);
+    return toBase64(bytes);
+  }
+
+  async decrypt(ciphertext: string): Promise<string> {
+    const bytes = fromBase64(ciphertext);
+    const decrypted = await crypto.subtle.decrypt(
+      { name: "AES-GCM", iv: bytes.subarray(0, IV_LENGTH) },
+      this.key,
+      bytes.subarray(IV_LENGTH),
+    );
+    return textDecoder.decode(decrypted);
+  }
+}
+
+/** Returns a copy of a set or setRow with every value encrypted, removes are returned as is. */
+export async function encryptOperation(op: CRDTOperation, cipher: PayloadCipher): Promise<CRDTOperation> {
+  if (op.type === "set") {
+    return { ...op, value: await cipher.encrypt(JSON.stringify(op.value)), encrypted: true };
+  }
+  if (op.type === "setRow") {
+    const value: Record<string, string> = {};
+    for (const [field, fieldValue] of Object.entries(op.value)) {
+      value[field] = await cipher.encrypt(JSON.stringify(fieldValue));
+    }
+    return { ...op, value, encrypted: true };
+  }
+  return op;
+}
+
+/** Returns a plaintext copy of an encrypted operation, other operations are returned as is. */
+export async function decryptOperation(op: CRDTOperation, cipher: PayloadCipher): Promise<CRDTOperation> {
+  if (op.type === "set" && op.encrypted) {
+    const { encrypted: _, ...plaintext } = op;
+    return { ...plaintext, value: JSON.parse(await cipher.decrypt(op.value)) };
+  }
+  if (op.type === "setRow" && op.encrypted) {
+    const { encrypted: _, ...plaintext } = op;
+    const value: Record<string, unknown> = {};
+    for (const [field, ciphertext] of Object.entries(op.value)) {
+      value[field] = JSON.parse(await cipher.decrypt(ciphertext));
+    }
+    return { ...plaintext, value };
+  }
+  return op;
+}
+
+function toBase64(bytes: Uint8Array): string {
+  let binary = "";
+  for (const byte of bytes) binary += String.fromCharCode(byte);
+  return btoa(binary);
+}
+
+function fromBase64(value: string): Uint8Array {
+  return Uint8Array.from(atob(value), (char) => char.charCodeAt(0));
+}
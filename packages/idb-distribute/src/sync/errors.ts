@@ -1,3 +1,5 @@
+import type { Dot } from "../crdt.ts";
+
 /**
  * Error codes that can be returned by the sync server.
  * These match the error codes defined in the Go server.
@@ -20,6 +22,54 @@ export enum SyncErrorCode {
   
   /** Client ID is invalid or missing */
   INVALID_CLIENT_ID = "INVALID_CLIENT_ID",
+
+  /** One or more operations don't match the registered schema of their table */
+  SCHEMA_VIOLATION = "SCHEMA_VIOLATION",
+
+  /** Request credentials are missing or invalid */
+  UNAUTHORIZED = "UNAUTHORIZED",
+
+  /** Request body is malformed or a field is out of range */
+  BAD_REQUEST = "BAD_REQUEST",
+
+  /** Server is at capacity, the request was not processed */
+  SERVER_BUSY = "SERVER_BUSY",
+
+  /** Too many requests from this client or address, see the Retry-After header */
+  RATE_LIMITED = "RATE_LIMITED",
+
+  /** Request body exceeds the server's size limit */
+  REQUEST_TOO_LARGE = "REQUEST_TOO_LARGE",
+
+  /** Request carries more operations than the server accepts at once */
+  TOO_MANY_OPERATIONS = "TOO_MANY_OPERATIONS",
+
+  /** An operation's value exceeds the server's size limit */
+  VALUE_TOO_LARGE = "VALUE_TOO_LARGE",
+
+  /** Request body uses a Content-Encoding the server can't decode */
+  UNSUPPORTED_ENCODING = "UNSUPPORTED_ENCODING",
+
+  /** The client ID wasn't issued to this namespace, or the server only accepts issued IDs */
+  UNKNOWN_CLIENT = "UNKNOWN_CLIENT",
+
+  /** The server doesn't speak the request's protocol version, the client has to be updated */
+  UNSUPPORTED_PROTOCOL = "UNSUPPORTED_PROTOCOL",
+
+  /** Unexpected server failure */
+  INTERNAL_ERROR = "INTERNAL_ERROR",
+}
+
+/**
+ * Why a single operation of a sync request was rejected
+ */
+export interface OperationError {
+  /** Position of the operation in the request's operations */
+  index: number;
+  dot: Dot;
+  /** Offending field, only present for SCHEMA_VIOLATION */
+  field?: string;
+  reason: string;
 }
 
 /**
@@ -28,6 +78,12 @@ export enum SyncErrorCode {
 export interface SyncError {
   code: SyncErrorCode;
   message: string;
+  /** Whether sending the same request again can succeed */
+  retryable: boolean;
+  /** Rejected operations, only present for INVALID_OPERATION and SCHEMA_VIOLATION */
+  details?: OperationError[];
+  /** Protocol versions the server speaks, only present for UNSUPPORTED_PROTOCOL */
+  supportedProtocolVersions?: number[];
 }
 
 /**
@@ -7,9 +7,52 @@ import {
 } from "../IDBRepository.ts";
 import { PersistedLogicalClock } from "../persistedLogicalClock.ts";
 import { validateTransactionStores } from "../utils.ts";
+import { canonicalRequestHash, canonicalResponseHash, importSigningKey } from "./canonicalHash.ts";
+import { decryptOperation, encryptOperation, PayloadCipher } from "./encryption.ts";
 import { isSyncError, SyncErrorCode } from "./errors.ts";
+import { BINARY_CONTENT_TYPE, decodeSyncResponse, encodeSyncRequest, WireFormat } from "./wire.ts";
+
+/**
+ * Maximum operations sent per sync, matches the server's default limit.
+ * Operations beyond it stay unsynced and go out with the next sync.
+ */
+export const MAX_OPERATIONS_PER_REQUEST = 10_000;
+
+/**
+ * Remote operations asked for per sync, matches the server's default page
+ * size. Responses with hasMore set are followed by another sync.
+ */
+export const SYNC_PAGE_SIZE = 1000;
+
+/**
+ * Sync protocol version this client speaks. Version 3 hashes a length-prefixed
+ * canonical encoding, signed with the client's key when it has one. Version 4
+ * also covers whether operations are encrypted.
+ */
+export const PROTOCOL_VERSION = 4;
+
+/**
+ * Request bodies at least this long are gzipped when the browser supports
+ * CompressionStream. Responses are decompressed by fetch itself.
+ */
+const MIN_COMPRESS_LENGTH = 1024;
+
+async function encodeBody(body: string | Uint8Array): Promise<{ body: BodyInit; headers: Record<string, string> }> {
+  if (body.length < MIN_COMPRESS_LENGTH || typeof CompressionStream === "undefined") {
+    return { body, headers: {} };
+  }
+
+  const stream = new Blob([body]).stream().pipeThrough(new CompressionStream("gzip"));
+  return { body: await new Response(stream).blob(), headers: { "Content-Encoding": "gzip" } };
+}
 
 export interface SyncRequest {
+  /**
+   * Selects the layout and hashing of the request and its response. Servers
+   * treat requests without one as version 1.
+   */
+  protocolVersion?: number;
+
   clientId: string;
 
   /**
@@ -25,6 +68,12 @@ export interface SyncRequest {
    */
   lastSeenServerVersion: number;
 
+  /**
+   * Maximum number of remote operations to receive in one response. Omit to
+   * use the server default, the server caps values above its maximum.
+   */
+  pageSize?: number;
+
   /**
    * Detects corruption during transmission. Network issues or middleware could
    * silently modify the request, leading to data inconsistency.
@@ -33,6 +82,12 @@ export interface SyncRequest {
 }
 
 export interface SyncResponse {
+  /**
+   * Version of the request this response answers, missing from servers that
+   * predate versioning, which speak version 1.
+   */
+  protocolVersion?: number;
+
   /**
    * Detects race conditions where multiple syncs are in flight but returned out
    * of order. This ensures responses are applied in the correct sequence.
@@ -62,15 +117,77 @@ export interface SyncResponse {
    * re-sending operations that have already been committed to the server.
    */
   syncedOperations: Dot[];
+
+  /**
+   * Signals that more remote operations are waiting on the server. The client
+   * should sync again from latestServerVersion until this is false.
+   */
+  hasMore: boolean;
+
+  /**
+   * The page size the server applied to this response, 0 when the request
+   * didn't ask for one.
+   */
+  pageSize: number;
+}
+
+/** A client ID and signing secret issued by the server. */
+export interface ClientRegistration {
+  clientId: string;
+  secret: Uint8Array;
+}
+
+/**
+ * Asks the server for a client ID and the secret to sign its syncs with,
+ * endpointUrl is the server's POST /clients endpoint. The secret is only sent
+ * once, store both before using them.
+ */
+export async function registerClient(endpointUrl: string): Promise<ClientRegistration> {
+  const response = await fetch(endpointUrl, { method: "POST" });
+  const body = await response.json().catch(() => undefined);
+  if (!response.ok) {
+    if (isSyncError(body)) {
+      const error = new Error(`Client registration error [${body.code}]: ${body.message}`, { cause: body });
+      error.name = body.code;
+      throw error;
+    }
+    throw new Error(`Client registration failed (${response.status}): ${response.statusText || "Unknown error"}`);
+  }
+
+  return {
+    clientId: body.clientId,
+    secret: Uint8Array.from(atob(body.secret), (char) => char.charCodeAt(0)),
+  };
 }
 
 export class Sync {
   private idbRepository: IDBRepository;
+  private signingKey?: CryptoKey;
+  private cipher?: PayloadCipher;
+  private encryptedTables = new Set<string>();
 
   constructor(idbRepository: IDBRepository) {
     this.idbRepository = idbRepository;
   }
 
+  /**
+   * Signs requests with the key the server issued to this client and checks
+   * that responses are signed with it. Pass undefined to stop signing.
+   */
+  async setSigningKey(secret: Uint8Array | undefined): Promise<void> {
+    this.signingKey = secret ? await importSigningKey(secret) : undefined;
+  }
+
+  /**
+   * Encrypts the values of operations on the given tables before they are
+   * sent, so the server only ever sees ciphertext, and decrypts encrypted
+   * operations from other clients. Pass undefined to stop encrypting.
+   */
+  setPayloadCipher(cipher: PayloadCipher | undefined, tables: string[] = []): void {
+    this.cipher = cipher;
+    this.encryptedTables = new Set(cipher ? tables : []);
+  }
+
   /**
    * Creates a sync request containing local changes to send to the server.
    *
@@ -95,65 +212,84 @@ export class Sync {
       .getClientState(tx);
 
     // Extract operations using optimized compound index query
-    const operations = await this.idbRepository.getUnsyncedOperationsByClient(tx, clientId);
+    const operations = await this.encryptOperations(
+      (await this.idbRepository.getUnsyncedOperationsByClient(tx, clientId))
+        .slice(0, MAX_OPERATIONS_PER_REQUEST),
+    );
 
     // create integrity hash
     const requestHash = await this.createRequestHash({
+      protocolVersion: PROTOCOL_VERSION,
       clientId,
       lastSeenServerVersion,
+      pageSize: SYNC_PAGE_SIZE,
       operations,
     });
 
     return {
+      protocolVersion: PROTOCOL_VERSION,
       clientId,
       lastSeenServerVersion,
+      pageSize: SYNC_PAGE_SIZE,
       operations,
       requestHash,
     };
   }
 
-  async sendSyncRequest(endpointUrl: string, request: SyncRequest): Promise<SyncResponse> {
-    const body = JSON.stringify(request);
+  /**
+   * Sends a sync request to the server.
+   *
+   * @param format - "binary" uses the compact wire format, smaller and cheaper
+   * to parse than JSON. Errors are always returned as JSON.
+   */
+  async sendSyncRequest(
+    endpointUrl: string,
+    request: SyncRequest,
+    format: WireFormat = "json",
+  ): Promise<SyncResponse> {
+    const binary = format === "binary";
+    const encoded = await encodeBody(binary ? encodeSyncRequest(request) : JSON.stringify(request));
 
     try {
       const response = await fetch(endpointUrl, {
         method: "POST",
         headers: {
-          "Content-Type": "application/json",
+          "Content-Type": binary ? BINARY_CONTENT_TYPE : "application/json",
+          // Lets the server check the rate limit before reading the body
+          "X-Client-ID": request.clientId,
+          ...encoded.headers,
         },
-        body,
+        body: encoded.body,
       });
 
       if (!response.ok) {
         // Try to parse structured error from response
+        let errorData: unknown;
         try {
-          const errorData = await response.json();
-
-          // Check if this is a structured SyncError
-          if (isSyncError(errorData)) {
-            // For CLIENT_STATE_OUT_OF_SYNC, throw a special error that the client can catch
-            if (errorData.code === SyncErrorCode.CLIENT_STATE_OUT_OF_SYNC) {
-              const error = new Error(errorData.message);
-              error.name = SyncErrorCode.CLIENT_STATE_OUT_OF_SYNC;
-              throw error;
-            }
-
-            // For other sync errors, include the code in the error message
-            throw new Error(`Sync error [${errorData.code}]: ${errorData.message}`);
-          }
-
-          // Fallback for non-structured errors
-          const message = errorData.error || errorData.message || "Unknown error";
-          throw new Error(`Sync failed (${response.status}): ${message}`);
-        } catch (parseError) {
+          errorData = await response.json();
+        } catch {
           // If we can't parse the response, use status text
           throw new Error(
             `Sync failed (${response.status}): ${response.statusText || "Unknown error"}`,
           );
         }
+
+        if (isSyncError(errorData)) {
+          // The name carries the code so callers can tell "reset your state"
+          // apart from "try again", the cause carries retryable and details
+          const error = errorData.code === SyncErrorCode.CLIENT_STATE_OUT_OF_SYNC
+            ? new Error(errorData.message, { cause: errorData })
+            : new Error(`Sync error [${errorData.code}]: ${errorData.message}`, { cause: errorData });
+          error.name = errorData.code;
+          throw error;
+        }
+
+        throw new Error(`Sync failed (${response.status}): ${response.statusText || "Unknown error"}`);
       }
 
-      let syncResponse: SyncResponse = await response.json();
+      let syncResponse: SyncResponse = binary
+        ? decodeSyncResponse(new Uint8Array(await response.arrayBuffer()))
+        : await response.json();
 
       return syncResponse;
     } catch (error: any) {
@@ -176,19 +312,27 @@ export class Sync {
     }
   }
 
+  /**
+   * Applies a sync response to the local state.
+   *
+   * @returns true if the response was applied, false if it was dropped as
+   * stale or the transaction was aborted
+   */
   async handleSyncResponse(
     tx: IDBTransaction,
     logicalClock: PersistedLogicalClock,
     response: SyncResponse,
-  ): Promise<void> {
+  ): Promise<boolean> {
     validateTransactionStores(tx, [CLIENT_STATE_STORE, OPERATIONS_STORE, ROWS_STORE], "readwrite");
 
     // Start IDB requests FIRST to keep transaction alive
     // Get client state synchronously
     const clientStatePromise = this.idbRepository.getClientState(tx);
 
-    // Now we can safely await non-IDB operations (hash validation)
+    // Now we can safely await non-IDB operations (hash validation and
+    // decryption, the hash covers the ciphertext)
     await this.validateResponseHash(response);
+    const operations = await this.decryptOperations(response.operations);
 
     // Now await the client state
     const { clientId, lastSeenServerVersion } = await clientStatePromise;
@@ -198,7 +342,7 @@ export class Sync {
       console.warn(
         `Dropping sync response: expected clientId ${clientId}, got ${firstSyncedOperation.clientId}`,
       );
-      return;
+      return false;
     }
 
     // Check if response is stale/out-of-order - if so, drop it
@@ -207,12 +351,12 @@ export class Sync {
         `Dropping stale sync response: expected base ${lastSeenServerVersion}, got ${response.baseServerVersion}. ` +
           `This can happen with delayed syncs arriving after newer syncs have completed.`,
       );
-      return;
+      return false;
     }
 
     try {
       // Save operations and apply operations to materialized view
-      await this.applyRemoteOperations(tx, response.operations);
+      await this.applyRemoteOperations(tx, operations);
 
       // update lastSeenServerVersion to latestServerVersion from response
       await this.idbRepository.saveServerVersion(tx, response.latestServerVersion);
@@ -227,14 +371,14 @@ export class Sync {
       // We only sync the clocks if we get any new operations from the server
       // otherwise it would be unnesesary work where we'd sync the clock with -1
       // and keep the current value
-      if (response.operations.length) {
-        const highestVersion = response.operations.reduce((prev, curr) => {
+      if (operations.length) {
+        const highestVersion = operations.reduce((prev, curr) => {
           return Math.max(prev, curr.dot.version);
         }, -1);
         await logicalClock.sync(tx, highestVersion);
       }
 
-      return;
+      return true;
     } catch (err: any) {
       // Explicitly abort the transaction to ensure all writes are rolled back
       // JavaScript errors don't automatically abort transactions, so we must do it explicitly
@@ -247,8 +391,28 @@ export class Sync {
       // Don't re-throw - transaction has been aborted, let it complete
       // The caller should handle sync failures gracefully and retry
       console.error("Sync failed, transaction aborted:", err);
-      return;
+      return false;
+    }
+  }
+
+  private encryptOperations(operations: CRDTOperation[]): Promise<CRDTOperation[]> {
+    const cipher = this.cipher;
+    if (!cipher) return Promise.resolve(operations);
+    return Promise.all(
+      operations.map((op) => this.encryptedTables.has(op.table) ? encryptOperation(op, cipher) : op),
+    );
+  }
+
+  private async decryptOperations(operations: CRDTOperation[]): Promise<CRDTOperation[]> {
+    const cipher = this.cipher;
+    if (!cipher) {
+      const encrypted = operations.find((op) => "encrypted" in op && op.encrypted);
+      if (encrypted) {
+        throw new Error(`Received an encrypted operation on ${encrypted.table} without a payload cipher`);
+      }
+      return operations;
     }
+    return Promise.all(operations.map((op) => decryptOperation(op, cipher)));
   }
 
   /**
@@ -346,11 +510,26 @@ export class Sync {
   //  has a hash that is validated both on the server and client, this
   //  is not done for security reasons (even if it might help). Rather it's
   //  done to ensure correctness.
+  //
+  //  From protocol version 2 on the hashed parts start with the version.
+  //  Version 3 hashes a canonical encoding instead, see canonicalHash.ts,
+  //  and with a signing key it does prove who sent a request.
   private async createRequestHash(req: Omit<SyncRequest, "requestHash">): Promise<string> {
-    const parts: string[] = [
+    const version = req.protocolVersion ?? 1;
+    if (version >= 3) {
+      return canonicalRequestHash(req, this.signingKey);
+    }
+
+    const parts: string[] = version >= 2 ? [String(version)] : [];
+    parts.push(
       req.clientId,
       String(req.lastSeenServerVersion),
-    ];
+    );
+
+    // pageSize is optional and only hashed when set (matches Go)
+    if (req.pageSize) {
+      parts.push(String(req.pageSize));
+    }
 
     for (const op of req.operations) {
       let value = "null";
@@ -377,6 +556,13 @@ export class Sync {
         String(op.dot.version),
         op.dot.clientId,
       );
+
+      // Version 1 leaves remove contexts out of the request hash
+      if (version >= 2 && op.type === "remove") {
+        for (const key of Object.keys(op.context).sort()) {
+          parts.push(key, String(op.context[key]));
+        }
+      }
     }
 
     const result = await this.sha256Array(parts);
@@ -386,10 +572,21 @@ export class Sync {
   private async createResponseHash(
     response: Omit<SyncResponse, "responseHash">,
   ) {
-    const parts: string[] = [
+    const version = response.protocolVersion ?? 1;
+    if (version >= 3) {
+      return canonicalResponseHash(response, this.signingKey);
+    }
+
+    const parts: string[] = version >= 2 ? [String(version)] : [];
+    parts.push(
       String(response.baseServerVersion),
       String(response.latestServerVersion),
-    ];
+    );
+
+    // Paging fields are only hashed when the request asked for a page size (matches Go)
+    if (response.pageSize) {
+      parts.push(String(response.hasMore), String(response.pageSize));
+    }
 
     // Add operation fields - must match server hash logic exactly
     for (const operation of response.operations) {
@@ -0,0 +1,256 @@
+/**
+ * Binary wire format for sync requests and responses, mirrors the server's
+ * internal/wire package. Strings are interned per message and operation values
+ * travel as JSON text, so request and response hashes are unaffected.
+ */
+import type { CRDTOperation, Dot } from "../crdt.ts";
+import type { SyncRequest, SyncResponse } from "./index.ts";
+
+/** Content-Type that selects the binary format, the server answers in kind. */
+export const BINARY_CONTENT_TYPE = "application/vnd.sync+binary";
+
+export type WireFormat = "json" | "binary";
+
+// Version 2 carries the protocol version after the format byte
+const FORMAT_VERSION = 2;
+
+const FLAG_FIELD = 1 << 0;
+const FLAG_VALUE = 1 << 1;
+const FLAG_CONTEXT = 1 << 2;
+const FLAG_ENCRYPTED = 1 << 3;
+
+const textEncoder = new TextEncoder();
+const textDecoder = new TextDecoder("utf-8", { fatal: true });
+
+class Encoder {
+  private bytes: number[] = [FORMAT_VERSION];
+  private strings = new Map<string, number>();
+
+  constructor(protocolVersion: number) {
+    this.uvarint(protocolVersion);
+  }
+
+  // Integers may exceed 32 bits, so no bitwise operators here
+  uvarint(value: number) {
+    while (value >= 0x80) {
+      this.bytes.push((value % 0x80) + 0x80);
+      value = Math.floor(value / 0x80);
+    }
+    this.bytes.push(value);
+  }
+
+  varint(value: number) {
+    this.uvarint(value >= 0 ? value * 2 : -value * 2 - 1);
+  }
+
+  bool(value: boolean) {
+    this.bytes.push(value ? 1 : 0);
+  }
+
+  byteString(value: Uint8Array) {
+    this.uvarint(value.length);
+    for (const byte of value) this.bytes.push(byte);
+  }
+
+  string(value: string) {
+    const reference = this.strings.get(value);
+    if (reference !== undefined) {
+      this.uvarint(reference);
+      return;
+    }
+    this.strings.set(value, this.strings.size + 1);
+    this.uvarint(0);
+    this.byteString(textEncoder.encode(value));
+  }
+
+  dot(dot: Dot) {
+    this.string(dot.clientId);
+    this.varint(dot.version);
+  }
+
+  operation(op: CRDTOperation) {
+    this.dot(op.dot);
+    this.string(op.type);
+    this.string(op.table);
+    this.string(String(op.rowKey));
+
+    const field = "field" in op ? op.field : undefined;
+    const value = "value" in op ? op.value : undefined;
+    const context = "context" in op ? op.context : undefined;
+    const encrypted = "encrypted" in op && op.encrypted;
+
+    this.bytes.push(
+      (field !== undefined ? FLAG_FIELD : 0) |
+        (value !== undefined ? FLAG_VALUE : 0) |
+        (context !== undefined ? FLAG_CONTEXT : 0) |
+        (encrypted ? FLAG_ENCRYPTED : 0),
+    );
+
+    if (field !== undefined) this.string(field);
+    if (value !== undefined) this.byteString(textEncoder.encode(JSON.stringify(value)));
+    if (context !== undefined) {
+      const clientIds = Object.keys(context).sort();
+      this.uvarint(clientIds.length);
+      for (const clientId of clientIds) {
+        this.string(clientId);
+        this.varint(context[clientId]);
+      }
+    }
+  }
+
+  finish(): Uint8Array {
+    return Uint8Array.from(this.bytes);
+  }
+}
+
+class Decoder {
+  private bytes: Uint8Array;
+  private offset = 1;
+  private strings: string[] = [];
+  protocolVersion = 1;
+
+  constructor(bytes: Uint8Array) {
+    this.bytes = bytes;
+    if (bytes[0] === FORMAT_VERSION) {
+      this.protocolVersion = this.uvarint();
+    } else if (bytes[0] !== 1) {
+      throw new Error(`Unknown sync wire format version ${bytes[0]}`);
+    }
+  }
+
+  byte(): number {
+    if (this.offset >= this.bytes.length) {
+      throw new Error("Unexpected end of sync message");
+    }
+    return this.bytes[this.offset++];
+  }
+
+  uvarint(): number {
+    let value = 0;
+    let scale = 1;
+    for (;;) {
+      const byte = this.byte();
+      value += (byte % 0x80) * scale;
+      if (byte < 0x80) return value;
+      scale *= 0x80;
+    }
+  }
+
+  varint(): number {
+    const value = this.uvarint();
+    return value % 2 === 0 ? value / 2 : -(value + 1) / 2;
+  }
+
+  bool(): boolean {
+    return this.byte() === 1;
+  }
+
+  byteString(): Uint8Array {
+    const length = this.uvarint();
+    if (this.offset + length > this.bytes.length) {
+      throw new Error("Unexpected end of sync message");
+    }
+    const value = this.bytes.subarray(this.offset, this.offset + length);
+    this.offset += length;
+    return value;
+  }
+
+  string(): string {
+    const reference = this.uvarint();
+    if (reference > 0) {
+      if (reference > this.strings.length) {
+        throw new Error(`Undefined string reference ${reference} in sync message`);
+      }
+      return this.strings[reference - 1];
+    }
+    const value = textDecoder.decode(this.byteString());
+    this.strings.push(value);
+    return value;
+  }
+
+  dot(): Dot {
+    return { clientId: this.string(), version: this.varint() };
+  }
+
+  operation(): CRDTOperation {
+    const dot = this.dot();
+    const op: Record<string, unknown> = {
+      type: this.string(),
+      table: this.string(),
+      rowKey: this.string(),
+      dot,
+    };
+
+    const flags = this.byte();
+    if (flags & FLAG_FIELD) op.field = this.string();
+    if (flags & FLAG_VALUE) op.value = JSON.parse(textDecoder.decode(this.byteString()));
+    if (flags & FLAG_CONTEXT) {
+      const context: Record<string, number> = {};
+      const count = this.uvarint();
+      for (let i = 0; i < count; i++) {
+        const clientId = this.string();
+        context[clientId] = this.varint();
+      }
+      op.context = context;
+    }
+    if (flags & FLAG_ENCRYPTED) op.encrypted = true;
+
+    return op as CRDTOperation;
+  }
+
+  operations(): CRDTOperation[] {
+    if (!this.bool()) return [];
+    const count = this.uvarint();
+    const operations: CRDTOperation[] = [];
+    for (let i = 0; i < count; i++) {
+      operations.push(this.operation());
+    }
+    return operations;
+  }
+
+  end() {
+    if (this.offset !== this.bytes.length) {
+      throw new Error("Unexpected data after sync message");
+    }
+  }
+}
+
+export function encodeSyncRequest(request: SyncRequest): Uint8Array {
+  const encoder = new Encoder(request.protocolVersion ?? 0);
+  encoder.string(request.clientId);
+  encoder.varint(request.lastSeenServerVersion);
+  encoder.uvarint(request.pageSize ?? 0);
+  encoder.string(request.requestHash);
+  encoder.bool(true);
+  encoder.uvarint(request.operations.length);
+  for (const op of request.operations) {
+    encoder.operation(op);
+  }
+  return encoder.finish();
+}
+
+export function decodeSyncResponse(bytes: Uint8Array): SyncResponse {
+  const decoder = new Decoder(bytes);
+  const baseServerVersion = decoder.varint();
+  const latestServerVersion = decoder.varint();
+  const operations = decoder.operations();
+
+  const syncedOperations: Dot[] = [];
+  const count = decoder.uvarint();
+  for (let i = 0; i < count; i++) {
+    syncedOperations.push(decoder.dot());
+  }
+
+  const response: SyncResponse = {
+    protocolVersion: decoder.protocolVersion,
+    baseServerVersion,
+    latestServerVersion,
+    operations,
+    syncedOperations,
+    hasMore: decoder.bool(),
+    pageSize: decoder.uvarint(),
+    responseHash: decoder.string(),
+  };
+  decoder.end();
+  return response;
+}